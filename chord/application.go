@@ -0,0 +1,82 @@
+package chord
+
+// KeyRange is the range of identifiers (Start, End] on the ring, i.e. the keys owned by
+// the node End when its predecessor is Start
+type KeyRange struct {
+	Start Id
+	End   Id
+}
+
+// Contains returns if id falls within the range. A range which starts and ends on the same
+// identifier covers the whole ring, as is the case for a single node.
+func (r KeyRange) Contains(id Id) bool {
+	if r.Start == r.End {
+		return true
+	}
+
+	return Between(id, r.Start, r.End+1)
+}
+
+// Application is the upcall interface for services built on top of the ring, modelled on the
+// update upcall of the common API for structured peer-to-peer overlays (Dabek et al.)
+type Application interface {
+	// RangeChanged is called when the range of keys owned by the node grows or shrinks.
+	// It's called synchronously from the ring maintenance, so long running work should be
+	// moved to another goroutine.
+	RangeChanged(old, new KeyRange)
+}
+
+// RegisterApplication adds an application to be notified of ownership changes. If the range
+// has already moved on from the whole ring the node starts with, the application is called
+// straight away with the change it missed, so a node which started stabilising before the
+// application was registered doesn't lose the first upcall.
+func (n *LocalNode) RegisterApplication(app Application) {
+	n.muUpcalls.Lock()
+	defer n.muUpcalls.Unlock()
+
+	n.muApps.Lock()
+	n.apps = append(n.apps, app)
+	owned := n.owned
+	n.muApps.Unlock()
+
+	initial := KeyRange{Start: n.Identifier(), End: n.Identifier()}
+	if owned != initial {
+		app.RangeChanged(initial, owned)
+	}
+}
+
+// OwnedRange returns the range of keys the node last knew itself to be responsible for
+func (n *LocalNode) OwnedRange() KeyRange {
+	n.muApps.Lock()
+	defer n.muApps.Unlock()
+
+	return n.owned
+}
+
+// updateOwnedRange recomputes the owned range from a new predecessor and notifies the
+// registered applications if it has changed. A nil predecessor leaves the range as it was,
+// as the node can't know what it owns until a new predecessor rectifies it.
+func (n *LocalNode) updateOwnedRange(pred node) {
+	if pred == nil {
+		return
+	}
+
+	n.muUpcalls.Lock()
+	defer n.muUpcalls.Unlock()
+
+	n.muApps.Lock()
+	old := n.owned
+	n.owned = KeyRange{Start: pred.Identifier(), End: n.Identifier()}
+	new := n.owned
+	apps := make([]Application, len(n.apps))
+	copy(apps, n.apps)
+	n.muApps.Unlock()
+
+	if old == new {
+		return
+	}
+
+	for _, app := range apps {
+		app.RangeChanged(old, new)
+	}
+}
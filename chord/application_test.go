@@ -0,0 +1,87 @@
+package chord
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type recordingApp struct {
+	changes [][2]KeyRange
+}
+
+func (a *recordingApp) RangeChanged(old, new KeyRange) {
+	a.changes = append(a.changes, [2]KeyRange{old, new})
+}
+
+func TestKeyRangeContains(t *testing.T) {
+	r := KeyRange{Start: 10, End: 20}
+
+	assert.False(t, r.Contains(10), "the start of the range is exclusive")
+	assert.True(t, r.Contains(11))
+	assert.True(t, r.Contains(20), "the end of the range is inclusive")
+	assert.False(t, r.Contains(21))
+
+	wrapped := KeyRange{Start: 20, End: 10}
+	assert.True(t, wrapped.Contains(5))
+	assert.True(t, wrapped.Contains(10))
+	assert.False(t, wrapped.Contains(15))
+}
+
+func TestKeyRangeWholeRing(t *testing.T) {
+	r := KeyRange{Start: 5, End: 5}
+
+	for _, id := range []Id{0, 5, 6, 1<<m - 1} {
+		assert.True(t, r.Contains(id))
+	}
+}
+
+func TestRectifyNotifiesApplications(t *testing.T) {
+	a := CreateNode(1)
+	b := CreateNode(10)
+	a.Join(b)
+
+	app := &recordingApp{}
+	b.RegisterApplication(app)
+
+	b.Rectify(a)
+
+	assert.Len(t, app.changes, 1)
+	assert.Equal(t, KeyRange{Start: 10, End: 10}, app.changes[0][0])
+	assert.Equal(t, KeyRange{Start: 1, End: 10}, app.changes[0][1])
+	assert.Equal(t, KeyRange{Start: 1, End: 10}, b.OwnedRange())
+}
+
+func TestUnchangedRangeDoesNotNotify(t *testing.T) {
+	a := CreateNode(1)
+	b := CreateNode(10)
+	a.Join(b)
+	b.Rectify(a)
+
+	app := &recordingApp{}
+	b.RegisterApplication(app)
+	assert.Len(t, app.changes, 1, "registering reports the change already made")
+
+	b.Rectify(a)
+
+	assert.Len(t, app.changes, 1)
+}
+
+func TestLateApplicationSeesMissedChange(t *testing.T) {
+	a := CreateNode(1)
+	b := CreateNode(10)
+	a.Join(b)
+	b.Rectify(a)
+
+	app := &recordingApp{}
+	b.RegisterApplication(app)
+
+	assert.Len(t, app.changes, 1)
+	assert.Equal(t, KeyRange{Start: 10, End: 10}, app.changes[0][0])
+	assert.Equal(t, KeyRange{Start: 1, End: 10}, app.changes[0][1])
+
+	// A node still owning the whole ring has nothing to report
+	lone := &recordingApp{}
+	CreateNode(20).RegisterApplication(lone)
+	assert.Empty(t, lone.changes)
+}
@@ -15,6 +15,9 @@ type Id int64
 // m is the size of the Chord ring, i.e. the ring is modulo (1<<m)
 const m = 32
 
+// ID_BITS is the size of identifiers in bits, for applications which partition the ring
+const ID_BITS = m
+
 // The stabilization interval in milliseconds
 const STABILIZE_INTERVAL = 1000 * time.Millisecond
 const FINGER_INTERVAL = 500 * time.Millisecond
@@ -47,6 +50,18 @@ type LocalNode struct {
 	shutdown chan struct{}
 	wg       *sync.WaitGroup
 
+	events *eventHub
+
+	muApps sync.Mutex
+	apps   []Application
+	owned  KeyRange
+
+	// muUpcalls keeps the upcalls to applications in the order the range changed
+	muUpcalls sync.Mutex
+
+	muServices sync.Mutex
+	services   map[string]string
+
 	// Metrics
 	registry         *prometheus.Registry
 	operationCount   *prometheus.CounterVec
@@ -76,6 +91,7 @@ func CreateNode(Id Id) *LocalNode {
 		shutdown:      make(chan struct{}),
 		wg:            new(sync.WaitGroup),
 		successorList: CreateSuccessorList(10),
+		events:        newEventHub(),
 
 		operationCount: prometheus.NewCounterVec(operationsCounter, operationsCounterLabels),
 
@@ -97,6 +113,7 @@ func CreateNode(Id Id) *LocalNode {
 
 	n.setSuccessor(n)
 	n.predecessor = n
+	n.owned = KeyRange{Start: Id, End: Id}
 	n.nextFinger = 1
 
 	n.registry = prometheus.NewRegistry()
@@ -173,18 +190,27 @@ func (n *LocalNode) Stop() {
 	close(n.shutdown)
 	slog.Info("graceful shutdown")
 	n.wg.Wait()
+	n.events.close()
 	slog.Info("shutdown complete")
 }
 
 // Join joins a Chord ring containing the node p
 func (n *LocalNode) Join(p node) error {
-	n.predecessor = nil
+	n.muPred.Lock()
+	if n.predecessor != nil {
+		n.predecessor = nil
+		n.notifyPointer(PredecessorChanged, nil)
+	}
+	n.muPred.Unlock()
 
 	succ, _, err := p.FindSuccessor(n.Identifier(), 0)
 	if err != nil {
 		return err
 	}
+
+	before := n.successorList.Identifiers()
 	n.setSuccessor(succ)
+	n.notifySuccessorList(before)
 
 	return nil
 }
@@ -199,13 +225,21 @@ func (n *LocalNode) setSuccessor(p node) {
 	// TODO do we need separate locations?
 	n.muFinger.Lock()
 	defer n.muFinger.Unlock()
+	changed := !sameNode(n.finger[0], p)
 	n.finger[0] = p
 
 	n.successorGauge.Set(float64(n.successorList.Head().Identifier()))
+
+	if changed {
+		n.notifyPointer(SuccessorChanged, p)
+	}
 }
 
 // stabilize updates the successor list and informs the immediate successor of the node's presence
 func (n *LocalNode) stabilize() error {
+	before := n.successorList.Identifiers()
+	defer n.notifySuccessorList(before)
+
 	defer func() {
 		succ, _ := n.Successor()
 		if succ != nil {
@@ -283,21 +317,30 @@ func (n *LocalNode) checkPredecessor() {
 	if n.predecessor != nil && !n.predecessor.Alive() {
 		fmt.Println("The predecessor is dead, resetting")
 		n.predecessor = nil
+		n.notifyPointer(PredecessorChanged, nil)
 	}
 }
 
 func (n *LocalNode) Rectify(newPredc node) error {
 	n.muPred.Lock()
-	defer n.muPred.Unlock()
 
 	pred, _ := n.Predecessor()
 	if pred == nil || Between(newPredc.Identifier(), pred.Identifier(), n.Identifier()) {
 		slog.Info("accepted rectify", "remote_node", newPredc)
+		changed := !sameNode(pred, newPredc)
 		n.predecessor = newPredc
+		if changed {
+			n.notifyPointer(PredecessorChanged, newPredc)
+		}
 
 		n.predecessorGauge.Set(float64(n.predecessor.Identifier()))
 		n.operationCount.WithLabelValues("rectify", "success", fmt.Sprint(n.Identifier())).Inc()
 	}
+	pred = n.predecessor
+	n.muPred.Unlock()
+
+	// Applications are notified outside of the lock so they are free to query the node
+	n.updateOwnedRange(pred)
 
 	return nil
 }
@@ -318,6 +361,9 @@ func (n *LocalNode) fixFingers() {
 
 	n.muFinger.Lock()
 	defer n.muFinger.Unlock()
+	if !sameNode(n.finger[n.nextFinger], succ) {
+		n.notifyFinger(n.nextFinger, succ)
+	}
 	n.finger[n.nextFinger] = succ
 	n.nextFinger++
 }
@@ -33,6 +33,13 @@ func SavePeer(node node) {
 	defer store.mu.Unlock()
 	if curr, ok := store.peers[node.Identifier()]; ok && curr != node {
 		// log.Printf("overwriting peer for %d\n with: %v", node.Identifier(), node.String())
+
+		// Not every message describing a node carries its services, keep the ones we already know
+		if next, ok := node.(*RPCNode); ok && next.Services == nil {
+			if prev, ok := curr.(*RPCNode); ok {
+				next.Services = prev.Services
+			}
+		}
 	} else {
 		peersStoredTotal.Inc()
 	}
@@ -0,0 +1,186 @@
+package chord
+
+import (
+	"log/slog"
+	"sync"
+)
+
+// RingEventType identifies which of the local node's pointers changed
+type RingEventType int
+
+const (
+	PredecessorChanged RingEventType = iota
+	SuccessorChanged
+	SuccessorListChanged
+	FingerChanged
+)
+
+// The number of events buffered per subscriber before events are dropped
+const EVENT_BUFFER_SIZE = 64
+
+func (t RingEventType) String() string {
+	switch t {
+	case PredecessorChanged:
+		return "predecessor_changed"
+	case SuccessorChanged:
+		return "successor_changed"
+	case SuccessorListChanged:
+		return "successor_list_changed"
+	case FingerChanged:
+		return "finger_changed"
+	}
+
+	return "unknown"
+}
+
+// Peer is a snapshot of a node's identity which is safe to hand out of the package
+type Peer struct {
+	Id      Id
+	Address string
+
+	// Services are the endpoints the node advertises by name, see RegisterService
+	Services map[string]string
+}
+
+// RingEvent describes a single change to the local node's view of the ring
+type RingEvent struct {
+	Type RingEventType
+
+	// Node is the new value of the pointer, nil if the pointer has been cleared
+	Node *Peer
+
+	// Finger is the index of the finger table entry, only set for FingerChanged
+	Finger int
+
+	// Successors is the full successor list, only set for SuccessorListChanged
+	Successors []Peer
+}
+
+type eventHub struct {
+	mu     sync.Mutex
+	subs   map[int]chan RingEvent
+	nextId int
+	closed bool
+}
+
+func newEventHub() *eventHub {
+	return &eventHub{
+		subs: make(map[int]chan RingEvent),
+	}
+}
+
+// subscribe registers a new buffered channel, the returned function removes it
+func (h *eventHub) subscribe() (<-chan RingEvent, func()) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	ch := make(chan RingEvent, EVENT_BUFFER_SIZE)
+	if h.closed {
+		close(ch)
+		return ch, func() {}
+	}
+
+	id := h.nextId
+	h.nextId++
+	h.subs[id] = ch
+
+	return ch, func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		if sub, ok := h.subs[id]; ok {
+			delete(h.subs, id)
+			close(sub)
+		}
+	}
+}
+
+// publish delivers an event to every subscriber without blocking, slow subscribers miss events
+func (h *eventHub) publish(event RingEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for _, ch := range h.subs {
+		select {
+		case ch <- event:
+		default:
+			slog.Warn("dropping ring event for slow subscriber", "event", event.Type)
+		}
+	}
+}
+
+// close ends every subscription, no further events are delivered
+func (h *eventHub) close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.closed = true
+	for id, ch := range h.subs {
+		delete(h.subs, id)
+		close(ch)
+	}
+}
+
+// Subscribe returns a channel of changes to the node's predecessor, successor, successor list
+// and finger table. The channel is closed when the returned cancel function is called or the node stops.
+func (n *LocalNode) Subscribe() (<-chan RingEvent, func()) {
+	return n.events.subscribe()
+}
+
+func peerFromNode(p node) *Peer {
+	if p == nil {
+		return nil
+	}
+
+	peer := PeerOf(p)
+	return &peer
+}
+
+// sameNode compares two possibly nil nodes by identifier
+func sameNode(a, b node) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+
+	return a.Identifier() == b.Identifier()
+}
+
+func (n *LocalNode) notifyPointer(eventType RingEventType, p node) {
+	n.events.publish(RingEvent{
+		Type: eventType,
+		Node: peerFromNode(p),
+	})
+}
+
+func (n *LocalNode) notifyFinger(i int, p node) {
+	n.events.publish(RingEvent{
+		Type:   FingerChanged,
+		Node:   peerFromNode(p),
+		Finger: i,
+	})
+}
+
+// notifySuccessorList publishes the current successor list if it differs from before
+func (n *LocalNode) notifySuccessorList(before []Id) {
+	after := n.successorList.Identifiers()
+	if equalIds(before, after) {
+		return
+	}
+
+	n.events.publish(RingEvent{
+		Type:       SuccessorListChanged,
+		Successors: n.successorList.Peers(),
+	})
+}
+
+func equalIds(a, b []Id) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,88 @@
+package chord
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRectifyPublishesPredecessorChanged(t *testing.T) {
+	a := CreateNode(1)
+	b := CreateNode(2)
+	a.Join(b)
+
+	events, cancel := b.Subscribe()
+	defer cancel()
+
+	b.Rectify(a)
+
+	event := <-events
+	assert.Equal(t, PredecessorChanged, event.Type)
+	assert.Equal(t, a.Identifier(), event.Node.Id)
+}
+
+func TestJoinPublishesSuccessorChanged(t *testing.T) {
+	a := CreateNode(1)
+	b := CreateNode(10)
+
+	events, cancel := a.Subscribe()
+	defer cancel()
+
+	a.Join(b)
+
+	// The node was its own predecessor, joining clears it
+	event := <-events
+	assert.Equal(t, PredecessorChanged, event.Type)
+	assert.Nil(t, event.Node)
+
+	event = <-events
+	assert.Equal(t, SuccessorChanged, event.Type)
+	assert.Equal(t, b.Identifier(), event.Node.Id)
+
+	event = <-events
+	assert.Equal(t, SuccessorListChanged, event.Type)
+	assert.Equal(t, b.Identifier(), event.Successors[0].Id)
+}
+
+func TestRejoinPublishesPredecessorChanged(t *testing.T) {
+	a := CreateNode(1)
+	b := CreateNode(10)
+	a.Join(b)
+	a.Rectify(b)
+
+	events, cancel := a.Subscribe()
+	defer cancel()
+
+	a.Join(b)
+
+	event := <-events
+	assert.Equal(t, PredecessorChanged, event.Type)
+	assert.Nil(t, event.Node)
+
+	pred, _ := a.Predecessor()
+	assert.Nil(t, pred)
+}
+
+func TestUnchangedPointerPublishesNothing(t *testing.T) {
+	a := CreateNode(1)
+	b := CreateNode(2)
+	a.Join(b)
+	b.Rectify(a)
+
+	events, cancel := b.Subscribe()
+	defer cancel()
+
+	b.Rectify(a)
+
+	assert.Len(t, events, 0)
+}
+
+func TestCancelClosesSubscription(t *testing.T) {
+	a := CreateNode(1)
+
+	events, cancel := a.Subscribe()
+	cancel()
+
+	_, ok := <-events
+	assert.False(t, ok, "channel should be closed after cancelling")
+}
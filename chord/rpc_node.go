@@ -23,6 +23,9 @@ type RPCNode struct {
 	Address string
 
 	Id Id
+
+	// Services are the endpoints the node advertises, they're never modified once the node is created
+	Services map[string]string
 }
 
 func (n *RPCNode) getConnection() (chord_proto.ChordClient, error) {
@@ -57,10 +60,7 @@ func (n *RPCNode) Predecessor() (node, error) {
 		return nil, err
 	}
 
-	newNode := &RPCNode{
-		Id:      Id(p.Identifier),
-		Address: p.Address,
-	}
+	newNode := parsePeer(p)
 	SavePeer(newNode)
 
 	return newNode, nil
@@ -80,10 +80,7 @@ func (n *RPCNode) Successor() (node, error) {
 		return nil, err
 	}
 
-	newNode := &RPCNode{
-		Id:      Id(p.Identifier),
-		Address: p.Address,
-	}
+	newNode := parsePeer(p)
 	SavePeer(newNode)
 
 	return newNode, nil
@@ -106,10 +103,7 @@ func (n *RPCNode) FindSuccessor(id Id, pathLength int) (node, int, error) {
 		return nil, int(p.PathLength), err
 	}
 
-	newNode := &RPCNode{
-		Id:      Id(p.Node.Identifier),
-		Address: p.Node.Address,
-	}
+	newNode := parsePeer(p.Node)
 	SavePeer(newNode)
 
 	return newNode, int(p.PathLength), nil
@@ -156,10 +150,7 @@ func (n *RPCNode) SuccessorList() (*SuccessorList, error) {
 
 	for i := 0; i < int(succListResponse.NumSuccessors); i++ {
 		node := succListResponse.Nodes[i]
-		newNode := &RPCNode{
-			Address: node.Address,
-			Id:      Id(node.Identifier),
-		}
+		newNode := parsePeer(node)
 		SavePeer(newNode)
 		newSuccList.successors[i] = newNode
 	}
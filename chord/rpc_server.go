@@ -79,10 +79,7 @@ func (s *server) FindSuccessor(ctx context.Context, in *chord_proto.FindSuccesso
 }
 
 func (s *server) Rectify(ctx context.Context, in *chord_proto.Node) (*chord_proto.RectifyResponse, error) {
-	node := &RPCNode{
-		Address: in.Address,
-		Id:      Id(in.Identifier),
-	}
+	node := parsePeer(in)
 
 	// Definitely validate
 	SavePeer(node)
@@ -148,6 +145,28 @@ func (s *server) Alive(ctx context.Context, in *chord_proto.LivenessRequest) (*c
 	return &chord_proto.LivenessResponse{}, nil
 }
 
+func (s *server) WatchRing(in *chord_proto.WatchRingRequest, stream chord_proto.Chord_WatchRingServer) error {
+	events, cancel := s.local.Subscribe()
+	defer cancel()
+
+	for {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				return nil
+			}
+
+			err := stream.Send(serializeEvent(event))
+			if err != nil {
+				return err
+			}
+
+		case <-stream.Context().Done():
+			return stream.Context().Err()
+		}
+	}
+}
+
 func SetExternalAddress(addr string) {
 	externalAddress = addr
 }
@@ -160,10 +179,37 @@ func serializePeer(node node) *chord_proto.Node {
 	switch v := node.(type) {
 	case *LocalNode:
 		res.Address = externalAddress
+		res.Services = serializeServices(v.Services())
 
 	case *RPCNode:
 		res.Address = v.Address
+		res.Services = serializeServices(v.Services)
 	}
 
 	return &res
 }
+
+func serializeEvent(event RingEvent) *chord_proto.RingEvent {
+	res := &chord_proto.RingEvent{
+		Type:   chord_proto.RingEventType(event.Type),
+		Finger: int32(event.Finger),
+	}
+
+	if event.Node != nil {
+		res.Node = &chord_proto.Node{
+			Address:    event.Node.Address,
+			Identifier: int64(event.Node.Id),
+			Services:   serializeServices(event.Node.Services),
+		}
+	}
+
+	for _, p := range event.Successors {
+		res.Successors = append(res.Successors, &chord_proto.Node{
+			Address:    p.Address,
+			Identifier: int64(p.Id),
+			Services:   serializeServices(p.Services),
+		})
+	}
+
+	return res
+}
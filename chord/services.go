@@ -0,0 +1,93 @@
+package chord
+
+import (
+	chord_proto "chord_dht/protos/chord"
+	"net"
+	"sort"
+	"strconv"
+)
+
+// Applications built on the ring, such as the DHT, usually serve on a port of their own. They
+// register it on the local node, which advertises it to peers along with its identity, so other
+// nodes don't have to guess where the application on a node can be reached.
+
+// RegisterService advertises the port an application serves on under name. The endpoint uses
+// the node's external address, peers learn of it the next time the node is sent to them.
+func (n *LocalNode) RegisterService(name string, port int) {
+	host, _, _ := net.SplitHostPort(externalAddress)
+
+	n.muServices.Lock()
+	defer n.muServices.Unlock()
+
+	if n.services == nil {
+		n.services = make(map[string]string)
+	}
+	n.services[name] = net.JoinHostPort(host, strconv.Itoa(port))
+}
+
+// Services returns the endpoints registered on the node by name
+func (n *LocalNode) Services() map[string]string {
+	n.muServices.Lock()
+	defer n.muServices.Unlock()
+
+	services := make(map[string]string, len(n.services))
+	for name, address := range n.services {
+		services[name] = address
+	}
+
+	return services
+}
+
+// ServiceAddress returns the address the peer advertises for a service, or an empty string if
+// it hasn't advertised one
+func (p Peer) ServiceAddress(name string) string {
+	return p.Services[name]
+}
+
+// PeerOf returns a snapshot of a node's identity and endpoints
+func PeerOf(node node) Peer {
+	res := serializePeer(node)
+	return Peer{
+		Id:       Id(res.Identifier),
+		Address:  res.Address,
+		Services: parseServices(res.Services),
+	}
+}
+
+// parsePeer creates a remote node from its description by another node
+func parsePeer(in *chord_proto.Node) *RPCNode {
+	return &RPCNode{
+		Id:       Id(in.Identifier),
+		Address:  in.Address,
+		Services: parseServices(in.Services),
+	}
+}
+
+func serializeServices(services map[string]string) []*chord_proto.Service {
+	var res []*chord_proto.Service
+	for name, address := range services {
+		res = append(res, &chord_proto.Service{
+			Name:    name,
+			Address: address,
+		})
+	}
+
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Name < res[j].Name
+	})
+
+	return res
+}
+
+func parseServices(services []*chord_proto.Service) map[string]string {
+	if len(services) == 0 {
+		return nil
+	}
+
+	res := make(map[string]string, len(services))
+	for _, s := range services {
+		res[s.Name] = s.Address
+	}
+
+	return res
+}
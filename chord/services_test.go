@@ -0,0 +1,40 @@
+package chord
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegisteredServicesAreAdvertised(t *testing.T) {
+	SetExternalAddress("10.0.0.1:8080")
+
+	n := CreateNode(1)
+	n.RegisterService("dht", 9000)
+
+	peer := parsePeer(serializePeer(n))
+	assert.Equal(t, Id(1), peer.Id)
+	assert.Equal(t, "10.0.0.1:9000", peer.Services["dht"])
+	assert.Equal(t, "10.0.0.1:9000", PeerOf(peer).ServiceAddress("dht"))
+	assert.Equal(t, "", PeerOf(peer).ServiceAddress("other"))
+}
+
+func TestSavePeerKeepsKnownServices(t *testing.T) {
+	SavePeer(&RPCNode{Id: 1001, Address: "10.0.0.2:8080", Services: map[string]string{"dht": "10.0.0.2:9000"}})
+
+	// A node learned from a message without services, e.g. the bootstrap address
+	SavePeer(&RPCNode{Id: 1001, Address: "10.0.0.2:8080"})
+
+	node, err := GetPeer(1001)
+	assert.Nil(t, err)
+	assert.Equal(t, "10.0.0.2:9000", PeerOf(node).ServiceAddress("dht"))
+}
+
+func TestBootstrapServicesAreRegistered(t *testing.T) {
+	SetExternalAddress("10.0.0.3:8080")
+
+	n := CreateNode(2)
+	registerServices(n, map[string]int{"dht": 9000, "redis": 6379})
+
+	assert.Equal(t, map[string]string{"dht": "10.0.0.3:9000", "redis": "10.0.0.3:6379"}, n.Services())
+}
@@ -111,6 +111,36 @@ func (s *SuccessorList) UniqueSuccessors() bool {
 	return true
 }
 
+// Identifiers returns the identifiers of the non-empty entries in order
+func (s *SuccessorList) Identifiers() []Id {
+	s.Lock()
+	defer s.Unlock()
+
+	ids := make([]Id, 0, s.size)
+	for _, succ := range s.successors {
+		if succ != nil {
+			ids = append(ids, succ.Identifier())
+		}
+	}
+
+	return ids
+}
+
+// Peers returns a snapshot of the non-empty entries in order
+func (s *SuccessorList) Peers() []Peer {
+	s.Lock()
+	defer s.Unlock()
+
+	peers := make([]Peer, 0, s.size)
+	for _, succ := range s.successors {
+		if succ != nil {
+			peers = append(peers, *peerFromNode(succ))
+		}
+	}
+
+	return peers
+}
+
 func (s *SuccessorList) String() string {
 	line := ""
 	for _, succ := range s.successors {
@@ -21,6 +21,10 @@ type BootstrapConfig struct {
 	// An address and port of an existing node in the desired network, if unspecified,
 	// the ring will initialise with the single new node
 	BootstrapAddr string
+
+	// Services are the ports of applications to advertise by name, see RegisterService.
+	// They're registered before the node joins, so peers never see the node without them.
+	Services map[string]int
 }
 
 func Bootstrap(config BootstrapConfig) *LocalNode {
@@ -41,6 +45,7 @@ func Bootstrap(config BootstrapConfig) *LocalNode {
 
 		id := remote.Announce(port, nil)
 		node = CreateNode(id)
+		registerServices(node, config.Services)
 		SavePeer(node)
 
 		err := node.Join(remote)
@@ -51,6 +56,7 @@ func Bootstrap(config BootstrapConfig) *LocalNode {
 		log.Println("No bootstrap address provided, initialising a new Chord ring")
 		id := IdentifierFromAddress(addr)
 		node = CreateNode(id)
+		registerServices(node, config.Services)
 		SavePeer(node)
 	}
 
@@ -63,6 +69,12 @@ func Bootstrap(config BootstrapConfig) *LocalNode {
 	return node
 }
 
+func registerServices(node *LocalNode, services map[string]int) {
+	for name, port := range services {
+		node.RegisterService(name, port)
+	}
+}
+
 func getListener(port int) net.Listener {
 	lis, err := net.Listen("tcp", fmt.Sprintf("0.0.0.0:%v", port))
 	if err != nil {
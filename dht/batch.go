@@ -0,0 +1,306 @@
+package dht
+
+import (
+	"chord_dht/chord"
+	dht_proto "chord_dht/protos/dht"
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// The maximum number of keys in a single BatchGet or BatchSet
+const MAX_BATCH_KEYS = 10000
+
+// errorResult records the failure of a batch for a key
+func errorResult(key string, err error) *dht_proto.BatchResult {
+	st := status.Convert(err)
+	return &dht_proto.BatchResult{
+		Key:   key,
+		Code:  int32(st.Code()),
+		Error: st.Message(),
+	}
+}
+
+// batchKeys validates the keys of a batch, returning the keys they're stored under
+func batchKeys(namespace string, keys []string) ([]string, error) {
+	scoped := make([]string, len(keys))
+	for i, key := range keys {
+		var err error
+		scoped[i], err = requestKey(namespace, key)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return scoped, nil
+}
+
+// allIndices returns the indices of every key of a batch of n keys
+func allIndices(n int) []int {
+	indices := make([]int, n)
+	for i := range indices {
+		indices[i] = i
+	}
+
+	return indices
+}
+
+// groupByOwner finds the owner of every key, returning the indices of the keys owned by each
+// node under the address of its DHT server, the local node's under an empty address. Keys are
+// resolved in ring order and each owner's range is remembered, so neighbouring keys which share
+// an owner only cost a single lookup. Keys whose owner couldn't be found are returned in failed.
+func (s *Server) groupByOwner(keys []string) (map[string][]int, map[int]error) {
+	ids := make([]chord.Id, len(keys))
+	order := make([]int, len(keys))
+	for i, key := range keys {
+		ids[i] = ChordIdFromString(key)
+		order[i] = i
+	}
+	sort.Slice(order, func(i, j int) bool {
+		return ids[order[i]] < ids[order[j]]
+	})
+
+	groups := make(map[string][]int)
+	failed := make(map[int]error)
+
+	var covered *chord.KeyRange
+	var address string
+	for _, i := range order {
+		if covered == nil || !covered.Contains(ids[i]) {
+			covered = nil
+
+			owner, _, err := s.node.FindSuccessor(ids[i], 0)
+			if err != nil {
+				failed[i] = status.Errorf(codes.Unavailable, "could not find the owner of the key: %v", err)
+				continue
+			}
+
+			address = ""
+			if owner.Identifier() != s.node.Identifier() {
+				address = dhtAddress(chord.PeerOf(owner))
+			}
+
+			// Without the owner's predecessor the next key is looked up on its own
+			if pred, err := owner.Predecessor(); err == nil && pred != nil {
+				covered = &chord.KeyRange{Start: pred.Identifier(), End: owner.Identifier()}
+			}
+		}
+
+		groups[address] = append(groups[address], i)
+	}
+
+	return groups, failed
+}
+
+// fanOut serves a batch by sending each owner its group of keys in parallel. local serves the
+// keys owned by the node and remote the keys owned by the node at address, each returning a
+// result for every index in order.
+func (s *Server) fanOut(keys []string, local func(indices []int) []*dht_proto.BatchResult, remote func(address string, indices []int) ([]*dht_proto.BatchResult, error)) []*dht_proto.BatchResult {
+	results := make([]*dht_proto.BatchResult, len(keys))
+
+	groups, failed := s.groupByOwner(keys)
+	for i, err := range failed {
+		results[i] = errorResult(keys[i], err)
+	}
+
+	var wg sync.WaitGroup
+	for address, indices := range groups {
+		wg.Add(1)
+		go func(address string, indices []int) {
+			defer wg.Done()
+
+			var group []*dht_proto.BatchResult
+			var err error
+			if address == "" {
+				group = local(indices)
+			} else {
+				group, err = remote(address, indices)
+				if err == nil && len(group) != len(indices) {
+					err = fmt.Errorf("%v returned %v results for %v keys", address, len(group), len(indices))
+				}
+			}
+
+			for j, i := range indices {
+				if err != nil {
+					results[i] = errorResult(keys[i], err)
+				} else {
+					results[i] = group[j]
+				}
+			}
+		}(address, indices)
+	}
+	wg.Wait()
+
+	return results
+}
+
+// getOwned reads a key sent to the node as its owner. If it has moved since the batch was
+// grouped, it's read from wherever it is now.
+func (s *Server) getOwned(key string, c dht_proto.Consistency) *dht_proto.BatchResult {
+	namespace, unscoped := splitKey(key)
+
+	if c == dht_proto.Consistency_ONE {
+		if entry, ok := s.keystore.Lookup(key); ok && !entry.Deleted {
+			return &dht_proto.BatchResult{
+				Key:     key,
+				Value:   entry.Value,
+				Version: entry.Version,
+			}
+		}
+	}
+
+	var res *dht_proto.GetKeyResponse
+	var err error
+
+	id := ChordIdFromString(key)
+	if s.node.OwnedRange().Contains(id) && s.handoffSource(id) == "" {
+		if c == dht_proto.Consistency_ONE {
+			return errorResult(key, status.Error(codes.NotFound, "key not found"))
+		}
+		res, err = s.quorumRead(key, c)
+	} else {
+		res, err = s.GetKey(context.Background(), &dht_proto.GetKeyRequest{
+			Key:         unscoped,
+			Namespace:   namespace,
+			Consistency: c,
+			Proxy:       true,
+		})
+	}
+
+	if err != nil {
+		return errorResult(key, err)
+	}
+
+	return &dht_proto.BatchResult{
+		Key:     key,
+		Value:   res.Value,
+		Version: res.Version,
+	}
+}
+
+// setOwned writes a key sent to the node as its owner, proxying it on if it has moved
+func (s *Server) setOwned(namespace string, entry *dht_proto.BatchEntry, c dht_proto.Consistency) *dht_proto.BatchResult {
+	res, err := s.SetKey(context.Background(), &dht_proto.SetKeyRequest{
+		Key:         entry.Key,
+		Namespace:   namespace,
+		Value:       entry.Value,
+		TtlSeconds:  entry.TtlSeconds,
+		Consistency: c,
+		Proxy:       true,
+	})
+	if err != nil {
+		return errorResult(entry.Key, err)
+	}
+
+	return &dht_proto.BatchResult{
+		Key:     entry.Key,
+		Version: res.Version,
+	}
+}
+
+func (s *Server) BatchGet(ctx context.Context, in *dht_proto.BatchGetRequest) (*dht_proto.BatchGetResponse, error) {
+	if len(in.Keys) > MAX_BATCH_KEYS {
+		return nil, status.Errorf(codes.InvalidArgument, "batches are limited to %v keys", MAX_BATCH_KEYS)
+	}
+
+	fmt.Printf("Received BatchGet for %v keys\n", len(in.Keys))
+
+	keys, err := batchKeys(in.Namespace, in.Keys)
+	if err != nil {
+		return nil, err
+	}
+
+	getOwned := func(indices []int) []*dht_proto.BatchResult {
+		results := make([]*dht_proto.BatchResult, len(indices))
+		for j, i := range indices {
+			results[j] = s.getOwned(keys[i], in.Consistency)
+		}
+		return results
+	}
+
+	var results []*dht_proto.BatchResult
+	if in.Owned {
+		results = getOwned(allIndices(len(keys)))
+	} else {
+		results = s.fanOut(keys, getOwned, func(address string, indices []int) ([]*dht_proto.BatchResult, error) {
+			req := &dht_proto.BatchGetRequest{
+				Namespace:   in.Namespace,
+				Consistency: in.Consistency,
+				Owned:       true,
+			}
+			for _, i := range indices {
+				req.Keys = append(req.Keys, in.Keys[i])
+			}
+
+			res, err := batchGet(ctx, address, req)
+			if err != nil {
+				return nil, err
+			}
+			return res.Results, nil
+		})
+	}
+
+	for i, key := range in.Keys {
+		results[i].Key = key
+	}
+
+	return &dht_proto.BatchGetResponse{Results: results}, nil
+}
+
+func (s *Server) BatchSet(ctx context.Context, in *dht_proto.BatchSetRequest) (*dht_proto.BatchSetResponse, error) {
+	if len(in.Entries) > MAX_BATCH_KEYS {
+		return nil, status.Errorf(codes.InvalidArgument, "batches are limited to %v keys", MAX_BATCH_KEYS)
+	}
+
+	fmt.Printf("Received BatchSet for %v keys\n", len(in.Entries))
+
+	unscoped := make([]string, len(in.Entries))
+	for i, entry := range in.Entries {
+		unscoped[i] = entry.Key
+	}
+
+	keys, err := batchKeys(in.Namespace, unscoped)
+	if err != nil {
+		return nil, err
+	}
+
+	setOwned := func(indices []int) []*dht_proto.BatchResult {
+		results := make([]*dht_proto.BatchResult, len(indices))
+		for j, i := range indices {
+			results[j] = s.setOwned(in.Namespace, in.Entries[i], in.Consistency)
+		}
+		return results
+	}
+
+	var results []*dht_proto.BatchResult
+	if in.Owned {
+		results = setOwned(allIndices(len(keys)))
+	} else {
+		results = s.fanOut(keys, setOwned, func(address string, indices []int) ([]*dht_proto.BatchResult, error) {
+			req := &dht_proto.BatchSetRequest{
+				Namespace:   in.Namespace,
+				Consistency: in.Consistency,
+				Owned:       true,
+			}
+			for _, i := range indices {
+				req.Entries = append(req.Entries, in.Entries[i])
+			}
+
+			res, err := batchSet(ctx, address, req)
+			if err != nil {
+				return nil, err
+			}
+			return res.Results, nil
+		})
+	}
+
+	for i, key := range unscoped {
+		results[i].Key = key
+	}
+
+	return &dht_proto.BatchSetResponse{Results: results}, nil
+}
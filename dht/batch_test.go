@@ -0,0 +1,128 @@
+package dht
+
+import (
+	"chord_dht/chord"
+	dht_proto "chord_dht/protos/dht"
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+)
+
+func TestBatchRoundTrip(t *testing.T) {
+	s := testServer()
+
+	set, err := s.BatchSet(context.Background(), &dht_proto.BatchSetRequest{
+		Entries: []*dht_proto.BatchEntry{
+			{Key: "a", Value: []byte("1")},
+			{Key: "b", Value: []byte("2")},
+		},
+	})
+	assert.Nil(t, err)
+	assert.Len(t, set.Results, 2)
+	for _, r := range set.Results {
+		assert.Equal(t, int32(codes.OK), r.Code)
+		assert.NotZero(t, r.Version)
+	}
+
+	get, err := s.BatchGet(context.Background(), &dht_proto.BatchGetRequest{
+		Keys: []string{"b", "missing", "a"},
+	})
+	assert.Nil(t, err)
+
+	results := parseBatchResults(get.Results)
+	assert.Equal(t, "b", results[0].Key)
+	assert.Equal(t, []byte("2"), results[0].Value)
+	assert.Equal(t, set.Results[1].Version, results[0].Version)
+	assert.Equal(t, codes.NotFound, codes.Code(get.Results[1].Code))
+	assert.NotNil(t, results[1].Err)
+	assert.Equal(t, []byte("1"), results[2].Value)
+	assert.Nil(t, results[2].Err)
+}
+
+func TestBatchLimit(t *testing.T) {
+	s := testServer()
+
+	_, err := s.BatchGet(context.Background(), &dht_proto.BatchGetRequest{
+		Keys: make([]string, MAX_BATCH_KEYS+1),
+	})
+	assert.NotNil(t, err)
+}
+
+func TestGroupByOwnerSingleNode(t *testing.T) {
+	s := testServer()
+
+	keys := make([]string, 100)
+	for i := range keys {
+		keys[i] = fmt.Sprint(i)
+	}
+
+	groups, failed := s.groupByOwner(keys)
+	assert.Empty(t, failed)
+	assert.Len(t, groups, 1)
+	assert.Len(t, groups[""], len(keys), "a single node owns every key")
+}
+
+func TestFanOutToSeveralOwners(t *testing.T) {
+	s := testServer()
+
+	// Node 1 knows b as its successor and b knows c, so keys are split between b and c
+	b := chord.CreateNode(1 << (chord.ID_BITS - 1))
+	c := chord.CreateNode(3 << (chord.ID_BITS - 2))
+	b.RegisterService(SERVICE_NAME, 9002)
+	c.RegisterService(SERVICE_NAME, 9003)
+	s.node.Join(b)
+	b.Join(c)
+
+	addressB := dhtAddress(chord.PeerOf(b))
+	addressC := dhtAddress(chord.PeerOf(c))
+	owner := func(key string) string {
+		if (chord.KeyRange{Start: s.node.Identifier(), End: b.Identifier()}).Contains(ChordIdFromString(key)) {
+			return addressB
+		}
+		return addressC
+	}
+
+	keys := make([]string, 200)
+	for i := range keys {
+		keys[i] = fmt.Sprint(i)
+	}
+
+	groups, failed := s.groupByOwner(keys)
+	assert.Empty(t, failed)
+	assert.Len(t, groups, 2)
+	for address, indices := range groups {
+		for _, i := range indices {
+			assert.Equal(t, owner(keys[i]), address, "key %v", keys[i])
+		}
+	}
+
+	// Each owner answers for its own group, c sends back too few results
+	results := s.fanOut(keys, func(indices []int) []*dht_proto.BatchResult {
+		t.Error("no key is owned locally")
+		return nil
+	}, func(address string, indices []int) ([]*dht_proto.BatchResult, error) {
+		if address == addressC {
+			return nil, nil
+		}
+
+		var group []*dht_proto.BatchResult
+		for _, i := range indices {
+			group = append(group, &dht_proto.BatchResult{Key: keys[i], Value: []byte(address)})
+		}
+		return group, nil
+	})
+
+	assert.Len(t, results, len(keys))
+	for i, result := range results {
+		assert.Equal(t, keys[i], result.Key, "results are in the order of the keys")
+		if owner(keys[i]) == addressB {
+			assert.Equal(t, int32(codes.OK), result.Code)
+			assert.Equal(t, []byte(addressB), result.Value)
+		} else {
+			assert.NotEqual(t, int32(codes.OK), result.Code)
+		}
+	}
+}
@@ -1,75 +1,898 @@
 package dht
 
 import (
+	"chord_dht/chord"
 	dht_proto "chord_dht/protos/dht"
 	"context"
 	"fmt"
+	"io"
+	"net"
+	"strconv"
 	"sync"
 	"time"
 
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
 )
 
 const DHT_PORT = 8081
 
+// The maximum number of redirections followed before a request is abandoned
+const MAX_REDIRECTS = 16
+
+// forwardAddress returns the address a redirect points to, nodes which don't send the port
+// of the DHT server serve on DHT_PORT
+func forwardAddress(n *dht_proto.Node) string {
+	port := int(n.Port)
+	if port == 0 {
+		port = DHT_PORT
+	}
+
+	return net.JoinHostPort(n.Address, strconv.Itoa(port))
+}
+
+// Connections to DHT servers are shared by every request to the same address, a connection
+// reconnects by itself if the server goes away and comes back
+var (
+	muConnections sync.Mutex
+	connections   = make(map[string]*grpc.ClientConn)
+)
+
 func getClient(address string) (dht_proto.DHTClient, error) {
-	conn, err := grpc.Dial(address, grpc.WithTransportCredentials(insecure.NewCredentials()))
-	if err != nil {
-		fmt.Printf("error getting connection: %v\n", err)
-		return nil, err
+	muConnections.Lock()
+	defer muConnections.Unlock()
+
+	conn, ok := connections[address]
+	if !ok {
+		var err error
+		conn, err = grpc.Dial(address, grpc.WithTransportCredentials(insecure.NewCredentials()))
+		if err != nil {
+			fmt.Printf("error getting connection: %v\n", err)
+			return nil, err
+		}
+
+		connections[address] = conn
 	}
 
 	client := dht_proto.NewDHTClient(conn)
 	return client, nil
 }
 
+// CloseConnections closes every connection opened by the client functions, later requests
+// open new ones
+func CloseConnections() {
+	muConnections.Lock()
+	defer muConnections.Unlock()
+
+	for address, conn := range connections {
+		conn.Close()
+		delete(connections, address)
+	}
+}
+
+// SetKey writes a key. Transfers are only accepted from nodes of the ring, other callers
+// setting transfer are refused with PermissionDenied.
 func SetKey(address string, key string, value []byte, transfer bool) error {
-	fmt.Printf("setting on: %v\n", address)
+	_, err := setKey(address, &dht_proto.SetKeyRequest{
+		Key:      key,
+		Value:    value,
+		Transfer: transfer,
+	})
+
+	return err
+}
+
+// SetKeyIn writes a key within a namespace, returning the version of the write
+func SetKeyIn(address string, namespace string, key string, value []byte) (uint64, error) {
+	res, err := setKey(address, &dht_proto.SetKeyRequest{
+		Key:       key,
+		Namespace: namespace,
+		Value:     value,
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return res.Version, nil
+}
+
+// SetKeyWithTTL writes a key which expires once ttl has passed
+func SetKeyWithTTL(address string, key string, value []byte, ttl time.Duration) error {
+	_, err := setKey(address, &dht_proto.SetKeyRequest{
+		Key:        key,
+		Value:      value,
+		TtlSeconds: int64(ttl.Seconds()),
+	})
+
+	return err
+}
+
+// SetKeyIf writes the key only if the precondition holds on its owner, returning the version of
+// the write. A failed precondition is reported with the FailedPrecondition status code.
+func SetKeyIf(address string, key string, value []byte, cond *dht_proto.Precondition) (uint64, error) {
+	res, err := setKey(address, &dht_proto.SetKeyRequest{
+		Key:          key,
+		Value:        value,
+		Precondition: cond,
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return res.Version, nil
+}
+
+// setKey sends a request to the node at address, following redirections until a node accepts it
+func setKey(address string, req *dht_proto.SetKeyRequest) (*dht_proto.SetKeyResponse, error) {
+	res, _, err := setKeyVia(context.Background(), address, req)
+	return res, err
+}
+
+// setKeyVia is setKey, also returning the address of every node the request was sent to. Each
+// request is sent with ctx, which carries the identifier of the node when it's forwarding.
+func setKeyVia(ctx context.Context, address string, req *dht_proto.SetKeyRequest) (*dht_proto.SetKeyResponse, []string, error) {
+	var path []string
+	for len(path) < MAX_REDIRECTS {
+		path = append(path, address)
+
+		fmt.Printf("setting on: %v\n", address)
+		client, err := getClient(address)
+		if err != nil {
+			return nil, path, err
+		}
+
+		reqCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+		res, err := client.SetKey(reqCtx, req)
+		cancel()
+
+		// The owner we were sent to is down, the node which sent us there hints the write
+		if len(path) > 1 && !req.Proxy && unreachable(err) {
+			proxied := proto.Clone(req).(*dht_proto.SetKeyRequest)
+			proxied.Proxy = true
+			res, via, err := setKeyVia(ctx, path[len(path)-2], proxied)
+			return res, append(path, via...), err
+		}
+
+		if err != nil {
+			fmt.Printf("Error setting key: %v\n", err)
+			return nil, path, err
+		}
+
+		if req.Transfer || res.ForwardNode == nil {
+			return res, path, nil
+		}
+
+		address = forwardAddress(res.ForwardNode)
+	}
+
+	return nil, path, fmt.Errorf("gave up after %v redirections", MAX_REDIRECTS)
+}
+
+// GetKey reads a key from the node at address, following redirections until a node holds it
+func GetKey(address string, key string) ([]byte, error) {
+	return GetKeyWithConsistency(address, "", key, dht_proto.Consistency_ONE)
+}
+
+// GetKeyIn reads a key within a namespace
+func GetKeyIn(address string, namespace string, key string) ([]byte, error) {
+	return GetKeyWithConsistency(address, namespace, key, dht_proto.Consistency_ONE)
+}
+
+// GetKeyWithConsistency reads a key within a namespace, the empty namespace being the default.
+// Reads of QUORUM and ALL are answered by the owner with the newest copy held by that many
+// replicas, ONE is answered by the first node holding a copy.
+func GetKeyWithConsistency(address string, namespace string, key string, c dht_proto.Consistency) ([]byte, error) {
+	res, _, err := getKeyVia(context.Background(), address, &dht_proto.GetKeyRequest{
+		Key:         key,
+		Namespace:   namespace,
+		Consistency: c,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return res.Value, nil
+}
+
+// getKeyVia sends a read to the node at address with ctx, following redirections until a node
+// answers it. Returns the address of every node the request was sent to.
+func getKeyVia(ctx context.Context, address string, req *dht_proto.GetKeyRequest) (*dht_proto.GetKeyResponse, []string, error) {
+	var path []string
+	for len(path) < MAX_REDIRECTS {
+		path = append(path, address)
+
+		client, err := getClient(address)
+		if err != nil {
+			return nil, path, err
+		}
+
+		reqCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+		res, err := client.GetKey(reqCtx, req)
+		cancel()
+
+		if err != nil {
+			return nil, path, err
+		}
+
+		if res.ForwardNode == nil {
+			return res, path, nil
+		}
+
+		address = forwardAddress(res.ForwardNode)
+	}
+
+	return nil, path, fmt.Errorf("gave up after %v redirections", MAX_REDIRECTS)
+}
+
+func DeleteKey(address string, key string) error {
+	return deleteKey(address, &dht_proto.DeleteKeyRequest{
+		Key: key,
+	})
+}
+
+// DeleteKeyIn deletes a key within a namespace
+func DeleteKeyIn(address string, namespace string, key string) error {
+	return deleteKey(address, &dht_proto.DeleteKeyRequest{
+		Key:       key,
+		Namespace: namespace,
+	})
+}
+
+// deleteKey sends a request to the node at address, following redirections until a node accepts it
+func deleteKey(address string, req *dht_proto.DeleteKeyRequest) error {
+	_, _, err := deleteKeyVia(context.Background(), address, req)
+	return err
+}
+
+// deleteKeyVia is deleteKey, also returning the address of every node the request was sent to.
+// Each request is sent with ctx, as for setKeyVia.
+func deleteKeyVia(ctx context.Context, address string, req *dht_proto.DeleteKeyRequest) (*dht_proto.DeleteKeyResponse, []string, error) {
+	var path []string
+	for len(path) < MAX_REDIRECTS {
+		path = append(path, address)
+
+		client, err := getClient(address)
+		if err != nil {
+			return nil, path, err
+		}
+
+		reqCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+		res, err := client.DeleteKey(reqCtx, req)
+		cancel()
+
+		if len(path) > 1 && !req.Proxy && unreachable(err) {
+			proxied := proto.Clone(req).(*dht_proto.DeleteKeyRequest)
+			proxied.Proxy = true
+			res, via, err := deleteKeyVia(ctx, path[len(path)-2], proxied)
+			return res, append(path, via...), err
+		}
+
+		if err != nil {
+			fmt.Printf("Error deleting key: %v\n", err)
+			return nil, path, err
+		}
+
+		if req.Transfer || res.ForwardNode == nil {
+			return res, path, nil
+		}
+
+		address = forwardAddress(res.ForwardNode)
+	}
+
+	return nil, path, fmt.Errorf("gave up after %v redirections", MAX_REDIRECTS)
+}
+
+// replicateKey stores a copy of an entry on the node at address on behalf of its owner, sender
+func replicateKey(address string, sender chord.Id, entry *dht_proto.Entry) error {
 	client, err := getClient(address)
 	if err != nil {
 		return err
 	}
 
+	ctx, cancel := context.WithTimeout(senderContext(context.Background(), sender), 10*time.Second)
+	defer cancel()
+
+	if entry.Deleted {
+		_, err = client.DeleteKey(ctx, &dht_proto.DeleteKeyRequest{
+			Key:     entry.Key,
+			Replica: true,
+			Version: entry.Version,
+		})
+		return err
+	}
+
+	_, err = client.SetKey(ctx, &dht_proto.SetKeyRequest{
+		Key:     entry.Key,
+		Value:   entry.Value,
+		Replica: true,
+		Version: entry.Version,
+		Expires: entry.Expires,
+	})
+
+	return err
+}
+
+// readReplica reads the local copy of a key held by the node at address, without any redirection
+func readReplica(address string, key string) (*dht_proto.GetKeyResponse, error) {
+	client, err := getClient(address)
+	if err != nil {
+		return nil, err
+	}
+
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
-	res, err := client.SetKey(ctx, &dht_proto.SetKeyRequest{
-		Key:      key,
-		Value:    value,
-		Transfer: transfer,
+	return client.GetKey(ctx, &dht_proto.GetKeyRequest{
+		Key:     key,
+		Replica: true,
 	})
+}
+
+// Handoff pulls every entry held by the node at address within r, calling fn for each
+func Handoff(address string, r chord.KeyRange, fn func(entry *dht_proto.Entry)) error {
+	return handoff(address, &dht_proto.HandoffRequest{
+		Start: int64(r.Start),
+		End:   int64(r.End),
+	}, fn)
+}
+
+// handoffBuckets pulls the entries held by the node at address within r which fall in any of
+// the buckets of the Merkle tree
+func handoffBuckets(address string, r chord.KeyRange, buckets []int, fn func(entry *dht_proto.Entry)) error {
+	req := &dht_proto.HandoffRequest{
+		Start: int64(r.Start),
+		End:   int64(r.End),
+	}
+	for _, b := range buckets {
+		req.Buckets = append(req.Buckets, int32(b))
+	}
+
+	return handoff(address, req, fn)
+}
+
+func handoff(address string, req *dht_proto.HandoffRequest, fn func(entry *dht_proto.Entry)) error {
+	client, err := getClient(address)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), HANDOFF_TIMEOUT)
+	defer cancel()
 
+	stream, err := client.Handoff(ctx, req)
 	if err != nil {
-		fmt.Printf("Error setting key: %v\n", err)
 		return err
 	}
 
-	if !transfer && res.ForwardNode != nil {
-		forwardAddr := fmt.Sprintf("%v:%v", res.ForwardNode.Address, DHT_PORT)
-		return SetKey(forwardAddr, key, value, transfer)
+	for {
+		entry, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		fn(entry)
+	}
+}
+
+// ConfirmHandoff tells the node at address which of the entries within r have been received,
+// so that it can drop its copies of them. Only the key and version of each entry are sent, in
+// batches of TRANSFER_BATCH_SIZE.
+func ConfirmHandoff(address string, r chord.KeyRange, entries []*dht_proto.Entry) error {
+	client, err := getClient(address)
+	if err != nil {
+		return err
+	}
+
+	for i := 0; i == 0 || i < len(entries); i += TRANSFER_BATCH_SIZE {
+		batch := entries[i:min(i+TRANSFER_BATCH_SIZE, len(entries))]
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		_, err = client.ConfirmHandoff(ctx, &dht_proto.ConfirmHandoffRequest{
+			Start:   int64(r.Start),
+			End:     int64(r.End),
+			Entries: batch,
+		})
+		cancel()
+
+		if err != nil {
+			return err
+		}
 	}
 
 	return nil
 }
 
-func TransferKeys(address string, keys *KeyStore) {
-	keys.muKeys.Lock()
-	defer keys.muKeys.Unlock()
+// TransferRange streams entries to the node at address in batches over a single connection,
+// returning once the node has acknowledged applying them. Entries sent as a replica aren't
+// replicated any further by the receiving node. Transfers are only accepted from nodes of the
+// ring, sender is the identifier of the node sending them.
+func TransferRange(address string, sender chord.Id, entries []Entry, replica bool) (*dht_proto.TransferRangeResponse, error) {
+	return transferRange(address, sender, entries, replica, false)
+}
+
+// transferRange is TransferRange, marking the entries as hints if hinted is set
+func transferRange(address string, sender chord.Id, entries []Entry, replica bool, hinted bool) (*dht_proto.TransferRangeResponse, error) {
+	client, err := getClient(address)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(senderContext(context.Background(), sender), TRANSFER_TIMEOUT)
+	defer cancel()
+
+	stream, err := client.TransferRange(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// Send blocks once the stream's flow control window is full, so a slow receiver holds the sender back
+	for _, batch := range batchEntries(entries) {
+		err = stream.Send(&dht_proto.TransferBatch{
+			Entries: batch,
+			Replica: replica,
+			Hinted:  hinted,
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return stream.CloseAndRecv()
+}
+
+// PutObject streams everything read from r to the node at address, which stores it under key
+// in chunks. Returns the version of the object.
+func PutObject(address string, key string, r io.Reader) (uint64, error) {
+	return PutObjectIn(address, "", key, r)
+}
+
+// PutObjectIn is PutObject for an object within a namespace, its chunks count towards the
+// namespace's quota
+func PutObjectIn(address string, namespace string, key string, r io.Reader) (uint64, error) {
+	client, err := getClient(address)
+	if err != nil {
+		return 0, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	stream, err := client.PutObject(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	// The key is sent on its own so that even an empty object sends a message
+	err = stream.Send(&dht_proto.ObjectChunk{Key: key, Namespace: namespace})
+	if err != nil {
+		return 0, err
+	}
+
+	buf := make([]byte, CHUNK_SIZE)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			sendErr := stream.Send(&dht_proto.ObjectChunk{Data: buf[:n]})
+			if sendErr != nil {
+				return 0, sendErr
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	res, err := stream.CloseAndRecv()
+	if err != nil {
+		return 0, err
+	}
+
+	return res.Version, nil
+}
+
+// GetObject streams the object stored under key from the node at address into w
+func GetObject(address string, key string, w io.Writer) error {
+	return GetObjectIn(address, "", key, w)
+}
+
+// GetObjectIn is GetObject for an object within a namespace
+func GetObjectIn(address string, namespace string, key string, w io.Writer) error {
+	client, err := getClient(address)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	stream, err := client.GetObject(ctx, &dht_proto.GetObjectRequest{
+		Key:       key,
+		Namespace: namespace,
+	})
+	if err != nil {
+		return err
+	}
+
+	for {
+		chunk, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		_, err = w.Write(chunk.Data)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// DeleteObject deletes the object stored under key, and its chunks, through the node at
+// address. Returns the number of chunks deleted.
+func DeleteObject(address string, key string) (int, error) {
+	return DeleteObjectIn(address, "", key)
+}
+
+// DeleteObjectIn is DeleteObject for an object within a namespace
+func DeleteObjectIn(address string, namespace string, key string) (int, error) {
+	client, err := getClient(address)
+	if err != nil {
+		return 0, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	res, err := client.DeleteObject(ctx, &dht_proto.DeleteObjectRequest{
+		Key:       key,
+		Namespace: namespace,
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return int(res.Chunks), nil
+}
+
+// WatchKey calls fn with every change to a key until ctx is cancelled, starting with its current
+// value. Redirects are followed when the key moves to another node, so fn doesn't see them.
+func WatchKey(ctx context.Context, address string, key string, fn func(*dht_proto.WatchEvent)) error {
+	return WatchKeyIn(ctx, address, "", key, fn)
+}
+
+// WatchKeyIn is WatchKey for a key within a namespace
+func WatchKeyIn(ctx context.Context, address string, namespace string, key string, fn func(*dht_proto.WatchEvent)) error {
+	// Only redirects without an event in between count, a key may move any number of times
+	// over the life of a watch
+	redirects := 0
+	for redirects < MAX_REDIRECTS {
+		client, err := getClient(address)
+		if err != nil {
+			return err
+		}
+
+		stream, err := client.WatchKey(ctx, &dht_proto.WatchKeyRequest{
+			Key:       key,
+			Namespace: namespace,
+		})
+		if err != nil {
+			return err
+		}
+
+		for {
+			event, err := stream.Recv()
+			if err == io.EOF {
+				return fmt.Errorf("watch on %v ended without a redirect", address)
+			}
+			if err != nil {
+				return err
+			}
+
+			if event.Type == dht_proto.WatchEventType_REDIRECT {
+				address = forwardAddress(event.ForwardNode)
+				redirects++
+				break
+			}
+
+			redirects = 0
+			fn(event)
+		}
+	}
+
+	return fmt.Errorf("gave up after %v redirections", MAX_REDIRECTS)
+}
+
+// WatchPrefix calls fn with every change to the keys starting with prefix which the node at
+// address owns, until ctx is cancelled or one of the streams fails. When part of the node's
+// range moves to another node, that node is watched too, so fn doesn't see the redirects.
+// Calls to fn are never concurrent.
+func WatchPrefix(ctx context.Context, address string, prefix string, fn func(*dht_proto.WatchEvent)) error {
+	return WatchPrefixIn(ctx, address, "", prefix, fn)
+}
+
+// WatchPrefixIn is WatchPrefix for keys within a namespace
+func WatchPrefixIn(ctx context.Context, address string, namespace string, prefix string, fn func(*dht_proto.WatchEvent)) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
 
 	var wg sync.WaitGroup
-	for _, v := range keys.Keys {
+	var muWatching, muFn sync.Mutex
+	watching := make(map[string]bool)
+	errs := make(chan error, 1)
+
+	var watch func(address string)
+	watch = func(address string) {
+		muWatching.Lock()
+		defer muWatching.Unlock()
+		if watching[address] {
+			return
+		}
+		watching[address] = true
+
 		wg.Add(1)
-		go func(v *keyentry) {
-			v.RLock()
-			defer v.RUnlock()
+		go func() {
+			defer wg.Done()
 
-			err := SetKey(address, v.Key, v.Value, true)
-			if err != nil {
-				fmt.Printf("Error transferring key: %v\n", err)
+			err := watchPrefixOn(ctx, address, namespace, prefix, func(event *dht_proto.WatchEvent) {
+				if event.Type == dht_proto.WatchEventType_REDIRECT {
+					watch(forwardAddress(event.ForwardNode))
+					return
+				}
+
+				muFn.Lock()
+				defer muFn.Unlock()
+				fn(event)
+			})
+
+			select {
+			case errs <- err:
+			default:
 			}
-			wg.Done()
-		}(v)
+		}()
 	}
+
+	watch(address)
+	err := <-errs
+	cancel()
 	wg.Wait()
+
+	return err
+}
+
+// watchPrefixOn streams the events of a prefix watch on a single node to fn
+func watchPrefixOn(ctx context.Context, address string, namespace string, prefix string, fn func(*dht_proto.WatchEvent)) error {
+	client, err := getClient(address)
+	if err != nil {
+		return err
+	}
+
+	stream, err := client.WatchPrefix(ctx, &dht_proto.WatchPrefixRequest{
+		Prefix:    prefix,
+		Namespace: namespace,
+	})
+	if err != nil {
+		return err
+	}
+
+	for {
+		event, err := stream.Recv()
+		if err == io.EOF {
+			return fmt.Errorf("watch on %v ended", address)
+		}
+		if err != nil {
+			return err
+		}
+
+		fn(event)
+	}
+}
+
+// The maximum time a batch may take, including the requests to each owner
+const BATCH_TIMEOUT = 30 * time.Second
+
+// BatchEntry is a key to write with BatchSet, a zero TTL never expires
+type BatchEntry struct {
+	Key   string
+	Value []byte
+	TTL   time.Duration
+}
+
+// BatchResult is the outcome of a batch for one key, Err is nil if it succeeded
+type BatchResult struct {
+	Key     string
+	Value   []byte
+	Version uint64
+	Err     error
+}
+
+func parseBatchResults(results []*dht_proto.BatchResult) []BatchResult {
+	res := make([]BatchResult, len(results))
+	for i, r := range results {
+		res[i] = BatchResult{
+			Key:     r.Key,
+			Value:   r.Value,
+			Version: r.Version,
+		}
+		if codes.Code(r.Code) != codes.OK {
+			res[i].Err = status.Error(codes.Code(r.Code), r.Error)
+		}
+	}
+
+	return res
+}
+
+// BatchGet reads many keys through the node at address, which fetches them from their owners in
+// parallel. Returns a result for every key in order, a missing key has the NotFound status code.
+func BatchGet(address string, keys []string) ([]BatchResult, error) {
+	return BatchGetIn(address, "", keys)
+}
+
+// BatchGetIn is BatchGet for keys within a namespace
+func BatchGetIn(address string, namespace string, keys []string) ([]BatchResult, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), BATCH_TIMEOUT)
+	defer cancel()
+
+	res, err := batchGet(ctx, address, &dht_proto.BatchGetRequest{
+		Keys:      keys,
+		Namespace: namespace,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return parseBatchResults(res.Results), nil
+}
+
+// BatchSet writes many keys through the node at address, which sends them to their owners in
+// parallel. Returns a result for every entry in order, carrying the version of the write.
+func BatchSet(address string, entries []BatchEntry) ([]BatchResult, error) {
+	return BatchSetIn(address, "", entries)
+}
+
+// BatchSetIn is BatchSet for keys within a namespace
+func BatchSetIn(address string, namespace string, entries []BatchEntry) ([]BatchResult, error) {
+	req := &dht_proto.BatchSetRequest{
+		Namespace: namespace,
+	}
+	for _, v := range entries {
+		req.Entries = append(req.Entries, &dht_proto.BatchEntry{
+			Key:        v.Key,
+			Value:      v.Value,
+			TtlSeconds: int64(v.TTL.Seconds()),
+		})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), BATCH_TIMEOUT)
+	defer cancel()
+
+	res, err := batchSet(ctx, address, req)
+	if err != nil {
+		return nil, err
+	}
+
+	return parseBatchResults(res.Results), nil
+}
+
+func batchGet(ctx context.Context, address string, req *dht_proto.BatchGetRequest) (*dht_proto.BatchGetResponse, error) {
+	client, err := getClient(address)
+	if err != nil {
+		return nil, err
+	}
+
+	return client.BatchGet(ctx, req)
+}
+
+func batchSet(ctx context.Context, address string, req *dht_proto.BatchSetRequest) (*dht_proto.BatchSetResponse, error) {
+	client, err := getClient(address)
+	if err != nil {
+		return nil, err
+	}
+
+	return client.BatchSet(ctx, req)
+}
+
+// merkleLevel fetches one level of the Merkle tree over r held by the node at address
+func merkleLevel(address string, r chord.KeyRange, level int) ([][]byte, error) {
+	client, err := getClient(address)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	res, err := client.MerkleTree(ctx, &dht_proto.MerkleTreeRequest{
+		Start: int64(r.Start),
+		End:   int64(r.End),
+		Level: int32(level),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return res.Hashes, nil
+}
+
+// TransferKeys hands every entry in the store over to the node at address on behalf of the
+// node sender, and drops the local copies once it has acknowledged them
+func TransferKeys(address string, sender chord.Id, keys Store) error {
+	entries := entriesInRange(keys, chord.KeyRange{})
+	if len(entries) == 0 {
+		return nil
+	}
+
+	res, err := TransferRange(address, sender, entries, false)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Transferred %v keys, %v were applied\n", res.Received, res.Applied)
+	for _, v := range entries {
+		keys.DeleteKey(v.Key)
+	}
+
+	return nil
+}
+
+// Snapshot has the node at address take a snapshot of the whole ring, with every node writing
+// its part to dir within its snapshot directory. Returns the manifest of the snapshot.
+func Snapshot(address string, dir string) (*dht_proto.SnapshotManifest, error) {
+	client, err := getClient(address)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), SNAPSHOT_TIMEOUT)
+	defer cancel()
+
+	return client.Snapshot(ctx, &dht_proto.SnapshotRequest{Directory: dir})
+}
+
+// RestoreSnapshot has the node at address load the snapshot in dir, within its snapshot
+// directory, into the ring, returning the number of keys restored
+func RestoreSnapshot(address string, dir string) (int64, error) {
+	client, err := getClient(address)
+	if err != nil {
+		return 0, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), SNAPSHOT_TIMEOUT)
+	defer cancel()
+
+	res, err := client.RestoreSnapshot(ctx, &dht_proto.RestoreSnapshotRequest{Directory: dir})
+	if err != nil {
+		return 0, err
+	}
+
+	return res.Entries, nil
+}
+
+func prepareSnapshot(ctx context.Context, address string, req *dht_proto.PrepareSnapshotRequest) error {
+	client, err := getClient(address)
+	if err != nil {
+		return err
+	}
+
+	_, err = client.PrepareSnapshot(ctx, req)
+	return err
+}
+
+func exportSnapshot(ctx context.Context, address string, req *dht_proto.ExportSnapshotRequest) (*dht_proto.SnapshotPart, error) {
+	client, err := getClient(address)
+	if err != nil {
+		return nil, err
+	}
+
+	return client.ExportSnapshot(ctx, req)
 }
@@ -0,0 +1,22 @@
+package dht
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetClientReusesConnections(t *testing.T) {
+	defer CloseConnections()
+
+	_, err := getClient("127.0.0.1:1")
+	assert.Nil(t, err)
+	conn := connections["127.0.0.1:1"]
+
+	_, err = getClient("127.0.0.1:1")
+	assert.Nil(t, err)
+	assert.Same(t, conn, connections["127.0.0.1:1"], "a second request should share the connection")
+
+	CloseConnections()
+	assert.Empty(t, connections)
+}
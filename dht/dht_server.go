@@ -16,46 +16,209 @@ import (
 	"google.golang.org/grpc/status"
 )
 
+// The interval between full scans for keys which are no longer owned by the node. Keys are
+// normally migrated as soon as the owned range changes, so this only catches failed transfers.
+const KEY_CHECK_INTERVAL = 60 * time.Second
+
+const DEFAULT_TOMBSTONE_GRACE = 1 * time.Hour
+
+// The interval between scans for keys whose TTL has passed
+const EXPIRY_INTERVAL = 5 * time.Second
+
+// The name the DHT advertises its endpoint under in the metadata of the Chord node
+const SERVICE_NAME = "dht"
+
+type Config struct {
+	// Port is the port to serve the DHT on, a random port is chosen if it's 0. Either way the
+	// port is advertised to other nodes in the metadata of the Chord node.
+	Port int
+
+	// Listener serves the DHT instead of listening on Port, if it's set. Opening it before the
+	// node joins lets the port be passed in chord.BootstrapConfig.Services, so the ring never
+	// sees the node without it.
+	Listener net.Listener
+
+	// ReplicationFactor is the number of nodes which store each key, the owner and its next
+	// ReplicationFactor-1 successors. Values below 1 are treated as 1, i.e. no replication.
+	ReplicationFactor int
+
+	// TombstoneGrace is how long deleted keys are remembered for, it should comfortably exceed
+	// the time taken for replicas and migrating copies to catch up. Defaults to DEFAULT_TOMBSTONE_GRACE.
+	TombstoneGrace time.Duration
+
+	// Quotas limit the keys and bytes each node owns for a namespace, replicas aren't counted.
+	// DefaultQuota applies to the namespaces without a quota of their own, including the
+	// default namespace. Zero quotas are unlimited.
+	Quotas       map[string]Quota
+	DefaultQuota Quota
+
+	// Store holds the keys of the node, a KeyStore is created if it's nil. The server closes
+	// it when stopped.
+	Store Store
+
+	// SnapshotDir is the directory snapshots are written to and restored from, directories in
+	// snapshot requests are relative to it and can't leave it. Snapshots are disabled if it's
+	// empty.
+	SnapshotDir string
+}
+
 type Server struct {
 	node *chord.LocalNode
 
+	replicationFactor int
+	tombstoneGrace    time.Duration
+
 	shutdown chan struct{}
 	wg       *sync.WaitGroup
 
-	keystore *KeyStore
+	keystore Store
+
+	// merkle serves the Merkle tree without a scan, if the store keeps it up to date
+	merkle merkleSource
+
+	muHandoff sync.RWMutex
+	incoming  *handoffState
+	outgoing  *handoffState
+
+	muHints sync.Mutex
+	hints   map[chord.Id]*hintQueue
+
+	muMembers sync.Mutex
+	members   map[chord.Id]ringMember
+
+	watches *watchHub
+
+	quotas *quotaTracker
+
+	snapshots   *snapshotRecorder
+	snapshotDir string
+
+	// Metrics
+	registry     *prometheus.Registry
+	primaryGauge prometheus.Gauge
+	replicaGauge prometheus.Gauge
+	hintsGauge   *prometheus.GaugeVec
+	hintAgeGauge *prometheus.GaugeVec
+
 	dht_proto.UnimplementedDHTServer
 }
 
-func StartDHT(node *chord.LocalNode, port int) *Server {
+func StartDHT(node *chord.LocalNode, config Config) *Server {
 	s := grpc.NewServer()
 
+	store := config.Store
+	if store == nil {
+		store = CreateKeyStore(node.Identifier())
+	}
+
 	dht := &Server{
-		node:     node,
-		keystore: CreateKeyStore(node.Identifier()),
-		shutdown: make(chan struct{}),
-		wg:       new(sync.WaitGroup),
+		node:              node,
+		replicationFactor: max(config.ReplicationFactor, 1),
+		tombstoneGrace:    config.TombstoneGrace,
+		keystore:          store,
+		hints:             make(map[chord.Id]*hintQueue),
+		watches:           newWatchHub(),
+		quotas:            newQuotaTracker(node.Identifier(), config.Quotas, config.DefaultQuota),
+		snapshots:         &snapshotRecorder{},
+		snapshotDir:       config.SnapshotDir,
+		shutdown:          make(chan struct{}),
+		wg:                new(sync.WaitGroup),
+
+		primaryGauge: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "dht_primary_keys",
+			Help: "The number of stored keys which the node owns",
+			ConstLabels: prometheus.Labels{
+				"id": fmt.Sprint(node.Identifier()),
+			},
+		}),
+		replicaGauge: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "dht_replica_keys",
+			Help: "The number of stored keys which the node holds as a replica for another owner",
+			ConstLabels: prometheus.Labels{
+				"id": fmt.Sprint(node.Identifier()),
+			},
+		}),
+	}
+
+	dht.hintsGauge, dht.hintAgeGauge = newHintGauges(node.Identifier())
+
+	dht.registry = prometheus.NewRegistry()
+	dht.registry.MustRegister(dht.primaryGauge)
+	dht.registry.MustRegister(dht.replicaGauge)
+	dht.registry.MustRegister(dht.hintsGauge)
+	dht.registry.MustRegister(dht.hintAgeGauge)
+	dht.registry.MustRegister(dht.quotas.keysGauge)
+	dht.registry.MustRegister(dht.quotas.bytesGauge)
+
+	lis := config.Listener
+	if lis == nil {
+		var err error
+		lis, err = net.Listen("tcp", fmt.Sprintf("0.0.0.0:%v", config.Port))
+		if err != nil {
+			panic(err)
+		}
 	}
 
-	prometheus.MustRegister(dht.keystore.Registry)
+	if c, ok := store.(prometheus.Collector); ok {
+		prometheus.MustRegister(c)
+	}
+	if m, ok := store.(merkleSource); ok {
+		dht.merkle = m
+	}
+	prometheus.MustRegister(dht.registry)
+
+	// Every change made by the server goes through the store, so that's where watches are fed
+	// and snapshots keep the values being overwritten
+	dht.keystore = &recordingStore{
+		Store:    &watchedStore{Store: store, hub: dht.watches},
+		recorder: dht.snapshots,
+	}
 	dht_proto.RegisterDHTServer(s, dht)
+	node.RegisterApplication(dht)
+	node.RegisterService(SERVICE_NAME, lis.Addr().(*net.TCPAddr).Port)
 
-	lis, err := net.Listen("tcp", fmt.Sprintf("0.0.0.0:%v", port))
-	if err != nil {
-		panic(err)
+	if dht.tombstoneGrace <= 0 {
+		dht.tombstoneGrace = DEFAULT_TOMBSTONE_GRACE
+	}
+
+	if dht.replicationFactor > 1 {
+		dht.wg.Add(2)
+		go dht.watchSuccessors()
+		go dht.antiEntropy()
 	}
 
+	dht.wg.Add(1)
+	go dht.deliverHints()
+
 	dht.wg.Add(1)
 	go func() {
 		defer dht.wg.Done()
 
-		keyCheckTicker := time.NewTicker(3 * time.Second)
+		keyCheckTicker := time.NewTicker(KEY_CHECK_INTERVAL)
 		defer keyCheckTicker.Stop()
 
+		expiryTicker := time.NewTicker(EXPIRY_INTERVAL)
+		defer expiryTicker.Stop()
+
+		quotaTicker := time.NewTicker(QUOTA_RECOUNT_INTERVAL)
+		defer quotaTicker.Stop()
+
 		for {
 			select {
 			case <-keyCheckTicker.C:
 				dht.CheckKeys()
 
+				purged := dht.keystore.PurgeTombstones(time.Now().Add(-dht.tombstoneGrace))
+				if purged > 0 {
+					fmt.Printf("Purged %v tombstones\n", purged)
+				}
+
+			case <-expiryTicker.C:
+				dht.keystore.PurgeExpired(time.Now())
+
+			case <-quotaTicker.C:
+				dht.quotas.recount(dht.keystore, dht.node.OwnedRange())
+
 			case <-dht.shutdown:
 				fmt.Println("Stopping...")
 				node.Stop()
@@ -63,8 +226,10 @@ func StartDHT(node *chord.LocalNode, port int) *Server {
 				succ, _ := node.Successor()
 				if succ != nil && succ != node {
 					fmt.Printf("Transferring keys to %v\n", succ)
-					addr := fmt.Sprintf("%v:%v", stripPort(chord.GetNodeAddress(succ)), DHT_PORT)
-					TransferKeys(addr, dht.keystore)
+					err := TransferKeys(dhtAddress(chord.PeerOf(succ)), dht.node.Identifier(), dht.keystore)
+					if err != nil {
+						fmt.Printf("error transferring keys: %v\n", err)
+					}
 				}
 				return
 			}
@@ -78,6 +243,8 @@ func StartDHT(node *chord.LocalNode, port int) *Server {
 		}
 	}()
 
+	go dht.pullRange()
+
 	return dht
 }
 
@@ -85,49 +252,124 @@ func (s *Server) Stop() {
 	fmt.Println("Starting DHT graceful shutdown...")
 	close(s.shutdown)
 	s.wg.Wait()
+	CloseConnections()
+
+	err := s.keystore.Close()
+	if err != nil {
+		fmt.Printf("error closing keystore: %v\n", err)
+	}
 	fmt.Println("Done")
 }
 
-func (s *Server) CheckKeys() {
-	for _, v := range s.keystore.Keys {
-		v.RLock()
+// RangeChanged is the upcall from the Chord layer. Keys which have left the node's range are
+// handed to the new predecessor, and keys which have joined it are copied to our replicas.
+func (s *Server) RangeChanged(old, new chord.KeyRange) {
+	s.watches.rangeChanged(new)
 
-		// First check if the key is between the current predecessor
-		// and us, if it is, then continue
+	if s.replicationFactor > 1 {
+		gained := chord.KeyRange{Start: new.Start, End: old.Start}
+		if old.Start != old.End && !old.Contains(new.Start) {
+			// Our predecessor has gone, we now own its range and already hold its keys as a replica
+			go s.replicateRange(gained, s.replicaTargets())
+		}
+	}
+
+	pred, err := s.node.Predecessor()
+	if err != nil || pred.Identifier() != new.Start {
+		// The predecessor has moved on again, the next upcall will deal with it
+		return
+	}
+
+	if chord.GetNodeAddress(pred) == "" {
+		return
+	}
+	addr := dhtAddress(chord.PeerOf(pred))
+
+	var lost []Entry
+	for _, v := range entriesInRange(s.keystore, old) {
+		if !new.Contains(v.Id) {
+			lost = append(lost, v)
+		}
+	}
+
+	if len(lost) == 0 {
+		return
+	}
+
+	// Give the new predecessor the chance to pull the keys itself, anything left over
+	// after the grace period is pushed to it. With replication we stay on as its first
+	// replica, so our copies are kept.
+	fmt.Printf("Range changed from %v to %v, %v keys to hand off\n", old, new, len(lost))
+	time.AfterFunc(HANDOFF_GRACE, func() {
 		pred, err := s.node.Predecessor()
-		if err != nil {
-			fmt.Println("key check failed, no predecessor")
-			v.RUnlock()
-			continue
+		if err != nil || pred.Identifier() != new.Start {
+			return
 		}
 
-		if chord.Between(v.Id, pred.Identifier()+1, s.node.Identifier()) {
-			v.RUnlock()
-			continue
+		var remaining []Entry
+		for _, v := range lost {
+			if s.keystore.HasKey(v.Key) && !new.Contains(v.Id) {
+				remaining = append(remaining, v)
+			}
 		}
 
-		fmt.Printf("Transferring key: %v\n", v.Id)
-		predAddr := fmt.Sprintf("%v:%v", stripPort(chord.GetNodeAddress(pred)), DHT_PORT)
-		err = SetKey(predAddr, v.Key, v.Value, true)
-		v.RUnlock()
+		if len(remaining) == 0 {
+			return
+		}
 
+		err = s.transferEntries(addr, remaining, s.replicationFactor == 1)
 		if err != nil {
-			fmt.Printf("error transferring key... %v", err)
-		} else {
-			fmt.Println("successfully transferred key, deleting...")
-			s.keystore.DeleteKey(v.Key)
-			fmt.Println("deleted")
+			fmt.Printf("error handing off keys to %v: %v\n", pred, err)
 		}
-	}
+	})
 }
 
 func (s *Server) GetKey(ctx context.Context, in *dht_proto.GetKeyRequest) (*dht_proto.GetKeyResponse, error) {
 	key := in.Key
+	if !in.Replica {
+		var err error
+		key, err = s.requestedKey(ctx, in.Namespace, in.Key, in.Internal)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	fmt.Printf("Received GetKey for %v\n", in.Key)
 
-	fmt.Printf("Received GetKey for %v\n", key)
+	if in.Replica {
+		entry, ok := s.keystore.Lookup(key)
+		if !ok {
+			return nil, status.Error(codes.NotFound, "node does not have this key")
+		}
+
+		return &dht_proto.GetKeyResponse{
+			Value:   entry.Value,
+			Version: entry.Version,
+			Deleted: entry.Deleted,
+			Expires: serializeExpiry(entry.Expires),
+		}, nil
+	}
 
-	if !s.keystore.HasKey(key) {
+	// Any replica can answer a read of ONE, anything stronger is coordinated by the owner
+	if !s.keystore.HasKey(key) || in.Consistency != dht_proto.Consistency_ONE {
 		chordKey := ChordIdFromString(key)
+
+		// A joining node sends lookups for keys it hasn't pulled yet to us, so don't send them back
+		if s.handingOff(chordKey) && in.Consistency == dht_proto.Consistency_ONE {
+			return nil, status.Error(codes.NotFound, "node does not have this key")
+		}
+
+		// The previous owner keeps serving the key until we have pulled it
+		if source := s.handoffSource(chordKey); source != "" && in.Consistency == dht_proto.Consistency_ONE {
+			if in.Proxy {
+				return s.proxyGetKey(in, source, 0)
+			}
+
+			return &dht_proto.GetKeyResponse{
+				ForwardNode: forwardNode(source),
+			}, nil
+		}
+
 		successor, pathLength, err := s.node.FindSuccessor(chordKey, 0)
 		fmt.Printf("Path length: %v\n", pathLength)
 		if err != nil {
@@ -136,56 +378,267 @@ func (s *Server) GetKey(ctx context.Context, in *dht_proto.GetKeyRequest) (*dht_
 		}
 
 		if successor.Identifier() != s.node.Identifier() {
-			forwardAddress := stripPort(chord.GetNodeAddress(successor))
+			forwardAddress := dhtAddress(chord.PeerOf(successor))
+			if in.Proxy {
+				return s.proxyGetKey(in, forwardAddress, pathLength)
+			}
+
 			return &dht_proto.GetKeyResponse{
-				ForwardNode: &dht_proto.Node{
-					Address: forwardAddress,
-				},
-				PathLength: int32(pathLength),
+				ForwardNode: forwardNode(forwardAddress),
+				PathLength:  int32(pathLength),
 			}, nil
 		}
 
-		return nil, status.Error(codes.Internal, "node does not have this key")
+		if in.Consistency != dht_proto.Consistency_ONE {
+			return s.quorumRead(key, in.Consistency)
+		}
+
+		// A replica may have a copy we've missed
+		s.sampleReplicas(key)
+		return nil, status.Error(codes.NotFound, "node does not have this key")
 	}
 
-	value, err := s.keystore.GetKey(key)
+	value, version, err := s.keystore.GetVersionedKey(key)
 	if err != nil {
 		return nil, fmt.Errorf("error whilst retrieving key")
 	}
 
+	if s.node.OwnedRange().Contains(ChordIdFromString(key)) {
+		s.sampleReplicas(key)
+	}
+
 	return &dht_proto.GetKeyResponse{
 		Value:      value,
 		PathLength: 0,
+		Version:    version,
 	}, nil
 }
 
 func (s *Server) SetKey(ctx context.Context, in *dht_proto.SetKeyRequest) (*dht_proto.SetKeyResponse, error) {
 	key := in.Key
+	if !in.Transfer && !in.Replica {
+		var err error
+		key, err = s.requestedKey(ctx, in.Namespace, in.Key, in.Internal)
+		if err != nil {
+			return nil, err
+		}
 
-	fmt.Printf("Received SetKey for %v\n", key)
+		// Only owners choose versions, a client's would skip the checks on a normal write
+		if in.Version != 0 {
+			return nil, status.Error(codes.InvalidArgument, "version can only be set on transfers and replicas")
+		}
+	} else if err := s.fromRingMember(ctx); err != nil {
+		return nil, err
+	}
+
+	fmt.Printf("Received SetKey for %v\n", in.Key)
 	// Check if we are actually the successor for this key
-	chordKey := ChordIdFromString(in.Key)
-	if !in.Transfer {
-		successor, _, err := s.node.FindSuccessor(chordKey, 0)
+	chordKey := ChordIdFromString(key)
+	if !in.Transfer && !in.Replica {
+		successor, pathLength, err := s.node.FindSuccessor(chordKey, 0)
 
 		if err != nil {
 			msg := fmt.Sprintf("key setting failed, could not verify the node's ownership of the key: %v", err)
 			return nil, status.Error(codes.Internal, msg)
 		}
 		if successor.Identifier() != s.node.Identifier() {
-			forwardAddress := stripPort(chord.GetNodeAddress(successor))
-			return &dht_proto.SetKeyResponse{
-				ForwardNode: &dht_proto.Node{
-					Address: forwardAddress,
-				},
-			}, nil
+			forwardAddress := dhtAddress(chord.PeerOf(successor))
+			if !in.Proxy {
+				return &dht_proto.SetKeyResponse{
+					ForwardNode: forwardNode(forwardAddress),
+				}, nil
+			}
+
+			// The owner is only checked once the forward fails, so writes to a live owner
+			// don't cost an extra round trip
+			res, err := s.proxySetKey(in, forwardAddress, pathLength)
+			if unreachable(err) && !successor.Alive() {
+				return s.hintSetKey(successor.Identifier(), forwardAddress, successor, key, in)
+			}
+
+			return res, err
+		}
+	}
+
+	// Transfers and replicas keep the version and expiry given to the write by its owner,
+	// and are dropped if we already hold something newer
+	version := in.Version
+	expires := requestExpiry(in)
+	if version == 0 {
+		counted, err := s.quotas.admit(s.keystore, key, in.Value)
+		if err != nil {
+			return nil, err
+		}
+
+		version = newVersion()
+		if in.Precondition != nil {
+			err = s.keystore.SetVersionedKeyIf(key, in.Value, version, expires, parsePrecondition(in.Precondition))
+		} else {
+			err = s.keystore.SetExpiringKey(key, in.Value, version, expires)
+		}
+		if err != nil {
+			s.quotas.refund(key, counted)
+		}
+
+		if err == ErrPreconditionFailed {
+			return nil, status.Error(codes.FailedPrecondition, "precondition failed")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error setting key")
+		}
+	} else if !s.keystore.Apply(key, in.Value, version, expires, false) {
+		return &dht_proto.SetKeyResponse{}, nil
+	}
+
+	if in.Replica {
+		return &dht_proto.SetKeyResponse{}, nil
+	}
+
+	// Transfers are acknowledged straight away, the new owner replicates in the background
+	acks := 0
+	if !in.Transfer {
+		acks = s.requiredReplicas(in.Consistency) - 1
+	}
+
+	err := s.replicateWrite(&dht_proto.Entry{
+		Key:     key,
+		Value:   in.Value,
+		Version: version,
+		Expires: serializeExpiry(expires),
+	}, acks)
+	if err != nil {
+		return nil, status.Error(codes.Unavailable, err.Error())
+	}
+
+	return &dht_proto.SetKeyResponse{
+		Version: version,
+	}, nil
+}
+
+func (s *Server) DeleteKey(ctx context.Context, in *dht_proto.DeleteKeyRequest) (*dht_proto.DeleteKeyResponse, error) {
+	key := in.Key
+	if !in.Transfer && !in.Replica {
+		var err error
+		key, err = s.requestedKey(ctx, in.Namespace, in.Key, in.Internal)
+		if err != nil {
+			return nil, err
+		}
+
+		// Only owners choose versions, a client's would skip the checks on a normal write
+		if in.Version != 0 {
+			return nil, status.Error(codes.InvalidArgument, "version can only be set on transfers and replicas")
+		}
+	} else if err := s.fromRingMember(ctx); err != nil {
+		return nil, err
+	}
+
+	fmt.Printf("Received DeleteKey for %v\n", in.Key)
+	// Check if we are actually the successor for this key
+	chordKey := ChordIdFromString(key)
+	if !in.Transfer && !in.Replica {
+		successor, pathLength, err := s.node.FindSuccessor(chordKey, 0)
+
+		if err != nil {
+			msg := fmt.Sprintf("key deletion failed, could not verify the node's ownership of the key: %v", err)
+			return nil, status.Error(codes.Internal, msg)
+		}
+		if successor.Identifier() != s.node.Identifier() {
+			forwardAddress := dhtAddress(chord.PeerOf(successor))
+			if !in.Proxy {
+				return &dht_proto.DeleteKeyResponse{
+					ForwardNode: forwardNode(forwardAddress),
+				}, nil
+			}
+
+			res, err := s.proxyDeleteKey(in, forwardAddress, pathLength)
+			if unreachable(err) && !successor.Alive() {
+				return s.hintDeleteKey(successor.Identifier(), forwardAddress, successor, key, in)
+			}
+
+			return res, err
+		}
+	}
+
+	version := in.Version
+	if version == 0 {
+		s.quotas.release(s.keystore, key)
+
+		version = newVersion()
+		err := s.keystore.DeleteVersionedKey(key, version)
+		if err != nil {
+			return nil, fmt.Errorf("error deleting key")
 		}
+	} else if !s.keystore.Apply(key, nil, version, time.Time{}, true) {
+		return &dht_proto.DeleteKeyResponse{}, nil
 	}
 
-	err := s.keystore.SetKey(key, in.Value)
+	if in.Replica {
+		return &dht_proto.DeleteKeyResponse{}, nil
+	}
+
+	acks := 0
+	if !in.Transfer {
+		acks = s.requiredReplicas(in.Consistency) - 1
+	}
+
+	err := s.replicateWrite(&dht_proto.Entry{
+		Key:     key,
+		Version: version,
+		Deleted: true,
+	}, acks)
 	if err != nil {
-		return nil, fmt.Errorf("error setting key")
+		return nil, status.Error(codes.Unavailable, err.Error())
+	}
+
+	return &dht_proto.DeleteKeyResponse{}, nil
+}
+
+// requestExpiry returns when a key set by the request expires, a zero time if it never does
+func requestExpiry(in *dht_proto.SetKeyRequest) time.Time {
+	if in.TtlSeconds > 0 && in.Version == 0 {
+		return time.Now().Add(time.Duration(in.TtlSeconds) * time.Second)
+	}
+
+	return parseExpiry(in.Expires)
+}
+
+// hintSetKey accepts a write for an owner which can't be reached, holding it as a hint until
+// the owner is back. Hints can't check preconditions or wait for replicas, so only plain
+// writes with a consistency of ONE are accepted.
+func (s *Server) hintSetKey(owner chord.Id, address string, node interface{ Alive() bool }, key string, in *dht_proto.SetKeyRequest) (*dht_proto.SetKeyResponse, error) {
+	if in.Precondition != nil || in.Consistency != dht_proto.Consistency_ONE {
+		return nil, status.Errorf(codes.Unavailable, "owner %v of the key is unreachable", owner)
+	}
+
+	version := newVersion()
+	s.addHint(owner, address, node, Entry{
+		Key:     key,
+		Value:   in.Value,
+		Id:      ChordIdFromString(key),
+		Version: version,
+		Expires: requestExpiry(in),
+	})
+
+	return &dht_proto.SetKeyResponse{
+		Version: version,
+		Hinted:  true,
+	}, nil
+}
+
+// hintDeleteKey is hintSetKey for deletes
+func (s *Server) hintDeleteKey(owner chord.Id, address string, node interface{ Alive() bool }, key string, in *dht_proto.DeleteKeyRequest) (*dht_proto.DeleteKeyResponse, error) {
+	if in.Consistency != dht_proto.Consistency_ONE {
+		return nil, status.Errorf(codes.Unavailable, "owner %v of the key is unreachable", owner)
 	}
 
-	return &dht_proto.SetKeyResponse{}, nil
+	s.addHint(owner, address, node, Entry{
+		Key:     key,
+		Id:      ChordIdFromString(key),
+		Version: newVersion(),
+		Deleted: true,
+	})
+
+	return &dht_proto.DeleteKeyResponse{
+		Hinted: true,
+	}, nil
 }
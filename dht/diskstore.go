@@ -0,0 +1,377 @@
+package dht
+
+import (
+	"bufio"
+	"chord_dht/chord"
+	dht_proto "chord_dht/protos/dht"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// The number of records the log can grow to before it's compacted into a snapshot
+const COMPACTION_THRESHOLD = 10000
+
+// The interval between checks of the log size, and so the longest a full log waits for compaction
+const COMPACTION_INTERVAL = 60 * time.Second
+
+// The interval between syncs of the log to disk. Writes survive a crash of the process straight
+// away, but may be lost if the machine fails before they are synced.
+const SYNC_INTERVAL = 1 * time.Second
+
+const (
+	LOG_FILE      = "keys.log"
+	SNAPSHOT_FILE = "keys.snapshot"
+)
+
+// Record types, a put holds the full entry and a remove only needs the key
+const (
+	recordPut    byte = 1
+	recordRemove byte = 2
+)
+
+// The size of a record header, a CRC32 of the payload followed by its length
+const recordHeaderSize = 8
+
+// Records longer than this can only come from a corrupt header
+const maxRecordSize = 64 << 20
+
+// DiskStore is a KeyStore which persists every change to an append-only log in its directory.
+// The log is periodically compacted by writing the contents of the store to a snapshot and
+// starting a new log, and both are replayed when the store is opened, so a node which restarts
+// with the same ID comes back with its keys. The whole dataset is still held in memory.
+//
+// Each record in the snapshot and log is a header of the CRC32 and length of the payload, then
+// the payload, which is the record type followed by a serialised dht_proto.Entry. A record which
+// was only partly written when the process crashed fails its checksum, and is truncated away
+// along with anything after it.
+type DiskStore struct {
+	*KeyStore
+
+	dir string
+
+	muLog   sync.Mutex
+	log     *os.File
+	records int
+	dirty   bool
+
+	shutdown chan struct{}
+	wg       sync.WaitGroup
+}
+
+// OpenDiskStore opens the store in dir, creating it if needed, and recovers any keys stored there
+func OpenDiskStore(dir string, id chord.Id) (*DiskStore, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	d := &DiskStore{
+		KeyStore: CreateKeyStore(id),
+		dir:      dir,
+		shutdown: make(chan struct{}),
+	}
+
+	_, err = d.replay(filepath.Join(dir, SNAPSHOT_FILE))
+	if err != nil {
+		return nil, fmt.Errorf("could not load snapshot: %w", err)
+	}
+
+	d.records, err = d.replay(filepath.Join(dir, LOG_FILE))
+	if err != nil {
+		return nil, fmt.Errorf("could not replay log: %w", err)
+	}
+
+	d.log, err = os.OpenFile(filepath.Join(dir, LOG_FILE), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Printf("Recovered %v keys from %v\n", d.Len(), dir)
+
+	// Only start journaling once everything on disk has been loaded
+	d.KeyStore.journal = d
+
+	d.wg.Add(1)
+	go d.maintain()
+
+	return d, nil
+}
+
+// replay loads every record in a file into the store, returning how many there were. A torn
+// record at the end of the file is treated as the end of it, and truncated away.
+func (d *DiskStore) replay(path string) (int, error) {
+	f, err := os.OpenFile(path, os.O_RDWR, 0644)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	var offset int64
+	records := 0
+	for {
+		op, entry, size, err := readRecord(r)
+		if err == io.EOF {
+			return records, nil
+		}
+		if err != nil {
+			slog.Warn("truncating torn record", "file", path, "offset", offset, "err", err)
+			return records, f.Truncate(offset)
+		}
+
+		switch op {
+		case recordPut:
+			d.restore(entry.Key, entry.Value, entry.Version, parseExpiry(entry.Expires), entry.Deleted)
+		case recordRemove:
+			d.KeyStore.DeleteKey(entry.Key)
+		}
+
+		offset += size
+		records++
+	}
+}
+
+// record appends an entry to the log, it's part of the journal interface
+func (d *DiskStore) record(entry *keyentry) {
+	d.append(recordPut, serializeEntry(entry.export()))
+}
+
+// remove appends the removal of a key to the log, it's part of the journal interface
+func (d *DiskStore) remove(key string) {
+	d.append(recordRemove, &dht_proto.Entry{Key: key})
+}
+
+func (d *DiskStore) append(op byte, entry *dht_proto.Entry) {
+	d.muLog.Lock()
+	defer d.muLog.Unlock()
+
+	if d.log == nil {
+		slog.Error("dropping write to closed log", "key", entry.Key)
+		return
+	}
+
+	err := writeRecord(d.log, op, entry)
+	if err != nil {
+		slog.Error("could not write to log", "key", entry.Key, "err", err)
+		return
+	}
+
+	d.records++
+	d.dirty = true
+}
+
+// maintain syncs the log to disk and compacts it once it grows past the threshold
+func (d *DiskStore) maintain() {
+	defer d.wg.Done()
+
+	syncTicker := time.NewTicker(SYNC_INTERVAL)
+	defer syncTicker.Stop()
+
+	compactionTicker := time.NewTicker(COMPACTION_INTERVAL)
+	defer compactionTicker.Stop()
+
+	for {
+		select {
+		case <-syncTicker.C:
+			err := d.Sync()
+			if err != nil {
+				slog.Error("could not sync log", "err", err)
+			}
+
+		case <-compactionTicker.C:
+			d.muLog.Lock()
+			full := d.records >= COMPACTION_THRESHOLD
+			d.muLog.Unlock()
+
+			if full {
+				err := d.Compact()
+				if err != nil {
+					slog.Error("could not compact log", "err", err)
+				}
+			}
+
+		case <-d.shutdown:
+			return
+		}
+	}
+}
+
+// Sync flushes the log to disk if anything has been written since the last sync
+func (d *DiskStore) Sync() error {
+	d.muLog.Lock()
+	defer d.muLog.Unlock()
+
+	if !d.dirty || d.log == nil {
+		return nil
+	}
+
+	d.dirty = false
+	return d.log.Sync()
+}
+
+// Compact writes the contents of the store to a new snapshot and empties the log. Writes to the
+// store are blocked until it completes, so the snapshot and log never overlap.
+func (d *DiskStore) Compact() error {
+	d.muKeys.Lock()
+	defer d.muKeys.Unlock()
+
+	d.muLog.Lock()
+	defer d.muLog.Unlock()
+
+	if d.log == nil {
+		return fmt.Errorf("store is closed")
+	}
+
+	path := filepath.Join(d.dir, SNAPSHOT_FILE)
+	err := d.writeSnapshot(path + ".tmp")
+	if err != nil {
+		return err
+	}
+
+	// The rename is atomic, a crash before it leaves the old snapshot and the full log in place
+	err = os.Rename(path+".tmp", path)
+	if err != nil {
+		return err
+	}
+
+	err = syncDir(d.dir)
+	if err != nil {
+		return err
+	}
+
+	err = d.log.Truncate(0)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Compacted %v log records into a snapshot of %v keys\n", d.records, len(d.Keys))
+	d.records = 0
+	d.dirty = true
+	promCompactionsTotal.Inc()
+
+	return nil
+}
+
+// writeSnapshot writes every entry in the store to path. Requires the store lock.
+func (d *DiskStore) writeSnapshot(path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	w := bufio.NewWriter(f)
+	for _, v := range d.Keys {
+		v.RLock()
+		err = writeRecord(w, recordPut, serializeEntry(v.export()))
+		v.RUnlock()
+
+		if err != nil {
+			return err
+		}
+	}
+
+	err = w.Flush()
+	if err != nil {
+		return err
+	}
+
+	return f.Sync()
+}
+
+// Close stops background maintenance and syncs the log, the store can't be written to afterwards
+func (d *DiskStore) Close() error {
+	close(d.shutdown)
+	d.wg.Wait()
+
+	err := d.Sync()
+	if err != nil {
+		return err
+	}
+
+	d.muLog.Lock()
+	defer d.muLog.Unlock()
+
+	err = d.log.Close()
+	d.log = nil
+	return err
+}
+
+func writeRecord(w io.Writer, op byte, entry *dht_proto.Entry) error {
+	data, err := proto.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	// The record is built up front so that it reaches the file in a single write
+	record := make([]byte, recordHeaderSize+1+len(data))
+	record[recordHeaderSize] = op
+	copy(record[recordHeaderSize+1:], data)
+
+	payload := record[recordHeaderSize:]
+	binary.LittleEndian.PutUint32(record[0:4], crc32.ChecksumIEEE(payload))
+	binary.LittleEndian.PutUint32(record[4:8], uint32(len(payload)))
+
+	_, err = w.Write(record)
+	return err
+}
+
+// readRecord reads the next record, returning io.EOF only if there are no more bytes at all
+func readRecord(r io.Reader) (byte, *dht_proto.Entry, int64, error) {
+	header := make([]byte, recordHeaderSize)
+	_, err := io.ReadFull(r, header)
+	if err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return 0, nil, 0, fmt.Errorf("short header")
+		}
+		return 0, nil, 0, err
+	}
+
+	checksum := binary.LittleEndian.Uint32(header[0:4])
+	length := binary.LittleEndian.Uint32(header[4:8])
+	if length == 0 || length > maxRecordSize {
+		return 0, nil, 0, fmt.Errorf("invalid record length %v", length)
+	}
+
+	payload := make([]byte, length)
+	_, err = io.ReadFull(r, payload)
+	if err != nil {
+		return 0, nil, 0, fmt.Errorf("short record: %w", err)
+	}
+
+	if crc32.ChecksumIEEE(payload) != checksum {
+		return 0, nil, 0, fmt.Errorf("checksum mismatch")
+	}
+
+	entry := &dht_proto.Entry{}
+	err = proto.Unmarshal(payload[1:], entry)
+	if err != nil {
+		return 0, nil, 0, err
+	}
+
+	return payload[0], entry, int64(recordHeaderSize + length), nil
+}
+
+// syncDir makes a rename within dir durable
+func syncDir(dir string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return f.Sync()
+}
@@ -0,0 +1,105 @@
+package dht
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDiskStoreRecoversKeys(t *testing.T) {
+	dir := t.TempDir()
+
+	d, err := OpenDiskStore(dir, 0)
+	assert.Nil(t, err)
+
+	d.SetVersionedKey("kept", []byte("a"), 1)
+	d.SetVersionedKey("overwritten", []byte("b"), 1)
+	d.SetVersionedKey("overwritten", []byte("c"), 2)
+	d.SetVersionedKey("deleted", []byte("d"), 1)
+	d.DeleteVersionedKey("deleted", 2)
+	d.SetVersionedKey("dropped", []byte("e"), 1)
+	d.DeleteKey("dropped")
+	assert.Nil(t, d.Close())
+
+	d, err = OpenDiskStore(dir, 0)
+	assert.Nil(t, err)
+	defer d.Close()
+
+	value, version, _ := d.GetVersionedKey("kept")
+	assert.Equal(t, []byte("a"), value)
+	assert.Equal(t, uint64(1), version)
+
+	value, version, _ = d.GetVersionedKey("overwritten")
+	assert.Equal(t, []byte("c"), value)
+	assert.Equal(t, uint64(2), version)
+
+	entry, ok := d.Lookup("deleted")
+	assert.True(t, ok, "the tombstone should survive a restart")
+	assert.True(t, entry.Deleted)
+
+	_, ok = d.Lookup("dropped")
+	assert.False(t, ok)
+	assert.Equal(t, 3, d.Len())
+}
+
+func TestDiskStoreCompaction(t *testing.T) {
+	dir := t.TempDir()
+
+	d, err := OpenDiskStore(dir, 0)
+	assert.Nil(t, err)
+
+	expires := time.UnixMilli(time.Now().Add(time.Hour).UnixMilli())
+	d.SetExpiringKey("before", []byte("a"), 1, expires)
+	assert.Nil(t, d.Compact())
+
+	info, err := os.Stat(filepath.Join(dir, LOG_FILE))
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), info.Size(), "compaction should empty the log")
+
+	d.SetVersionedKey("after", []byte("b"), 2)
+	assert.Nil(t, d.Close())
+
+	d, err = OpenDiskStore(dir, 0)
+	assert.Nil(t, err)
+	defer d.Close()
+
+	assert.True(t, d.HasKey("before"))
+	assert.True(t, d.HasKey("after"))
+	assert.Equal(t, expires, d.Keys["before"].Expires)
+}
+
+func TestDiskStoreTruncatesTornRecord(t *testing.T) {
+	dir := t.TempDir()
+
+	d, err := OpenDiskStore(dir, 0)
+	assert.Nil(t, err)
+	d.SetVersionedKey("test", []byte("a"), 1)
+	assert.Nil(t, d.Close())
+
+	path := filepath.Join(dir, LOG_FILE)
+	good, _ := os.Stat(path)
+
+	// Simulate a crash part way through writing a record
+	f, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	f.Write([]byte{1, 2, 3, 4, 5, 6, 7, 8, 9})
+	f.Close()
+
+	d, err = OpenDiskStore(dir, 0)
+	assert.Nil(t, err)
+
+	assert.True(t, d.HasKey("test"))
+	info, _ := os.Stat(path)
+	assert.Equal(t, good.Size(), info.Size(), "the torn record should be truncated")
+
+	// The log is still usable afterwards
+	d.SetVersionedKey("next", []byte("b"), 2)
+	assert.Nil(t, d.Close())
+
+	d, err = OpenDiskStore(dir, 0)
+	assert.Nil(t, err)
+	defer d.Close()
+	assert.True(t, d.HasKey("next"))
+}
@@ -0,0 +1,280 @@
+package dht
+
+import (
+	"chord_dht/chord"
+	dht_proto "chord_dht/protos/dht"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// The gateway serves the DHT over plain HTTP for clients without gRPC:
+//
+//	GET    /keys/{key}  returns the value as the body, 404 if it doesn't exist
+//	PUT    /keys/{key}  stores the body as the value
+//	DELETE /keys/{key}  deletes the key
+//	GET    /ring        lists the nodes of the ring as JSON
+//
+// The namespace, consistency and, for PUT, ttl in seconds are given as query parameters. The
+// version of a key is returned in the ETag and X-Version headers, and a PUT can be made
+// conditional with If-Match on a version or If-None-Match: * for a key which doesn't exist.
+// Requests are proxied to the owner of the key, so any node can be used. Errors are returned
+// as a JSON object with an error field.
+
+// The largest value the gateway accepts, leaving room within the 4 MiB gRPC message limit for
+// the rest of the request as it's forwarded. Larger values should be stored as objects.
+const GATEWAY_MAX_VALUE = 4<<20 - 64<<10
+
+// RegisterGateway adds the routes of the HTTP gateway to mux
+func (s *Server) RegisterGateway(mux *http.ServeMux) {
+	mux.HandleFunc("/keys/", s.serveKey)
+	mux.HandleFunc("/ring", s.serveRing)
+}
+
+// httpStatus returns the HTTP status code matching the gRPC status of an error
+func httpStatus(err error) int {
+	switch status.Code(err) {
+	case codes.OK:
+		return http.StatusOK
+	case codes.InvalidArgument, codes.OutOfRange:
+		return http.StatusBadRequest
+	case codes.NotFound:
+		return http.StatusNotFound
+	case codes.AlreadyExists, codes.Aborted:
+		return http.StatusConflict
+	case codes.FailedPrecondition:
+		return http.StatusPreconditionFailed
+	case codes.ResourceExhausted:
+		return http.StatusTooManyRequests
+	case codes.PermissionDenied:
+		return http.StatusForbidden
+	case codes.Unauthenticated:
+		return http.StatusUnauthorized
+	case codes.Unimplemented:
+		return http.StatusNotImplemented
+	case codes.Unavailable:
+		return http.StatusServiceUnavailable
+	case codes.DeadlineExceeded:
+		return http.StatusGatewayTimeout
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	writeJSON(w, httpStatus(err), map[string]string{
+		"error": status.Convert(err).Message(),
+	})
+}
+
+func writeVersion(w http.ResponseWriter, version uint64) {
+	w.Header().Set("ETag", strconv.Quote(strconv.FormatUint(version, 10)))
+	w.Header().Set("X-Version", strconv.FormatUint(version, 10))
+}
+
+// parseConsistency reads the consistency query parameter, ONE if it's absent
+func parseConsistency(r *http.Request) (dht_proto.Consistency, error) {
+	param := r.URL.Query().Get("consistency")
+	if param == "" {
+		return dht_proto.Consistency_ONE, nil
+	}
+
+	c, ok := dht_proto.Consistency_value[strings.ToUpper(param)]
+	if !ok {
+		return 0, status.Errorf(codes.InvalidArgument, "invalid consistency %q, expected one, quorum or all", param)
+	}
+
+	return dht_proto.Consistency(c), nil
+}
+
+// parseGatewayPrecondition reads the conditional headers of a PUT
+func parseGatewayPrecondition(r *http.Request) (*dht_proto.Precondition, error) {
+	if match := r.Header.Get("If-None-Match"); match != "" {
+		if match != "*" {
+			return nil, status.Error(codes.InvalidArgument, "If-None-Match only supports *")
+		}
+		return &dht_proto.Precondition{
+			Condition: &dht_proto.Precondition_IfNotExists{IfNotExists: true},
+		}, nil
+	}
+
+	if match := r.Header.Get("If-Match"); match != "" {
+		version, err := strconv.ParseUint(strings.Trim(match, `"`), 10, 64)
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "If-Match should be the version of the key, got %q", match)
+		}
+		return &dht_proto.Precondition{
+			Condition: &dht_proto.Precondition_IfVersion{IfVersion: version},
+		}, nil
+	}
+
+	return nil, nil
+}
+
+func (s *Server) serveKey(w http.ResponseWriter, r *http.Request) {
+	key := strings.TrimPrefix(r.URL.Path, "/keys/")
+	if key == "" {
+		writeError(w, status.Error(codes.InvalidArgument, "a key is required"))
+		return
+	}
+
+	namespace := r.URL.Query().Get("namespace")
+	c, err := parseConsistency(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		res, err := s.GetKey(r.Context(), &dht_proto.GetKeyRequest{
+			Key:         key,
+			Namespace:   namespace,
+			Consistency: c,
+			Proxy:       true,
+		})
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+
+		writeVersion(w, res.Version)
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Write(res.Value)
+
+	case http.MethodPut:
+		precondition, err := parseGatewayPrecondition(r)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+
+		var ttl int64
+		if param := r.URL.Query().Get("ttl"); param != "" {
+			ttl, err = strconv.ParseInt(param, 10, 64)
+			if err != nil || ttl < 0 {
+				writeError(w, status.Errorf(codes.InvalidArgument, "invalid ttl %q, expected a number of seconds", param))
+				return
+			}
+		}
+
+		value, err := io.ReadAll(http.MaxBytesReader(w, r.Body, GATEWAY_MAX_VALUE))
+		if err != nil {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				writeJSON(w, http.StatusRequestEntityTooLarge, map[string]string{
+					"error": fmt.Sprintf("values are limited to %v bytes, store larger values as objects", GATEWAY_MAX_VALUE),
+				})
+				return
+			}
+			writeError(w, status.Error(codes.InvalidArgument, err.Error()))
+			return
+		}
+
+		res, err := s.SetKey(r.Context(), &dht_proto.SetKeyRequest{
+			Key:          key,
+			Namespace:    namespace,
+			Value:        value,
+			Consistency:  c,
+			Precondition: precondition,
+			TtlSeconds:   ttl,
+			Proxy:        true,
+		})
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+
+		// A hinted write is accepted but won't reach the owner until it's back
+		code := http.StatusOK
+		if res.Hinted {
+			code = http.StatusAccepted
+		}
+
+		writeVersion(w, res.Version)
+		writeJSON(w, code, map[string]any{
+			"version": res.Version,
+			"hinted":  res.Hinted,
+		})
+
+	case http.MethodDelete:
+		res, err := s.DeleteKey(r.Context(), &dht_proto.DeleteKeyRequest{
+			Key:         key,
+			Namespace:   namespace,
+			Consistency: c,
+			Proxy:       true,
+		})
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+
+		if res.Hinted {
+			w.WriteHeader(http.StatusAccepted)
+		} else {
+			w.WriteHeader(http.StatusNoContent)
+		}
+
+	default:
+		w.Header().Set("Allow", "GET, HEAD, PUT, DELETE")
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{
+			"error": fmt.Sprintf("method %v isn't supported", r.Method),
+		})
+	}
+}
+
+// gatewayNode describes a node of the ring in the response to GET /ring
+type gatewayNode struct {
+	Id      chord.Id `json:"id"`
+	Address string   `json:"address"`
+	DHT     string   `json:"dht"`
+
+	// The range (start, end] of Chord identifiers the node owns
+	Start chord.Id `json:"start"`
+	End   chord.Id `json:"end"`
+}
+
+func (s *Server) serveRing(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{
+			"error": fmt.Sprintf("method %v isn't supported", r.Method),
+		})
+		return
+	}
+
+	peers, err := s.ringPeers()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	// The peers are in ring order, so each node's range starts at the one before it
+	nodes := make([]gatewayNode, len(peers))
+	for i, p := range peers {
+		nodes[i] = gatewayNode{
+			Id:      p.Id,
+			Address: p.Address,
+			DHT:     dhtAddress(p),
+			Start:   peers[(i+len(peers)-1)%len(peers)].Id,
+			End:     p.Id,
+		}
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{
+		"nodes": nodes,
+	})
+}
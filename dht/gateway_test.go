@@ -0,0 +1,108 @@
+package dht
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func gatewayRequest(t *testing.T, url string, method string, body string, headers map[string]string) *http.Response {
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	assert.Nil(t, err)
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	assert.Nil(t, err)
+	t.Cleanup(func() { res.Body.Close() })
+
+	return res
+}
+
+func TestGatewayRoundTrip(t *testing.T) {
+	mux := http.NewServeMux()
+	testServer().RegisterGateway(mux)
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	res := gatewayRequest(t, ts.URL+"/keys/a/b?namespace=ns", http.MethodPut, "value", nil)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	version := res.Header.Get("X-Version")
+	assert.NotEmpty(t, version)
+
+	res = gatewayRequest(t, ts.URL+"/keys/a/b?namespace=ns&consistency=quorum", http.MethodGet, "", nil)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, `"`+version+`"`, res.Header.Get("ETag"))
+	body, _ := io.ReadAll(res.Body)
+	assert.Equal(t, "value", string(body))
+
+	// The key is scoped by its namespace
+	res = gatewayRequest(t, ts.URL+"/keys/a/b", http.MethodGet, "", nil)
+	assert.Equal(t, http.StatusNotFound, res.StatusCode)
+
+	res = gatewayRequest(t, ts.URL+"/keys/a/b?namespace=ns", http.MethodPut, "again", map[string]string{"If-None-Match": "*"})
+	assert.Equal(t, http.StatusPreconditionFailed, res.StatusCode)
+
+	res = gatewayRequest(t, ts.URL+"/keys/a/b?namespace=ns", http.MethodPut, "again", map[string]string{"If-Match": `"` + version + `"`})
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+
+	res = gatewayRequest(t, ts.URL+"/keys/a/b?namespace=ns", http.MethodDelete, "", nil)
+	assert.Equal(t, http.StatusNoContent, res.StatusCode)
+
+	res = gatewayRequest(t, ts.URL+"/keys/a/b?namespace=ns", http.MethodGet, "", nil)
+	assert.Equal(t, http.StatusNotFound, res.StatusCode)
+}
+
+func TestGatewayRejectsBadRequests(t *testing.T) {
+	mux := http.NewServeMux()
+	testServer().RegisterGateway(mux)
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	res := gatewayRequest(t, ts.URL+"/keys/a?consistency=some", http.MethodGet, "", nil)
+	assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+
+	var body map[string]string
+	assert.Nil(t, json.NewDecoder(res.Body).Decode(&body))
+	assert.Contains(t, body["error"], "consistency")
+
+	res = gatewayRequest(t, ts.URL+"/keys/a?ttl=soon", http.MethodPut, "", nil)
+	assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+
+	res = gatewayRequest(t, ts.URL+"/keys/a", http.MethodPost, "", nil)
+	assert.Equal(t, http.StatusMethodNotAllowed, res.StatusCode)
+
+	res = gatewayRequest(t, ts.URL+"/keys/a", http.MethodPut, strings.Repeat("x", GATEWAY_MAX_VALUE+1), nil)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, res.StatusCode)
+}
+
+func TestGatewayRing(t *testing.T) {
+	mux := http.NewServeMux()
+	testServer().RegisterGateway(mux)
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	res := gatewayRequest(t, ts.URL+"/ring", http.MethodGet, "", nil)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+
+	var ring struct {
+		Nodes []gatewayNode `json:"nodes"`
+	}
+	assert.Nil(t, json.NewDecoder(res.Body).Decode(&ring))
+	assert.Len(t, ring.Nodes, 1)
+	assert.Equal(t, ring.Nodes[0].Start, ring.Nodes[0].End)
+}
+
+func TestHTTPStatus(t *testing.T) {
+	assert.Equal(t, http.StatusNotFound, httpStatus(status.Error(codes.NotFound, "")))
+	assert.Equal(t, http.StatusTooManyRequests, httpStatus(status.Error(codes.ResourceExhausted, "")))
+	assert.Equal(t, http.StatusInternalServerError, httpStatus(io.EOF))
+}
@@ -0,0 +1,171 @@
+package dht
+
+import (
+	"chord_dht/chord"
+	dht_proto "chord_dht/protos/dht"
+	"context"
+	"fmt"
+	"time"
+)
+
+// The maximum time a joining node will spend pulling its range from its successor
+const HANDOFF_TIMEOUT = 60 * time.Second
+
+// How long the previous owner waits for a joining node to pull its keys before pushing them
+// itself, longer than the pull may take so that the two don't overlap
+const HANDOFF_GRACE = HANDOFF_TIMEOUT + 15*time.Second
+
+// handoffState tracks a range being handed off, either the range a joining node is still
+// pulling from its successor or the range the successor is handing to it
+type handoffState struct {
+	r    chord.KeyRange
+	from string
+
+	// When an outgoing handoff is given up on if it hasn't been confirmed
+	until time.Time
+}
+
+// pullRange fetches the keys the node has taken over from its successor after joining. Until
+// it completes, lookups for missing keys in the range are redirected to the successor, which
+// keeps serving them until the handoff is confirmed.
+func (s *Server) pullRange() {
+	succ, _ := s.node.Successor()
+	if succ == nil || succ.Identifier() == s.node.Identifier() {
+		return
+	}
+
+	if chord.GetNodeAddress(succ) == "" {
+		return
+	}
+	addr := dhtAddress(chord.PeerOf(succ))
+
+	// Everything the successor holds outside of its new range (us, successor] is now ours
+	r := chord.KeyRange{Start: succ.Identifier(), End: s.node.Identifier()}
+
+	s.muHandoff.Lock()
+	s.incoming = &handoffState{r: r, from: addr}
+	s.muHandoff.Unlock()
+
+	defer func() {
+		s.muHandoff.Lock()
+		s.incoming = nil
+		s.muHandoff.Unlock()
+	}()
+
+	fmt.Printf("Pulling range %v from %v\n", r, succ)
+	received := 0
+	var pulled []*dht_proto.Entry
+	err := Handoff(addr, r, func(entry *dht_proto.Entry) {
+		// Anything written to us since joining is newer than the successor's copy
+		if s.keystore.Apply(entry.Key, entry.Value, entry.Version, parseExpiry(entry.Expires), entry.Deleted) {
+			received++
+		}
+		pulled = append(pulled, &dht_proto.Entry{Key: entry.Key, Version: entry.Version})
+	})
+	if err != nil {
+		fmt.Printf("handoff from %v failed, waiting for keys to be pushed instead: %v\n", succ, err)
+		return
+	}
+
+	// Every key is here now, so there's nothing left to redirect to the successor
+	s.muHandoff.Lock()
+	s.incoming = nil
+	s.muHandoff.Unlock()
+
+	err = ConfirmHandoff(addr, r, pulled)
+	if err != nil {
+		fmt.Printf("could not confirm handoff with %v: %v\n", succ, err)
+		return
+	}
+
+	fmt.Printf("Handoff complete, received %v keys\n", received)
+}
+
+// handoffSource returns the address of the DHT server on the node still serving id during a handoff, or
+// an empty string if the id isn't being handed off
+func (s *Server) handoffSource(id chord.Id) string {
+	s.muHandoff.RLock()
+	defer s.muHandoff.RUnlock()
+
+	if s.incoming == nil || !s.incoming.r.Contains(id) {
+		return ""
+	}
+
+	return s.incoming.from
+}
+
+// handingOff returns whether id is in a range the node is handing off to a joining node. The
+// joining node redirects lookups for keys it hasn't pulled yet back to us, so a key we don't
+// have either is missing, rather than to be looked up on its new owner.
+func (s *Server) handingOff(id chord.Id) bool {
+	s.muHandoff.RLock()
+	defer s.muHandoff.RUnlock()
+
+	return s.outgoing != nil && s.outgoing.r.Contains(id) && time.Now().Before(s.outgoing.until)
+}
+
+func (s *Server) Handoff(in *dht_proto.HandoffRequest, stream dht_proto.DHT_HandoffServer) error {
+	r := chord.KeyRange{Start: chord.Id(in.Start), End: chord.Id(in.End)}
+	fmt.Printf("Handing off range %v\n", r)
+
+	// Buckets are only asked for by anti-entropy, which doesn't move the range
+	var entries []Entry
+	if len(in.Buckets) > 0 {
+		buckets := make([]int, len(in.Buckets))
+		for i, b := range in.Buckets {
+			buckets[i] = int(b)
+		}
+		entries = entriesInBuckets(s.keystore, r, buckets)
+	} else {
+		s.muHandoff.Lock()
+		s.outgoing = &handoffState{r: r, until: time.Now().Add(HANDOFF_TIMEOUT)}
+		s.muHandoff.Unlock()
+
+		entries = entriesInRange(s.keystore, r)
+	}
+
+	for _, v := range entries {
+		err := stream.Send(serializeEntry(v))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *Server) ConfirmHandoff(ctx context.Context, in *dht_proto.ConfirmHandoffRequest) (*dht_proto.ConfirmHandoffResponse, error) {
+	r := chord.KeyRange{Start: chord.Id(in.Start), End: chord.Id(in.End)}
+
+	s.muHandoff.Lock()
+	if s.outgoing != nil && s.outgoing.r == r {
+		s.outgoing = nil
+	}
+	s.muHandoff.Unlock()
+
+	// The new node's successor is its first replica, CheckKeys drops anything we no longer need
+	if s.replicationFactor > 1 {
+		fmt.Printf("Handoff of range %v confirmed, keeping keys as a replica\n", r)
+		return &dht_proto.ConfirmHandoffResponse{}, nil
+	}
+
+	// Only the copies the new owner received are dropped, anything written since is kept
+	// until it's pushed on
+	deleted := 0
+	for _, v := range in.Entries {
+		if !r.Contains(ChordIdFromString(v.Key)) {
+			continue
+		}
+
+		if stored, ok := s.keystore.Lookup(v.Key); ok && stored.Version == v.Version {
+			if s.keystore.DeleteKey(v.Key) == nil {
+				deleted++
+			}
+		}
+	}
+
+	fmt.Printf("Handoff of range %v confirmed, dropped %v keys\n", r, deleted)
+	return &dht_proto.ConfirmHandoffResponse{
+		Deleted: int32(deleted),
+	}, nil
+}
@@ -0,0 +1,52 @@
+package dht
+
+import (
+	"chord_dht/chord"
+	dht_proto "chord_dht/protos/dht"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConfirmHandoffKeepsNewerWrites(t *testing.T) {
+	s := testServer()
+	pulled, stale := newVersion(), newVersion()
+	s.keystore.SetExpiringKey("pulled", []byte("1"), pulled, time.Time{})
+	s.keystore.SetExpiringKey("rewritten", []byte("1"), stale, time.Time{})
+
+	// Written after the stream finished, so the new owner only has the old version
+	s.keystore.SetExpiringKey("rewritten", []byte("2"), newVersion(), time.Time{})
+	s.keystore.SetExpiringKey("unseen", []byte("1"), newVersion(), time.Time{})
+
+	r := chord.KeyRange{Start: 1, End: 1}
+	s.outgoing = &handoffState{r: r, until: time.Now().Add(HANDOFF_TIMEOUT)}
+
+	res, err := s.ConfirmHandoff(context.Background(), &dht_proto.ConfirmHandoffRequest{
+		Start: int64(r.Start),
+		End:   int64(r.End),
+		Entries: []*dht_proto.Entry{
+			{Key: "pulled", Version: pulled},
+			{Key: "rewritten", Version: stale},
+		},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, int32(1), res.Deleted)
+
+	assert.False(t, s.keystore.HasKey("pulled"))
+	assert.True(t, s.keystore.HasKey("rewritten"))
+	assert.True(t, s.keystore.HasKey("unseen"))
+	assert.False(t, s.handingOff(ChordIdFromString("unseen")), "a confirmed handoff is over")
+}
+
+func TestHandingOffExpires(t *testing.T) {
+	s := testServer()
+	id := ChordIdFromString("key")
+
+	s.outgoing = &handoffState{r: chord.KeyRange{Start: 1, End: 1}, until: time.Now().Add(time.Minute)}
+	assert.True(t, s.handingOff(id))
+
+	s.outgoing.until = time.Now().Add(-time.Second)
+	assert.False(t, s.handingOff(id), "a handoff which was never confirmed is given up on")
+}
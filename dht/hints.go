@@ -0,0 +1,227 @@
+package dht
+
+import (
+	"chord_dht/chord"
+	"fmt"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// The interval between attempts to deliver hints to their owners
+const HINT_DELIVERY_INTERVAL = 5 * time.Second
+
+// The maximum number of hints kept for each owner, the oldest are dropped beyond this
+const MAX_HINTS = 100000
+
+// hint is a write accepted on behalf of an owner which couldn't be reached. Hints are only
+// held in memory, so they're lost if the node restarts before delivering them.
+type hint struct {
+	entry   Entry
+	created time.Time
+}
+
+// hintQueue holds the hints for a single owner, in the order they were written
+type hintQueue struct {
+	owner   chord.Id
+	address string // the DHT server of the owner
+	node    interface{ Alive() bool }
+	hints   []hint
+}
+
+// unreachable returns if a request may have failed because the node couldn't be reached. Nodes
+// answer Unavailable themselves too, so it's no more than a reason to check.
+func unreachable(err error) bool {
+	code := status.Code(err)
+	return code == codes.Unavailable || code == codes.DeadlineExceeded
+}
+
+// addHint stores a write for an owner which is down, it's delivered once the owner is back
+func (s *Server) addHint(owner chord.Id, address string, node interface{ Alive() bool }, entry Entry) {
+	s.muHints.Lock()
+	defer s.muHints.Unlock()
+
+	q, ok := s.hints[owner]
+	if !ok {
+		q = &hintQueue{owner: owner, address: address, node: node}
+		s.hints[owner] = q
+	}
+
+	q.hints = append(q.hints, hint{entry: entry, created: time.Now()})
+	s.trimHints(q)
+	s.updateHintMetrics(q)
+
+	fmt.Printf("Stored hint for %v on behalf of %v\n", entry.Key, owner)
+}
+
+// trimHints drops the oldest hints beyond MAX_HINTS. Requires the hints lock.
+func (s *Server) trimHints(q *hintQueue) {
+	if excess := len(q.hints) - MAX_HINTS; excess > 0 {
+		fmt.Printf("Hint queue for %v is full, dropping %v hints\n", q.owner, excess)
+		q.hints = q.hints[excess:]
+		promHintsDroppedTotal.Add(float64(excess))
+	}
+}
+
+// updateHintMetrics reports the size and age of a queue, removing it once it's empty.
+// Requires the hints lock.
+func (s *Server) updateHintMetrics(q *hintQueue) {
+	label := fmt.Sprint(q.owner)
+	if len(q.hints) == 0 {
+		delete(s.hints, q.owner)
+		s.hintsGauge.DeleteLabelValues(label)
+		s.hintAgeGauge.DeleteLabelValues(label)
+		return
+	}
+
+	s.hintsGauge.WithLabelValues(label).Set(float64(len(q.hints)))
+	s.hintAgeGauge.WithLabelValues(label).Set(time.Since(q.hints[0].created).Seconds())
+}
+
+// deliverHints periodically hands queued hints to their owners
+func (s *Server) deliverHints() {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(HINT_DELIVERY_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.muHints.Lock()
+			queues := make([]*hintQueue, 0, len(s.hints))
+			for _, q := range s.hints {
+				queues = append(queues, q)
+			}
+			s.muHints.Unlock()
+
+			for _, q := range queues {
+				s.deliverQueue(q)
+			}
+
+		case <-s.shutdown:
+			return
+		}
+	}
+}
+
+// deliverQueue sends the hints for one owner once the failure detector sees it again. If the
+// ring has routed around the owner in the meantime, its keys now belong to its successor, so
+// the hints go there instead.
+func (s *Server) deliverQueue(q *hintQueue) {
+	address := q.address
+	if !q.node.Alive() {
+		succ, _, err := s.node.FindSuccessor(q.owner, 0)
+		if err != nil || succ.Identifier() == q.owner {
+			// Still down and still responsible for its keys, keep waiting
+			s.muHints.Lock()
+			s.updateHintMetrics(q)
+			s.muHints.Unlock()
+			return
+		}
+		address = ""
+		if chord.GetNodeAddress(succ) != "" {
+			address = dhtAddress(chord.PeerOf(succ))
+		}
+	}
+
+	s.muHints.Lock()
+	pending := q.hints
+	q.hints = nil
+	s.muHints.Unlock()
+
+	if len(pending) == 0 {
+		return
+	}
+
+	entries := make([]Entry, len(pending))
+	for i, h := range pending {
+		entries[i] = h.entry
+	}
+
+	err := s.deliverEntries(address, entries, true)
+
+	s.muHints.Lock()
+	defer s.muHints.Unlock()
+
+	if err != nil {
+		fmt.Printf("could not deliver %v hints for %v: %v\n", len(pending), q.owner, err)
+		q.hints = append(pending, q.hints...)
+		s.trimHints(q)
+	} else {
+		fmt.Printf("Delivered %v hints for %v\n", len(pending), q.owner)
+		promHintsDeliveredTotal.Add(float64(len(pending)))
+	}
+
+	if s.hints[q.owner] == q {
+		s.updateHintMetrics(q)
+	}
+}
+
+// deliverEntries hands entries to the node at address, or applies them locally if the keys
+// now belong to us. Hinted entries are checked against the owner's quotas.
+func (s *Server) deliverEntries(address string, entries []Entry, hinted bool) error {
+	if address != "" {
+		_, err := transferRange(address, s.node.Identifier(), entries, false, hinted)
+		return err
+	}
+
+	for _, v := range entries {
+		if hinted {
+			s.applyHint(v)
+		} else {
+			s.keystore.Apply(v.Key, v.Value, v.Version, v.Expires, v.Deleted)
+		}
+	}
+	if s.replicationFactor > 1 {
+		go s.replicateEntries(entries, s.replicaTargets())
+	}
+
+	return nil
+}
+
+// applyHint stores a write which was held as a hint for the node. A hinted write was never
+// admitted by an owner, so it's checked against the quota of its namespace now and dropped if
+// it doesn't fit. Returns whether it was applied.
+func (s *Server) applyHint(v Entry) bool {
+	if v.Deleted {
+		s.quotas.release(s.keystore, v.Key)
+		return s.keystore.Apply(v.Key, v.Value, v.Version, v.Expires, v.Deleted)
+	}
+
+	counted, err := s.quotas.admit(s.keystore, v.Key, v.Value)
+	if err != nil {
+		fmt.Printf("dropping hinted write of %v: %v\n", v.Key, err)
+		return false
+	}
+
+	// A hint older than the stored copy is dropped, and mustn't count
+	applied := s.keystore.Apply(v.Key, v.Value, v.Version, v.Expires, v.Deleted)
+	if !applied {
+		s.quotas.refund(v.Key, counted)
+	}
+
+	return applied
+}
+
+func newHintGauges(id chord.Id) (*prometheus.GaugeVec, *prometheus.GaugeVec) {
+	labels := prometheus.Labels{
+		"id": fmt.Sprint(id),
+	}
+
+	queued := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name:        "dht_hints_queued",
+		Help:        "The number of writes held as hints for an owner which couldn't be reached",
+		ConstLabels: labels,
+	}, []string{"owner"})
+
+	age := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name:        "dht_hint_oldest_age_seconds",
+		Help:        "The age of the oldest hint held for an owner",
+		ConstLabels: labels,
+	}, []string{"owner"})
+
+	return queued, age
+}
@@ -0,0 +1,83 @@
+package dht
+
+import (
+	"chord_dht/chord"
+	dht_proto "chord_dht/protos/dht"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type fakeLiveness bool
+
+func (f fakeLiveness) Alive() bool {
+	return bool(f)
+}
+
+func TestHintSetKeyRequiresPlainWrite(t *testing.T) {
+	s := testServer()
+
+	_, err := s.hintSetKey(2, "", fakeLiveness(false), "test", &dht_proto.SetKeyRequest{
+		Key:         "test",
+		Consistency: dht_proto.Consistency_QUORUM,
+	})
+	assert.NotNil(t, err)
+
+	_, err = s.hintSetKey(2, "", fakeLiveness(false), "test", &dht_proto.SetKeyRequest{
+		Key:          "test",
+		Precondition: &dht_proto.Precondition{Condition: &dht_proto.Precondition_IfNotExists{IfNotExists: true}},
+	})
+	assert.NotNil(t, err)
+	assert.Empty(t, s.hints)
+}
+
+func TestHintsWaitForOwner(t *testing.T) {
+	s := testServer()
+	s.node.Join(chord.CreateNode(2))
+
+	res, err := s.hintSetKey(2, "", fakeLiveness(false), "test", &dht_proto.SetKeyRequest{Key: "test", Value: []byte("value")})
+	assert.Nil(t, err)
+	assert.True(t, res.Hinted)
+
+	// The ring still routes to the owner, so the hint is kept
+	s.deliverQueue(s.hints[2])
+	assert.Len(t, s.hints[2].hints, 1)
+	assert.False(t, s.keystore.HasKey("test"))
+}
+
+func TestHintsDeliveredOnceOwnerIsBack(t *testing.T) {
+	s := testServer()
+
+	s.hintSetKey(2, "", fakeLiveness(true), "test", &dht_proto.SetKeyRequest{Key: "test", Value: []byte("value")})
+	s.hintDeleteKey(2, "", fakeLiveness(true), "other", &dht_proto.DeleteKeyRequest{Key: "other"})
+	assert.Len(t, s.hints[2].hints, 2)
+
+	// An empty address is the local node, so the hints are applied straight to the store
+	s.deliverQueue(s.hints[2])
+	assert.Empty(t, s.hints)
+
+	value, _, _ := s.keystore.GetVersionedKey("test")
+	assert.Equal(t, []byte("value"), value)
+	entry, _ := s.keystore.Lookup("other")
+	assert.True(t, entry.Deleted)
+}
+
+func TestHintQueueIsBounded(t *testing.T) {
+	s := testServer()
+	q := &hintQueue{owner: 2, node: fakeLiveness(false)}
+	q.hints = make([]hint, MAX_HINTS+5)
+	q.hints[5].entry.Key = "oldest kept"
+
+	s.trimHints(q)
+	assert.Len(t, q.hints, MAX_HINTS)
+	assert.Equal(t, "oldest kept", q.hints[0].entry.Key)
+}
+
+func TestUnreachable(t *testing.T) {
+	assert.True(t, unreachable(status.Error(codes.Unavailable, "connection refused")))
+	assert.True(t, unreachable(status.Error(codes.DeadlineExceeded, "")))
+	assert.False(t, unreachable(status.Error(codes.FailedPrecondition, "")))
+	assert.False(t, unreachable(nil))
+}
@@ -0,0 +1,79 @@
+package dht
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// The number of low bits of a version used by the logical counter
+const LOGICAL_BITS = 16
+
+// The furthest a version from another node may be ahead of the local wall clock. Anything
+// further comes from a node whose clock is badly wrong, or was made up, and observing it would
+// drag every version created here after it.
+const MAX_CLOCK_OFFSET = 10 * time.Second
+
+// ErrClockOffset is returned for a version too far ahead of the local clock to be observed
+var ErrClockOffset = errors.New("version is too far ahead of the local clock")
+
+// Clock is a hybrid logical clock (Kulkarni et al.). Versions pack the wall clock in
+// milliseconds above a logical counter, so they stay close to real time but never go
+// backwards, and every version the node has seen from elsewhere is ordered before the
+// next one it creates even if the wall clocks of the two nodes disagree.
+type Clock struct {
+	mu   sync.Mutex
+	last uint64
+}
+
+// versionClock issues the versions for writes coordinated by this process
+var versionClock = &Clock{}
+
+// Now returns a version greater than any previously issued or observed
+func (c *Clock) Now() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	physical := uint64(time.Now().UnixMilli()) << LOGICAL_BITS
+	if physical > c.last {
+		c.last = physical
+	} else {
+		c.last++
+	}
+
+	return c.last
+}
+
+// Observe advances the clock past a version received from another node. A version more than
+// MAX_CLOCK_OFFSET ahead of the wall clock is refused with ErrClockOffset, and the clock is left
+// alone.
+func (c *Clock) Observe(version uint64) error {
+	if ahead := time.Until(versionTime(version)); ahead > MAX_CLOCK_OFFSET {
+		return fmt.Errorf("%w: %v ahead", ErrClockOffset, ahead.Round(time.Millisecond))
+	}
+
+	c.advance(version)
+	return nil
+}
+
+// advance moves the clock up to version without any check, for versions the node created
+// itself, e.g. read back from disk after a restart
+func (c *Clock) advance(version uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if version > c.last {
+		c.last = version
+	}
+}
+
+// newVersion returns a version for a new write, later writes have higher versions
+func newVersion() uint64 {
+	return versionClock.Now()
+}
+
+// versionTime returns the wall clock time at which a version was created
+func versionTime(version uint64) time.Time {
+	return time.UnixMilli(int64(version >> LOGICAL_BITS))
+}
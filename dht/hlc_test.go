@@ -0,0 +1,50 @@
+package dht
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClockIsMonotonic(t *testing.T) {
+	c := &Clock{}
+
+	last := c.Now()
+	for i := 0; i < 1000; i++ {
+		next := c.Now()
+		assert.Greater(t, next, last)
+		last = next
+	}
+}
+
+func TestClockObservesRemoteVersions(t *testing.T) {
+	c := &Clock{}
+
+	// A version from a node whose clock is a little ahead of ours
+	remote := uint64(time.Now().Add(MAX_CLOCK_OFFSET/2).UnixMilli()) << LOGICAL_BITS
+	assert.Nil(t, c.Observe(remote))
+
+	assert.Greater(t, c.Now(), remote)
+}
+
+func TestClockRefusesVersionsBeyondMaxOffset(t *testing.T) {
+	c := &Clock{}
+	last := c.Now()
+
+	// A version from a node whose clock is an hour ahead of ours
+	remote := uint64(time.Now().Add(time.Hour).UnixMilli()) << LOGICAL_BITS
+	assert.ErrorIs(t, c.Observe(remote), ErrClockOffset)
+	assert.ErrorIs(t, c.Observe(^uint64(0)), ErrClockOffset)
+
+	next := c.Now()
+	assert.Greater(t, next, last)
+	assert.Less(t, next, remote, "the clock shouldn't have moved")
+}
+
+func TestVersionTime(t *testing.T) {
+	c := &Clock{}
+	now := time.Now()
+
+	assert.WithinDuration(t, now, versionTime(c.Now()), time.Second)
+}
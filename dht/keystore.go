@@ -1,19 +1,126 @@
 package dht
 
 import (
+	"bytes"
 	"chord_dht/chord"
+	"errors"
 	"fmt"
 	"log/slog"
 	"sync"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 )
 
-type keystore interface {
-	HasKey(string) bool
-	SetKey(string, []byte) error
-	GetKey(string) ([]byte, error)
-	DeleteKey(string) error
+// Store is the storage engine behind a DHT node. KeyStore holds keys in memory and DiskStore
+// persists them, other implementations can be passed to StartDHT through Config.Store. If the
+// store implements prometheus.Collector, its metrics are registered too.
+//
+// Every write carries a version, and a store must keep tombstones for deleted keys until they're
+// purged, since they are replicated and handed off like any other entry. Keys past their expiry
+// time are reported as deleted.
+type Store interface {
+	// HasKey returns if the key is stored, and hasn't been deleted or expired
+	HasKey(key string) bool
+
+	// GetVersionedKey returns the value of a live key along with its version
+	GetVersionedKey(key string) ([]byte, uint64, error)
+
+	// Lookup returns whatever the store holds for the key, including tombstones. ok is false
+	// if there is no record of the key at all.
+	Lookup(key string) (entry Entry, ok bool)
+
+	// SetExpiringKey stores a new version of a key, a zero expiry time never expires
+	SetExpiringKey(key string, value []byte, version uint64, expires time.Time) error
+
+	// SetVersionedKeyIf stores a new version of a key only if Precondition.Holds for the stored
+	// copy, checking and writing atomically. Returns ErrPreconditionFailed if it doesn't hold.
+	SetVersionedKeyIf(key string, value []byte, version uint64, expires time.Time, cond Precondition) error
+
+	// Apply stores a value or tombstone from another node only if it's newer than the stored
+	// copy, ordered by NewerThan. Returns whether it was applied.
+	Apply(key string, value []byte, version uint64, expires time.Time, deleted bool) bool
+
+	// DeleteVersionedKey replaces the key with a tombstone
+	DeleteVersionedKey(key string, version uint64) error
+
+	// DeleteKey removes every trace of the key, tombstone or not
+	DeleteKey(key string) error
+
+	// PurgeTombstones drops tombstones for deletes made before the cutoff, returning how many
+	PurgeTombstones(cutoff time.Time) int
+
+	// PurgeExpired replaces keys which have expired by now with tombstones versioned by
+	// expiryVersion, returning how many
+	PurgeExpired(now time.Time) int
+
+	// Len returns the number of entries stored, including tombstones
+	Len() int
+
+	// Range calls fn with a copy of every entry whose Chord ID falls within r, including
+	// tombstones, in no particular order. Iteration stops early if fn returns false. fn must
+	// not call back into the store.
+	Range(r chord.KeyRange, fn func(Entry) bool)
+
+	// Close releases any resources held by the store
+	Close() error
+}
+
+var _ Store = (*KeyStore)(nil)
+var _ Store = (*DiskStore)(nil)
+
+// Entry is a copy of everything stored for a key
+type Entry struct {
+	Key     string
+	Value   []byte
+	Id      chord.Id
+	Version uint64
+	Deleted bool
+	Expires time.Time
+}
+
+// journal is told about every change made to a KeyStore, so that it can be persisted.
+// Both methods are called with the store lock held.
+type journal interface {
+	// record is called after an entry is written, with the entry lock held
+	record(entry *keyentry)
+
+	// remove is called after every trace of a key is dropped from the store
+	remove(key string)
+}
+
+// ErrPreconditionFailed is returned by conditional writes when the condition doesn't hold
+var ErrPreconditionFailed = errors.New("precondition failed")
+
+// Precondition is checked against the stored copy of a key before a conditional write,
+// every field which is set must hold
+type Precondition struct {
+	// NotExists requires the key to be missing or deleted
+	NotExists bool
+
+	// Version requires the key to exist with this version, if non-zero
+	Version uint64
+
+	// Value requires the key to exist with this value, if non-nil
+	Value []byte
+}
+
+// Holds checks the precondition against the stored copy of a key, as returned by Lookup. ok is
+// false if the store has no record of the key. Deleted and expired keys don't exist.
+func (p Precondition) Holds(entry Entry, ok bool) bool {
+	exists := ok && live(entry, time.Now())
+
+	if p.NotExists && exists {
+		return false
+	}
+	if p.Version != 0 && (!exists || entry.Version != p.Version) {
+		return false
+	}
+	if p.Value != nil && (!exists || !bytes.Equal(entry.Value, p.Value)) {
+		return false
+	}
+
+	return true
 }
 
 type keyentry struct {
@@ -21,6 +128,16 @@ type keyentry struct {
 	Value []byte
 	Id    chord.Id
 
+	// Version orders writes to the key, the highest version is the newest
+	Version uint64
+
+	// Deleted marks a tombstone, which is kept so that the delete wins over older copies
+	// of the key until it's garbage collected
+	Deleted bool
+
+	// Expires is when the key stops being served, the zero time means never
+	Expires time.Time
+
 	sync.RWMutex
 }
 
@@ -28,14 +145,31 @@ type KeyStore struct {
 	muKeys sync.RWMutex
 	Keys   map[string]*keyentry
 
-	keyGauge prometheus.Gauge
+	keyGauge       prometheus.Gauge
+	tombstoneGauge prometheus.Gauge
+
+	// journal persists changes to the store, nil for a purely in-memory store
+	journal journal
+
+	// merkle holds the leaves of the Merkle tree over the store, kept up to date by every write
+	merkle *merkleLeaves
 
 	Registry *prometheus.Registry
 }
 
+// Describe and Collect implement prometheus.Collector for the gauges of the store
+func (k *KeyStore) Describe(ch chan<- *prometheus.Desc) {
+	k.Registry.Describe(ch)
+}
+
+func (k *KeyStore) Collect(ch chan<- prometheus.Metric) {
+	k.Registry.Collect(ch)
+}
+
 func CreateKeyStore(id chord.Id) *KeyStore {
 	ks := &KeyStore{
-		Keys: make(map[string]*keyentry),
+		Keys:   make(map[string]*keyentry),
+		merkle: newMerkleLeaves(),
 		keyGauge: prometheus.NewGauge(prometheus.GaugeOpts{
 			Name: "dht_keys_total",
 			Help: "The total number of keys stored in the node",
@@ -43,14 +177,39 @@ func CreateKeyStore(id chord.Id) *KeyStore {
 				"id": fmt.Sprint(id),
 			},
 		}),
+		tombstoneGauge: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "dht_tombstones_total",
+			Help: "The total number of deleted keys awaiting garbage collection",
+			ConstLabels: prometheus.Labels{
+				"id": fmt.Sprint(id),
+			},
+		}),
 	}
 
 	ks.Registry = prometheus.NewRegistry()
 	ks.Registry.MustRegister(ks.keyGauge)
+	ks.Registry.MustRegister(ks.tombstoneGauge)
 
 	return ks
 }
 
+// live returns if the entry holds a value which can be served at the given time
+func (e *keyentry) live(now time.Time) bool {
+	return !e.Deleted && (e.Expires.IsZero() || now.Before(e.Expires))
+}
+
+// export takes a copy of the entry. Requires the entry lock.
+func (e *keyentry) export() Entry {
+	return Entry{
+		Key:     e.Key,
+		Value:   e.Value,
+		Id:      e.Id,
+		Version: e.Version,
+		Deleted: e.Deleted,
+		Expires: e.Expires,
+	}
+}
+
 func createKeyEntry(key string) *keyentry {
 	k := &keyentry{}
 	k.Key = key
@@ -58,71 +217,382 @@ func createKeyEntry(key string) *keyentry {
 	return k
 }
 
+// HasKey returns if the key is stored and hasn't been deleted
 func (k *KeyStore) HasKey(key string) bool {
 	k.muKeys.RLock()
 	defer k.muKeys.RUnlock()
 
-	_, ok := k.Keys[key]
-	return ok
+	return k.hasKey(key)
 }
 
 func (k *KeyStore) SetKey(key string, bytes []byte) error {
+	return k.SetVersionedKey(key, bytes, newVersion())
+}
+
+// SetVersionedKey sets the key with a version chosen by the caller, e.g. the coordinator of a write
+func (k *KeyStore) SetVersionedKey(key string, bytes []byte, version uint64) error {
+	return k.SetExpiringKey(key, bytes, version, time.Time{})
+}
+
+// SetExpiringKey sets a versioned key which is treated as missing after expires, a zero time never expires
+func (k *KeyStore) SetExpiringKey(key string, bytes []byte, version uint64, expires time.Time) error {
 	k.muKeys.Lock()
 
 	defer k.muKeys.Unlock()
 
 	if k.hasKey(key) {
 		slog.Warn("overwriting log entry", "key", key)
-	} else {
-		k.keyGauge.Inc()
-		k.Keys[key] = createKeyEntry(key)
 	}
 
-	entry := k.Keys[key]
+	entry := k.entry(key)
 
 	entry.Lock()
 	defer entry.Unlock()
-	entry.Value = bytes
+	k.write(entry, bytes, version, expires, false)
+
+	promSetKeysTotal.Inc()
+	return nil
+}
+
+// SetVersionedKeyIf sets the key only if the precondition holds, the check and the write happen
+// atomically. Returns ErrPreconditionFailed if the condition doesn't hold.
+func (k *KeyStore) SetVersionedKeyIf(key string, bytes []byte, version uint64, expires time.Time, cond Precondition) error {
+	k.muKeys.Lock()
+	defer k.muKeys.Unlock()
+
+	var stored Entry
+	existing := k.Keys[key]
+	if existing != nil {
+		existing.RLock()
+		stored = existing.export()
+		existing.RUnlock()
+	}
+	ok := cond.Holds(stored, existing != nil)
+
+	if !ok {
+		promFailedPreconditionsTotal.Inc()
+		return ErrPreconditionFailed
+	}
+
+	entry := k.entry(key)
+
+	entry.Lock()
+	defer entry.Unlock()
+	k.write(entry, bytes, version, expires, false)
 
 	promSetKeysTotal.Inc()
 	return nil
 }
 
+// SetKeyIfAbsent sets the key only if the store has no record of it, returning whether it was set
+func (k *KeyStore) SetKeyIfAbsent(key string, bytes []byte, version uint64) bool {
+	k.muKeys.Lock()
+	defer k.muKeys.Unlock()
+
+	if _, ok := k.Keys[key]; ok {
+		return false
+	}
+
+	entry := k.entry(key)
+	k.write(entry, bytes, version, time.Time{}, false)
+
+	promSetKeysTotal.Inc()
+	return true
+}
+
+// Apply stores a value or tombstone received from another node, only if it's newer than what
+// the store already holds. It's used wherever two copies of a key meet, e.g. replication and
+// migration, so that a stale copy can never overwrite a newer one. Returns whether it was applied.
+func (k *KeyStore) Apply(key string, bytes []byte, version uint64, expires time.Time, deleted bool) bool {
+	err := versionClock.Observe(version)
+	if err != nil {
+		fmt.Printf("refusing version %v of %v: %v\n", version, key, err)
+		return false
+	}
+
+	k.muKeys.Lock()
+	defer k.muKeys.Unlock()
+
+	if entry, ok := k.Keys[key]; ok {
+		entry.RLock()
+		newer := NewerThan(version, bytes, entry.Version, entry.Value)
+		entry.RUnlock()
+
+		if !newer {
+			promStaleWritesTotal.Inc()
+			return false
+		}
+	}
+
+	entry := k.entry(key)
+
+	entry.Lock()
+	defer entry.Unlock()
+	k.write(entry, bytes, version, expires, deleted)
+
+	return true
+}
+
+// write replaces the contents of an entry. Requires both the store and entry locks.
+func (k *KeyStore) write(entry *keyentry, bytes []byte, version uint64, expires time.Time, deleted bool) {
+	k.setDeleted(entry, deleted)
+	entry.Value = bytes
+	entry.Version = version
+	entry.Expires = expires
+	k.merkle.set(entry.export())
+
+	if k.journal != nil {
+		k.journal.record(entry)
+	}
+}
+
+// restore loads an entry read back from disk, replacing whatever is stored
+func (k *KeyStore) restore(key string, bytes []byte, version uint64, expires time.Time, deleted bool) {
+	versionClock.advance(version)
+
+	k.muKeys.Lock()
+	defer k.muKeys.Unlock()
+
+	entry := k.entry(key)
+
+	entry.Lock()
+	defer entry.Unlock()
+	k.write(entry, bytes, version, expires, deleted)
+}
+
+// removed drops an entry from the store and tells the journal. Requires the store lock.
+func (k *KeyStore) removed(key string, entry *keyentry) {
+	delete(k.Keys, key)
+	k.merkle.remove(key, entry.Id)
+	if entry.Deleted {
+		k.tombstoneGauge.Dec()
+	} else {
+		k.keyGauge.Dec()
+	}
+
+	if k.journal != nil {
+		k.journal.remove(key)
+	}
+}
+
+// expiryVersion is the version of the tombstone left by a key with the given version once it
+// expires. It's worked out from the expiry time alone, so every replica expiring its copy
+// leaves the same tombstone.
+func expiryVersion(version uint64, expires time.Time) uint64 {
+	return max(version+1, uint64(expires.UnixMilli())<<LOGICAL_BITS)
+}
+
+// NewerThan orders two versions of a key, returning if the first is newer. Every Store must
+// order copies by it so that replicas agree on the winner. Versions only tie if two
+// coordinators wrote in the same instant, so the value bytes break the tie.
+func NewerThan(version uint64, value []byte, existingVersion uint64, existingValue []byte) bool {
+	if version != existingVersion {
+		return version > existingVersion
+	}
+
+	return bytes.Compare(value, existingValue) > 0
+}
+
+// DeleteVersionedKey replaces the key with a tombstone, which is stored even if the key
+// isn't, so that the delete can't be undone by an older copy arriving later
+func (k *KeyStore) DeleteVersionedKey(key string, version uint64) error {
+	k.muKeys.Lock()
+	defer k.muKeys.Unlock()
+
+	entry := k.entry(key)
+
+	entry.Lock()
+	defer entry.Unlock()
+	k.write(entry, nil, version, time.Time{}, true)
+
+	promDeleteKeysTotal.Inc()
+	return nil
+}
+
+// entry returns the entry for a key, creating a live one if there isn't one. Not thread safe.
+func (k *KeyStore) entry(key string) *keyentry {
+	if entry, ok := k.Keys[key]; ok {
+		return entry
+	}
+
+	entry := createKeyEntry(key)
+	k.Keys[key] = entry
+	k.keyGauge.Inc()
+	return entry
+}
+
+// setDeleted moves an entry between live and tombstone, keeping the gauges in step.
+// Requires both the store and entry locks.
+func (k *KeyStore) setDeleted(entry *keyentry, deleted bool) {
+	if entry.Deleted == deleted {
+		return
+	}
+
+	entry.Deleted = deleted
+	if deleted {
+		k.keyGauge.Dec()
+		k.tombstoneGauge.Inc()
+	} else {
+		k.tombstoneGauge.Dec()
+		k.keyGauge.Inc()
+	}
+}
+
 // hasKey is the non-threadsafe version of HasKey for internal use only
 func (k *KeyStore) hasKey(key string) bool {
-	_, ok := k.Keys[key]
-	return ok
+	entry, ok := k.Keys[key]
+	if !ok {
+		return false
+	}
+
+	entry.RLock()
+	defer entry.RUnlock()
+	return entry.live(time.Now())
 }
 
 func (k *KeyStore) GetKey(key string) ([]byte, error) {
+	value, _, err := k.GetVersionedKey(key)
+	return value, err
+}
+
+// GetVersionedKey returns the value of the key along with its version
+func (k *KeyStore) GetVersionedKey(key string) ([]byte, uint64, error) {
+	entry, ok := k.Lookup(key)
+	if !ok || entry.Deleted {
+		return nil, 0, fmt.Errorf("key %v not found", key)
+	}
+
+	return entry.Value, entry.Version, nil
+}
+
+// Lookup returns whatever the store holds for the key, including tombstones. Expired keys are
+// reported as deleted. ok is false if there is no record of the key at all.
+func (k *KeyStore) Lookup(key string) (Entry, bool) {
 	k.muKeys.RLock()
 	defer k.muKeys.RUnlock()
 
-	if !k.hasKey(key) {
-		return nil, fmt.Errorf("key %v not found", key)
+	entry, ok := k.Keys[key]
+	if !ok {
+		return Entry{}, false
 	}
-	entry := k.Keys[key]
 	entry.Lock()
 	defer entry.Unlock()
 
 	promGetKeysTotal.Inc()
-	return entry.Value, nil
+	res := entry.export()
+	if !entry.live(time.Now()) {
+		res.Value = nil
+		res.Deleted = true
+	}
+
+	return res, true
+}
+
+// merkleTree returns the Merkle tree over the entries within r from the leaves kept by the
+// store, without a scan
+func (k *KeyStore) merkleTree(r chord.KeyRange) *merkleTree {
+	return k.merkle.tree(r)
 }
 
+// Len returns the number of entries stored, including tombstones
+func (k *KeyStore) Len() int {
+	k.muKeys.RLock()
+	defer k.muKeys.RUnlock()
+
+	return len(k.Keys)
+}
+
+// Range calls fn for every entry within r, holding the store lock throughout
+func (k *KeyStore) Range(r chord.KeyRange, fn func(Entry) bool) {
+	k.muKeys.RLock()
+	defer k.muKeys.RUnlock()
+
+	for _, v := range k.Keys {
+		if !r.Contains(v.Id) {
+			continue
+		}
+
+		v.RLock()
+		entry := v.export()
+		v.RUnlock()
+
+		if !fn(entry) {
+			return
+		}
+	}
+}
+
+// entriesInRange collects the entries of a store within r, so that the store can be changed
+// while they are processed
+func entriesInRange(store Store, r chord.KeyRange) []Entry {
+	var entries []Entry
+	store.Range(r, func(e Entry) bool {
+		entries = append(entries, e)
+		return true
+	})
+
+	return entries
+}
+
+// DeleteKey removes every trace of the key from the store, tombstone or not. It's used to
+// drop copies which have moved to another node, DeleteVersionedKey is used to delete a key.
 func (k *KeyStore) DeleteKey(key string) error {
 	k.muKeys.Lock()
 	defer k.muKeys.Unlock()
 
-	if !k.hasKey(key) {
+	entry, ok := k.Keys[key]
+	if !ok {
 		return fmt.Errorf("could not delete key %v: not found", key)
 	}
 
-	entry := k.Keys[key]
 	entry.Lock()
 	defer entry.Unlock()
-	delete(k.Keys, key)
+	k.removed(key, entry)
 
-	k.keyGauge.Dec()
-	promDeleteKeysTotal.Inc()
 	return nil
 }
+
+// Close releases any resources held by the store, there are none for an in-memory store
+func (k *KeyStore) Close() error {
+	return nil
+}
+
+// PurgeTombstones drops tombstones for deletes made before the cutoff, returning how many
+func (k *KeyStore) PurgeTombstones(cutoff time.Time) int {
+	k.muKeys.Lock()
+	defer k.muKeys.Unlock()
+
+	purged := 0
+	for key, entry := range k.Keys {
+		entry.Lock()
+		if entry.Deleted && versionTime(entry.Version).Before(cutoff) {
+			k.removed(key, entry)
+			purged++
+		}
+		entry.Unlock()
+	}
+
+	promTombstonesPurgedTotal.Add(float64(purged))
+	return purged
+}
+
+// PurgeExpired replaces keys whose TTL has passed with tombstones, returning how many. Like any
+// other tombstone they stop an older copy bringing the key back, and are dropped once the
+// tombstone grace has passed since the key expired.
+func (k *KeyStore) PurgeExpired(now time.Time) int {
+	k.muKeys.Lock()
+	defer k.muKeys.Unlock()
+
+	purged := 0
+	for _, entry := range k.Keys {
+		entry.Lock()
+		if !entry.Deleted && !entry.Expires.IsZero() && !now.Before(entry.Expires) {
+			k.write(entry, nil, expiryVersion(entry.Version, entry.Expires), time.Time{}, true)
+			purged++
+		}
+		entry.Unlock()
+	}
+
+	promExpiredKeysTotal.Add(float64(purged))
+	return purged
+}
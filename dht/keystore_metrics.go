@@ -19,3 +19,58 @@ var promDeleteKeysTotal = promauto.NewGauge(prometheus.GaugeOpts{
 	Name: "dht_delete_keys_total",
 	Help: "Count of GetKey operations",
 })
+
+var promTombstonesPurgedTotal = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "dht_tombstones_purged_total",
+	Help: "Count of tombstones garbage collected after the grace period",
+})
+
+var promStaleWritesTotal = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "dht_stale_writes_total",
+	Help: "Count of replicated or migrated copies discarded for being older than the stored version",
+})
+
+var promFailedPreconditionsTotal = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "dht_failed_preconditions_total",
+	Help: "Count of conditional writes rejected because their precondition didn't hold",
+})
+
+var promExpiredKeysTotal = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "dht_expired_keys_total",
+	Help: "Count of keys removed by the reaper after their TTL passed",
+})
+
+var promCompactionsTotal = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "dht_log_compactions_total",
+	Help: "Count of times the on-disk log has been compacted into a snapshot",
+})
+
+var promAntiEntropyRepairsTotal = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "dht_anti_entropy_repairs_total",
+	Help: "Count of Merkle tree buckets found to differ from a replica and repaired",
+})
+
+var promHintsDeliveredTotal = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "dht_hints_delivered_total",
+	Help: "Count of hinted writes delivered to their owner",
+})
+
+var promHintsDroppedTotal = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "dht_hints_dropped_total",
+	Help: "Count of hinted writes dropped because the queue for their owner was full",
+})
+
+var promQuotaRejectionsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "dht_quota_rejections_total",
+	Help: "Count of writes rejected because their namespace was at its quota",
+}, []string{"namespace"})
+
+var promWatches = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: "dht_watches",
+	Help: "The number of open WatchKey and WatchPrefix streams",
+})
+
+var promReadRepairsTotal = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "dht_read_repairs_total",
+	Help: "Count of stale copies of a key updated after a read found a newer version",
+})
@@ -1,7 +1,9 @@
 package dht
 
 import (
+	"chord_dht/chord"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -26,3 +28,229 @@ func TestKeyStoreReturnsCorrectKey(t *testing.T) {
 	assert.Nil(t, err, "expected nil err")
 	assert.Equal(t, []byte("Hello, World!"), value)
 }
+
+func TestKeyStoreEntriesInRange(t *testing.T) {
+	k := CreateKeyStore(0)
+	keys := []string{"a", "b", "c", "d", "e"}
+	for _, key := range keys {
+		k.SetKey(key, []byte(key))
+	}
+
+	id := ChordIdFromString("c")
+	entries := entriesInRange(k, chord.KeyRange{Start: id - 1, End: id})
+
+	assert.Len(t, entries, 1)
+	assert.Equal(t, "c", entries[0].Key)
+
+	all := entriesInRange(k, chord.KeyRange{Start: id, End: id})
+	assert.Len(t, all, len(keys))
+
+	visited := 0
+	k.Range(chord.KeyRange{Start: id, End: id}, func(Entry) bool {
+		visited++
+		return visited < 2
+	})
+	assert.Equal(t, 2, visited, "returning false should stop the iteration")
+}
+
+func TestKeyStoreSetKeyIfAbsent(t *testing.T) {
+	k := CreateKeyStore(0)
+
+	assert.True(t, k.SetKeyIfAbsent("test", []byte("first"), 1))
+	assert.False(t, k.SetKeyIfAbsent("test", []byte("second"), 2))
+
+	value, err := k.GetKey("test")
+	assert.Nil(t, err, "expected nil err")
+	assert.Equal(t, []byte("first"), value)
+}
+
+func TestKeyStoreReturnsVersion(t *testing.T) {
+	k := CreateKeyStore(0)
+
+	err := k.SetVersionedKey("test", []byte("Hello, World!"), 42)
+	assert.Nil(t, err, "expected nil err")
+
+	value, version, err := k.GetVersionedKey("test")
+	assert.Nil(t, err, "expected nil err")
+	assert.Equal(t, []byte("Hello, World!"), value)
+	assert.Equal(t, uint64(42), version)
+}
+
+func TestKeyStoreDeleteLeavesTombstone(t *testing.T) {
+	k := CreateKeyStore(0)
+	k.SetVersionedKey("test", []byte("test"), 1)
+
+	err := k.DeleteVersionedKey("test", 2)
+	assert.Nil(t, err, "expected nil err")
+
+	assert.False(t, k.HasKey("test"))
+	_, err = k.GetKey("test")
+	assert.NotNil(t, err, "deleted keys should not be returned")
+
+	entry, ok := k.Lookup("test")
+	assert.True(t, ok)
+	assert.True(t, entry.Deleted)
+	assert.Equal(t, uint64(2), entry.Version)
+}
+
+func TestKeyStorePurgeTombstones(t *testing.T) {
+	k := CreateKeyStore(0)
+	k.DeleteVersionedKey("old", uint64(time.Now().Add(-2*time.Hour).UnixMilli())<<LOGICAL_BITS)
+	k.DeleteVersionedKey("new", newVersion())
+	k.SetKey("live", []byte("live"))
+
+	purged := k.PurgeTombstones(time.Now().Add(-time.Hour))
+
+	assert.Equal(t, 1, purged)
+	_, ok := k.Lookup("old")
+	assert.False(t, ok, "expired tombstone should be purged")
+	_, ok = k.Lookup("new")
+	assert.True(t, ok, "recent tombstone should be kept")
+	assert.True(t, k.HasKey("live"))
+}
+
+func TestKeyStoreApplyKeepsNewerVersion(t *testing.T) {
+	k := CreateKeyStore(0)
+	k.SetVersionedKey("test", []byte("new"), 2)
+
+	assert.False(t, k.Apply("test", []byte("old"), 1, time.Time{}, false), "an older copy should be discarded")
+	assert.False(t, k.Apply("test", nil, 1, time.Time{}, true), "an older delete should be discarded")
+
+	value, _ := k.GetKey("test")
+	assert.Equal(t, []byte("new"), value)
+
+	assert.True(t, k.Apply("test", nil, 3, time.Time{}, true), "a newer delete should be applied")
+	assert.False(t, k.HasKey("test"))
+}
+
+func TestKeyStoreApplyRefusesFutureVersions(t *testing.T) {
+	k := CreateKeyStore(0)
+	k.SetVersionedKey("test", []byte("current"), 2)
+
+	assert.False(t, k.Apply("test", []byte("poison"), ^uint64(0), time.Time{}, false), "a version beyond the max clock offset should be refused")
+
+	value, _ := k.GetKey("test")
+	assert.Equal(t, []byte("current"), value)
+}
+
+func TestKeyStoreApplyBreaksTiesByValue(t *testing.T) {
+	a := CreateKeyStore(0)
+	b := CreateKeyStore(0)
+
+	a.Apply("test", []byte("x"), 1, time.Time{}, false)
+	a.Apply("test", []byte("y"), 1, time.Time{}, false)
+	b.Apply("test", []byte("y"), 1, time.Time{}, false)
+	b.Apply("test", []byte("x"), 1, time.Time{}, false)
+
+	valueA, _ := a.GetKey("test")
+	valueB, _ := b.GetKey("test")
+	assert.Equal(t, valueA, valueB, "replicas should agree regardless of arrival order")
+}
+
+func TestKeyStoreSetIfNotExists(t *testing.T) {
+	k := CreateKeyStore(0)
+	cond := Precondition{NotExists: true}
+
+	assert.Nil(t, k.SetVersionedKeyIf("test", []byte("first"), 1, time.Time{}, cond))
+	assert.Equal(t, ErrPreconditionFailed, k.SetVersionedKeyIf("test", []byte("second"), 2, time.Time{}, cond))
+
+	// A deleted key no longer exists
+	k.DeleteVersionedKey("test", 3)
+	assert.Nil(t, k.SetVersionedKeyIf("test", []byte("third"), 4, time.Time{}, cond))
+}
+
+func TestKeyStoreSetIfVersionMatches(t *testing.T) {
+	k := CreateKeyStore(0)
+	k.SetVersionedKey("counter", []byte("1"), 10)
+
+	assert.Equal(t, ErrPreconditionFailed, k.SetVersionedKeyIf("counter", []byte("2"), 11, time.Time{}, Precondition{Version: 9}))
+	assert.Nil(t, k.SetVersionedKeyIf("counter", []byte("2"), 11, time.Time{}, Precondition{Version: 10}))
+
+	value, version, _ := k.GetVersionedKey("counter")
+	assert.Equal(t, []byte("2"), value)
+	assert.Equal(t, uint64(11), version)
+}
+
+func TestKeyStoreSetIfValueEquals(t *testing.T) {
+	k := CreateKeyStore(0)
+
+	assert.Equal(t, ErrPreconditionFailed, k.SetVersionedKeyIf("leader", []byte("b"), 1, time.Time{}, Precondition{Value: []byte("a")}), "a missing key has no value to match")
+
+	k.SetVersionedKey("leader", []byte("a"), 1)
+	assert.Equal(t, ErrPreconditionFailed, k.SetVersionedKeyIf("leader", []byte("c"), 2, time.Time{}, Precondition{Value: []byte("b")}))
+	assert.Nil(t, k.SetVersionedKeyIf("leader", []byte("c"), 2, time.Time{}, Precondition{Value: []byte("a")}))
+}
+
+func TestKeyStoreExpiredKeyIsMissing(t *testing.T) {
+	k := CreateKeyStore(0)
+	k.SetExpiringKey("session", []byte("abc"), 1, time.Now().Add(-time.Second))
+	k.SetExpiringKey("token", []byte("def"), 1, time.Now().Add(time.Hour))
+
+	assert.False(t, k.HasKey("session"))
+	_, err := k.GetKey("session")
+	assert.NotNil(t, err)
+
+	entry, ok := k.Lookup("session")
+	assert.True(t, ok)
+	assert.True(t, entry.Deleted, "an expired key should look deleted")
+
+	assert.True(t, k.HasKey("token"))
+}
+
+func TestKeyStoreSetIfNotExistsAfterExpiry(t *testing.T) {
+	k := CreateKeyStore(0)
+	k.SetExpiringKey("lock", []byte("a"), 1, time.Now().Add(-time.Second))
+
+	assert.Nil(t, k.SetVersionedKeyIf("lock", []byte("b"), 2, time.Time{}, Precondition{NotExists: true}))
+}
+
+func TestKeyStorePurgeExpired(t *testing.T) {
+	k := CreateKeyStore(0)
+	now := time.Now()
+	k.SetExpiringKey("expired", []byte("a"), 1, now.Add(-time.Second))
+	k.SetExpiringKey("expiring", []byte("b"), 1, now.Add(time.Hour))
+	k.SetKey("forever", []byte("c"))
+
+	assert.Equal(t, 1, k.PurgeExpired(now))
+	assert.Equal(t, 0, k.PurgeExpired(now), "a tombstone doesn't expire again")
+
+	// The expired key is left as a tombstone, versioned by its expiry time
+	entry, ok := k.Lookup("expired")
+	assert.True(t, ok)
+	assert.True(t, entry.Deleted)
+	assert.Equal(t, now.Add(-time.Second).UnixMilli(), versionTime(entry.Version).UnixMilli())
+	assert.False(t, k.Apply("expired", []byte("a"), 1, time.Time{}, false), "the expired copy can't come back")
+
+	assert.Equal(t, 1, k.PurgeExpired(now.Add(2*time.Hour)))
+	assert.True(t, k.HasKey("forever"))
+	assert.Equal(t, 3, k.Len())
+
+	// The tombstones are dropped after the grace, counted from when the keys expired
+	assert.Equal(t, 1, k.PurgeTombstones(now))
+	assert.Equal(t, 1, k.PurgeTombstones(now.Add(3*time.Hour)))
+}
+
+func TestKeyStoreApplyKeepsExpiry(t *testing.T) {
+	k := CreateKeyStore(0)
+	expires := time.Now().Add(time.Minute)
+	k.Apply("test", []byte("value"), 1, expires, false)
+
+	assert.Equal(t, expires, k.Keys["test"].Expires)
+	assert.Equal(t, expires.UnixMilli(), serializeEntry(k.Keys["test"].export()).Expires)
+}
+
+func TestPreconditionHolds(t *testing.T) {
+	live := Entry{Key: "test", Value: []byte("a"), Version: 5}
+	deleted := Entry{Key: "test", Version: 6, Deleted: true}
+	expired := Entry{Key: "test", Value: []byte("a"), Version: 5, Expires: time.Now().Add(-time.Second)}
+
+	assert.True(t, Precondition{NotExists: true}.Holds(Entry{}, false))
+	assert.True(t, Precondition{NotExists: true}.Holds(deleted, true))
+	assert.True(t, Precondition{NotExists: true}.Holds(expired, true))
+	assert.False(t, Precondition{NotExists: true}.Holds(live, true))
+
+	assert.True(t, Precondition{Version: 5, Value: []byte("a")}.Holds(live, true))
+	assert.False(t, Precondition{Version: 4}.Holds(live, true))
+	assert.False(t, Precondition{Value: []byte("b")}.Holds(live, true))
+	assert.False(t, Precondition{Version: 5}.Holds(expired, true))
+}
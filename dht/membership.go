@@ -0,0 +1,128 @@
+package dht
+
+import (
+	"chord_dht/chord"
+	"context"
+	"net"
+	"strconv"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// Replicas and transfers are applied as they're given, with the version chosen by their owner
+// and without the ownership, namespace, quota or precondition checks made on a client's write,
+// so they're only accepted from nodes of the ring. A node sends its identifier along with these
+// requests, and it's accepted if a node with that identifier is in the ring at the host the
+// request came from.
+
+// RING_SENDER_HEADER is the metadata key a node sends its identifier under
+const RING_SENDER_HEADER = "chord-sender"
+
+// The time a node found in the ring is trusted for before it's looked up again
+const RING_MEMBER_TTL = time.Minute
+
+// ringMember is a node found in the ring by a lookup
+type ringMember struct {
+	address string // the DHT server of the node
+	checked time.Time
+}
+
+// senderContext returns ctx carrying the identifier of the node sending a request
+func senderContext(ctx context.Context, sender chord.Id) context.Context {
+	return metadata.AppendToOutgoingContext(ctx, RING_SENDER_HEADER, strconv.FormatInt(int64(sender), 10))
+}
+
+// fromRingMember returns a PermissionDenied error unless the request was sent by a node of the
+// ring. Requests made within this node don't come from a peer, and are always accepted.
+func (s *Server) fromRingMember(ctx context.Context) error {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return nil
+	}
+
+	denied := status.Error(codes.PermissionDenied, "replicas and transfers are only accepted from nodes of the ring")
+	values := metadata.ValueFromIncomingContext(ctx, RING_SENDER_HEADER)
+	if len(values) != 1 {
+		return denied
+	}
+	id, err := strconv.ParseInt(values[0], 10, 64)
+	if err != nil {
+		return denied
+	}
+
+	address, ok := s.ringAddress(chord.Id(id))
+	if !ok || !sameHost(p.Addr, address) {
+		return denied
+	}
+
+	return nil
+}
+
+// ringAddress returns the DHT address of the node with the given identifier, if it's in the
+// ring. The predecessor and successors are known already, other nodes, such as the owners of
+// the keys replicated here, are looked up and remembered for RING_MEMBER_TTL.
+func (s *Server) ringAddress(id chord.Id) (string, bool) {
+	if pred, err := s.node.Predecessor(); err == nil && pred.Identifier() == id {
+		return dhtAddress(chord.PeerOf(pred)), true
+	}
+
+	succs, _ := s.node.SuccessorList()
+	for _, p := range succs.Peers() {
+		if p.Id == id {
+			return dhtAddress(p), true
+		}
+	}
+
+	s.muMembers.Lock()
+	member, ok := s.members[id]
+	s.muMembers.Unlock()
+	if ok && time.Since(member.checked) < RING_MEMBER_TTL {
+		return member.address, true
+	}
+
+	node, _, err := s.node.FindSuccessor(id, 0)
+	if err != nil || node.Identifier() != id {
+		return "", false
+	}
+
+	address := dhtAddress(chord.PeerOf(node))
+	s.muMembers.Lock()
+	if s.members == nil {
+		s.members = make(map[chord.Id]ringMember)
+	}
+	s.members[id] = ringMember{address: address, checked: time.Now()}
+	s.muMembers.Unlock()
+
+	return address, true
+}
+
+// sameHost returns if a request from addr could have come from the node serving at address.
+// Nodes may advertise a hostname, which is resolved, and loopback addresses all match.
+func sameHost(addr net.Addr, address string) bool {
+	tcp, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+
+	host := stripPort(address)
+	ips := []net.IP{net.ParseIP(host)}
+	if ips[0] == nil {
+		var err error
+		ips, err = net.LookupIP(host)
+		if err != nil {
+			return false
+		}
+	}
+
+	for _, ip := range ips {
+		if ip.Equal(tcp.IP) || (ip.IsLoopback() && tcp.IP.IsLoopback()) {
+			return true
+		}
+	}
+
+	return false
+}
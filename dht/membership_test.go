@@ -0,0 +1,53 @@
+package dht
+
+import (
+	"chord_dht/chord"
+	dht_proto "chord_dht/protos/dht"
+	"context"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestReplicasOnlyFromRingMembers(t *testing.T) {
+	s := testServer()
+	address := serveDHT(t, s)
+	entry := &dht_proto.Entry{Key: "test", Value: []byte("value"), Version: newVersion()}
+
+	// A client can't send replicas or transfers, with or without claiming to be a node
+	client, err := getClient(address)
+	assert.Nil(t, err)
+	_, err = client.SetKey(context.Background(), &dht_proto.SetKeyRequest{
+		Key:     entry.Key,
+		Value:   entry.Value,
+		Replica: true,
+		Version: entry.Version,
+	})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+	err = SetKey(address, "test", []byte("value"), true)
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+	err = replicateKey(address, 2, entry)
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+	_, err = TransferRange(address, 2, []Entry{parseEntry(entry)}, false)
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+	assert.False(t, s.keystore.HasKey("test"))
+
+	// The predecessor is accepted, from the host it's at
+	s.node.Rectify(&chord.RPCNode{Id: 2, Address: "127.0.0.1:1"})
+	assert.Nil(t, replicateKey(address, 2, entry))
+	assert.True(t, s.keystore.HasKey("test"))
+
+	s.node.Rectify(&chord.RPCNode{Id: 3, Address: "192.0.2.1:1"})
+	err = replicateKey(address, 3, entry)
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+}
+
+func TestSameHost(t *testing.T) {
+	addr := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 40000}
+	assert.True(t, sameHost(addr, "192.0.2.1:8081"))
+	assert.False(t, sameHost(addr, "192.0.2.2:8081"))
+	assert.True(t, sameHost(&net.TCPAddr{IP: net.ParseIP("127.0.0.1")}, "[::1]:8081"))
+}
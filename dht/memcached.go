@@ -0,0 +1,499 @@
+package dht
+
+import (
+	"bufio"
+	dht_proto "chord_dht/protos/dht"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// Legacy memcached clients can use the DHT through the memcached text protocol. The storage
+// commands set, add, replace and cas, retrieval with get and gets, delete and touch are served,
+// every key in the default namespace and forwarded to its owner. The CAS value of a key is its
+// version, and the exptime of an item is its TTL. A key stored with flags is wrapped in a
+// CacheItem, otherwise it's stored as the plain value so other clients can read it too.
+
+// CACHE_ITEM_FORMAT marks the value of a key as a cache item holding flags
+const CACHE_ITEM_FORMAT = "chord-memcached/v1"
+
+// The longest key memcached accepts
+const MEMCACHED_MAX_KEY = 250
+
+// The largest value accepted from a client, as for the HTTP gateway
+const MEMCACHED_MAX_VALUE = GATEWAY_MAX_VALUE
+
+// Exptimes up to 30 days are relative to now, anything larger is a Unix timestamp
+const MEMCACHED_MAX_RELATIVE_EXPTIME = 30 * 24 * 60 * 60
+
+// The version reported to clients
+const MEMCACHED_VERSION = "1.6.0-chord"
+
+// encodeCacheItem returns the value stored for an item
+func encodeCacheItem(flags uint32, data []byte) []byte {
+	if flags == 0 {
+		return data
+	}
+
+	value, _ := proto.Marshal(&dht_proto.CacheItem{
+		Format: CACHE_ITEM_FORMAT,
+		Flags:  flags,
+		Data:   data,
+	})
+	return value
+}
+
+// decodeCacheItem returns the flags and data of a stored value, a value which isn't a cache
+// item has no flags
+func decodeCacheItem(value []byte) (uint32, []byte) {
+	item := &dht_proto.CacheItem{}
+	err := proto.Unmarshal(value, item)
+	if err != nil || item.Format != CACHE_ITEM_FORMAT {
+		return 0, value
+	}
+
+	return item.Flags, item.Data
+}
+
+// memcachedTTL converts an exptime to a TTL in seconds, zero never expires. expired is set if
+// the item has expired already, memcached treats a negative exptime or a timestamp in the
+// past as expiring immediately.
+func memcachedTTL(exptime int64, now time.Time) (ttl int64, expired bool) {
+	switch {
+	case exptime == 0:
+		return 0, false
+	case exptime < 0:
+		return 0, true
+	case exptime <= MEMCACHED_MAX_RELATIVE_EXPTIME:
+		return exptime, false
+	}
+
+	ttl = exptime - now.Unix()
+	if ttl <= 0 {
+		return 0, true
+	}
+
+	return ttl, false
+}
+
+// validMemcachedKey returns if a key can be used over the protocol
+func validMemcachedKey(key string) bool {
+	if len(key) == 0 || len(key) > MEMCACHED_MAX_KEY {
+		return false
+	}
+
+	for _, c := range []byte(key) {
+		if c <= ' ' || c == 0x7f {
+			return false
+		}
+	}
+
+	return true
+}
+
+// ServeMemcached serves memcached clients connecting to lis until the server is stopped
+func (s *Server) ServeMemcached(lis net.Listener) error {
+	log.Printf("memcached server listening at %v", lis.Addr())
+
+	go func() {
+		<-s.shutdown
+		lis.Close()
+	}()
+
+	for {
+		conn, err := lis.Accept()
+		if err != nil {
+			select {
+			case <-s.shutdown:
+				return nil
+			default:
+				return err
+			}
+		}
+
+		go s.serveMemcachedConn(conn)
+	}
+}
+
+// memcachedWriter writes memcached replies, dropping the reply to a command sent with noreply
+type memcachedWriter struct {
+	*bufio.Writer
+	noreply bool
+}
+
+// reply writes a line, unless the command asked for no reply
+func (w *memcachedWriter) reply(line string) {
+	if !w.noreply {
+		w.WriteString(line + "\r\n")
+	}
+}
+
+// clientError writes an error caused by the client, which is sent even with noreply
+func (w *memcachedWriter) clientError(msg string) {
+	w.WriteString("CLIENT_ERROR " + msg + "\r\n")
+}
+
+// writeStatus writes the error reply for a failed request
+func (w *memcachedWriter) writeStatus(err error) {
+	msg := strings.NewReplacer("\r", " ", "\n", " ").Replace(status.Convert(err).Message())
+	if status.Code(err) == codes.InvalidArgument {
+		w.clientError(msg)
+		return
+	}
+
+	w.WriteString("SERVER_ERROR " + msg + "\r\n")
+}
+
+func (s *Server) serveMemcachedConn(conn net.Conn) {
+	defer conn.Close()
+
+	// Large enough for a get of many keys of the longest length
+	r := bufio.NewReaderSize(conn, 64<<10)
+	w := &memcachedWriter{Writer: bufio.NewWriter(conn)}
+
+	for {
+		line, err := readTextLine(r)
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			w.clientError(err.Error())
+			w.Flush()
+			return
+		}
+
+		fields := strings.Fields(string(line))
+		w.noreply = len(fields) > 1 && acceptsNoreply(fields[0]) && fields[len(fields)-1] == "noreply"
+		if w.noreply {
+			fields = fields[:len(fields)-1]
+		}
+
+		quit, err := s.memcachedCommand(w, r, fields)
+		if err != nil {
+			// The data block of a storage command couldn't be read, the stream is out of step
+			w.clientError(err.Error())
+			w.Flush()
+			return
+		}
+
+		if r.Buffered() == 0 || quit {
+			if w.Flush() != nil || quit {
+				return
+			}
+		}
+	}
+}
+
+// acceptsNoreply returns if a command may end with noreply. Retrievals always reply, so for them
+// it's just another key.
+func acceptsNoreply(command string) bool {
+	switch command {
+	case "set", "add", "replace", "cas", "delete", "touch":
+		return true
+	}
+
+	return false
+}
+
+// memcachedCommand runs a command, returning if the connection should close. An error is
+// returned if the connection can't be used any further.
+func (s *Server) memcachedCommand(w *memcachedWriter, r *bufio.Reader, fields []string) (bool, error) {
+	if len(fields) == 0 {
+		w.WriteString("ERROR\r\n")
+		return false, nil
+	}
+
+	switch fields[0] {
+	case "get", "gets":
+		s.memcachedGet(w, fields[1:], fields[0] == "gets")
+
+	case "set", "add", "replace", "cas":
+		return false, s.memcachedStore(w, r, fields[0], fields[1:])
+
+	case "delete":
+		s.memcachedDelete(w, fields[1:])
+
+	case "touch":
+		s.memcachedTouch(w, fields[1:])
+
+	case "version":
+		w.WriteString("VERSION " + MEMCACHED_VERSION + "\r\n")
+
+	case "quit":
+		return true, nil
+
+	default:
+		w.WriteString("ERROR\r\n")
+	}
+
+	return false, nil
+}
+
+// memcachedGet serves get and gets, replying with the items which exist
+func (s *Server) memcachedGet(w *memcachedWriter, keys []string, cas bool) {
+	if len(keys) == 0 {
+		w.WriteString("ERROR\r\n")
+		return
+	}
+	for _, key := range keys {
+		if !validMemcachedKey(key) {
+			w.clientError("bad command line format")
+			return
+		}
+	}
+
+	res, err := s.BatchGet(context.Background(), &dht_proto.BatchGetRequest{Keys: keys})
+	if err != nil {
+		w.writeStatus(err)
+		return
+	}
+
+	for _, result := range res.Results {
+		code := codes.Code(result.Code)
+		if code == codes.NotFound {
+			continue
+		}
+		if code != codes.OK {
+			w.writeStatus(status.Errorf(code, "error reading %v: %v", result.Key, result.Error))
+			return
+		}
+	}
+
+	for _, result := range res.Results {
+		if codes.Code(result.Code) != codes.OK {
+			continue
+		}
+
+		flags, data := decodeCacheItem(result.Value)
+		if cas {
+			fmt.Fprintf(w, "VALUE %v %v %v %v\r\n", result.Key, flags, len(data), result.Version)
+		} else {
+			fmt.Fprintf(w, "VALUE %v %v %v\r\n", result.Key, flags, len(data))
+		}
+		w.Write(data)
+		w.WriteString("\r\n")
+	}
+	w.WriteString("END\r\n")
+}
+
+// readDataBlock reads the data block following a storage command, a block which is too large
+// is skipped so the connection stays in step
+func readDataBlock(r *bufio.Reader, size int) ([]byte, bool, error) {
+	if size > MEMCACHED_MAX_VALUE {
+		_, err := io.CopyN(io.Discard, r, int64(size)+2)
+		return nil, false, err
+	}
+
+	data := make([]byte, size+2)
+	_, err := io.ReadFull(r, data)
+	if err != nil {
+		return nil, false, err
+	}
+	if data[size] != '\r' || data[size+1] != '\n' {
+		return nil, false, fmt.Errorf("bad data chunk")
+	}
+
+	return data[:size], true, nil
+}
+
+// memcachedStore serves the storage commands:
+//
+//	set|add|replace <key> <flags> <exptime> <bytes> [noreply]
+//	cas <key> <flags> <exptime> <bytes> <cas unique> [noreply]
+func (s *Server) memcachedStore(w *memcachedWriter, r *bufio.Reader, command string, args []string) error {
+	arity := 4
+	if command == "cas" {
+		arity = 5
+	}
+	if len(args) != arity {
+		w.WriteString("ERROR\r\n")
+		return nil
+	}
+
+	flags, errFlags := strconv.ParseUint(args[1], 10, 32)
+	exptime, errExptime := strconv.ParseInt(args[2], 10, 64)
+	size, errSize := strconv.Atoi(args[3])
+	if errSize != nil || size < 0 {
+		// Without the size the data block can't be skipped
+		return fmt.Errorf("bad data chunk")
+	}
+
+	data, ok, err := readDataBlock(r, size)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		w.WriteString("SERVER_ERROR object too large for cache\r\n")
+		return nil
+	}
+
+	var cas uint64
+	var errCas error
+	if command == "cas" {
+		cas, errCas = strconv.ParseUint(args[4], 10, 64)
+	}
+	if !validMemcachedKey(args[0]) || errFlags != nil || errExptime != nil || errCas != nil {
+		w.clientError("bad command line format")
+		return nil
+	}
+
+	ttl, expired := memcachedTTL(exptime, time.Now())
+	req := &dht_proto.SetKeyRequest{
+		Key:        args[0],
+		Value:      encodeCacheItem(uint32(flags), data),
+		TtlSeconds: ttl,
+		Proxy:      true,
+	}
+
+	switch command {
+	case "set":
+		_, err = s.SetKey(context.Background(), req)
+
+	case "add":
+		req.Precondition = &dht_proto.Precondition{
+			Condition: &dht_proto.Precondition_IfNotExists{IfNotExists: true},
+		}
+		_, err = s.SetKey(context.Background(), req)
+
+	case "replace":
+		_, err = s.replaceKey(req, nil)
+
+	case "cas":
+		req.Precondition = &dht_proto.Precondition{
+			Condition: &dht_proto.Precondition_IfVersion{IfVersion: cas},
+		}
+		_, err = s.SetKey(context.Background(), req)
+
+		// A failed cas reports whether the key changed or has gone
+		if status.Code(err) == codes.FailedPrecondition {
+			_, err = s.GetKey(context.Background(), &dht_proto.GetKeyRequest{
+				Key:         req.Key,
+				Consistency: dht_proto.Consistency_QUORUM,
+				Proxy:       true,
+			})
+			if status.Code(err) == codes.NotFound {
+				w.reply("NOT_FOUND")
+			} else {
+				w.reply("EXISTS")
+			}
+			return nil
+		}
+	}
+
+	switch {
+	case command == "add" && status.Code(err) == codes.FailedPrecondition,
+		command == "replace" && status.Code(err) == codes.NotFound:
+		w.reply("NOT_STORED")
+		return nil
+	case err != nil:
+		w.writeStatus(err)
+		return nil
+	}
+
+	// The item was stored already expired, which leaves nothing behind
+	if expired {
+		_, err = s.DeleteKey(context.Background(), &dht_proto.DeleteKeyRequest{
+			Key:   req.Key,
+			Proxy: true,
+		})
+		if err != nil {
+			w.writeStatus(err)
+			return nil
+		}
+	}
+
+	w.reply("STORED")
+	return nil
+}
+
+// memcachedDelete serves delete <key> [noreply]
+func (s *Server) memcachedDelete(w *memcachedWriter, args []string) {
+	if len(args) != 1 || !validMemcachedKey(args[0]) {
+		w.clientError("bad command line format. Usage: delete <key> [noreply]")
+		return
+	}
+
+	// Deletes always succeed, so the key is read first to tell the client if it existed. The
+	// owner coordinates reads above ONE, so a stale replica doesn't report it missing.
+	_, err := s.GetKey(context.Background(), &dht_proto.GetKeyRequest{
+		Key:         args[0],
+		Consistency: dht_proto.Consistency_QUORUM,
+		Proxy:       true,
+	})
+	if status.Code(err) == codes.NotFound {
+		w.reply("NOT_FOUND")
+		return
+	}
+	if err != nil {
+		w.writeStatus(err)
+		return
+	}
+
+	_, err = s.DeleteKey(context.Background(), &dht_proto.DeleteKeyRequest{
+		Key:   args[0],
+		Proxy: true,
+	})
+	if err != nil {
+		w.writeStatus(err)
+		return
+	}
+
+	w.reply("DELETED")
+}
+
+// memcachedTouch serves touch <key> <exptime> [noreply], rewriting the item with a new TTL
+func (s *Server) memcachedTouch(w *memcachedWriter, args []string) {
+	if len(args) != 2 || !validMemcachedKey(args[0]) {
+		w.WriteString("ERROR\r\n")
+		return
+	}
+
+	exptime, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil {
+		w.clientError("invalid exptime argument")
+		return
+	}
+
+	ttl, expired := memcachedTTL(exptime, time.Now())
+	req := &dht_proto.SetKeyRequest{
+		Key:        args[0],
+		TtlSeconds: ttl,
+		Proxy:      true,
+	}
+
+	// The item keeps its value and flags, only the TTL changes
+	_, err = s.replaceKey(req, func(current *dht_proto.GetKeyResponse) {
+		req.Value = current.Value
+	})
+	if status.Code(err) == codes.NotFound {
+		w.reply("NOT_FOUND")
+		return
+	}
+	if err != nil {
+		w.writeStatus(err)
+		return
+	}
+
+	// Touching an item with an exptime in the past expires it
+	if expired {
+		_, err = s.DeleteKey(context.Background(), &dht_proto.DeleteKeyRequest{
+			Key:   req.Key,
+			Proxy: true,
+		})
+		if err != nil {
+			w.writeStatus(err)
+			return
+		}
+	}
+
+	w.reply("TOUCHED")
+}
@@ -0,0 +1,144 @@
+package dht
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// memcachedConn sends commands to a memcached listener and reads the reply lines
+type memcachedConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func dialMemcached(t *testing.T, s *Server) *memcachedConn {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	t.Cleanup(func() { lis.Close() })
+
+	go s.ServeMemcached(lis)
+
+	conn, err := net.Dial("tcp", lis.Addr().String())
+	assert.Nil(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	return &memcachedConn{conn: conn, r: bufio.NewReader(conn)}
+}
+
+// do sends a command and reads n lines of reply
+func (c *memcachedConn) do(t *testing.T, command string, n int) []string {
+	_, err := c.conn.Write([]byte(command))
+	assert.Nil(t, err)
+
+	var lines []string
+	for i := 0; i < n; i++ {
+		line, err := c.r.ReadString('\n')
+		assert.Nil(t, err)
+		lines = append(lines, strings.TrimSuffix(line, "\r\n"))
+	}
+
+	return lines
+}
+
+func TestMemcachedStorage(t *testing.T) {
+	s := testServer()
+	c := dialMemcached(t, s)
+
+	assert.Equal(t, []string{"STORED"}, c.do(t, "set a 42 0 5\r\nhello\r\n", 1))
+	assert.Equal(t, []string{"VALUE a 42 5", "hello", "END"}, c.do(t, "get a missing\r\n", 3))
+
+	assert.Equal(t, []string{"NOT_STORED"}, c.do(t, "add a 0 0 1\r\nx\r\n", 1))
+	assert.Equal(t, []string{"STORED"}, c.do(t, "add b 0 0 1\r\nx\r\n", 1))
+	assert.Equal(t, []string{"NOT_STORED"}, c.do(t, "replace missing 0 0 1\r\nx\r\n", 1))
+	assert.Equal(t, []string{"STORED"}, c.do(t, "replace b 7 0 1\r\ny\r\n", 1))
+	assert.Equal(t, []string{"VALUE b 7 1", "y", "END"}, c.do(t, "get b\r\n", 3))
+
+	// A key without flags is stored as its plain value, so other clients can read it
+	assert.Equal(t, []string{"STORED"}, c.do(t, "set plain 0 0 5\r\nvalue\r\n", 1))
+	value, _, err := s.keystore.GetVersionedKey("plain")
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("value"), value)
+
+	assert.Equal(t, []string{"DELETED"}, c.do(t, "delete a\r\n", 1))
+	assert.Equal(t, []string{"NOT_FOUND"}, c.do(t, "delete a\r\n", 1))
+	assert.Equal(t, []string{"END"}, c.do(t, "get a\r\n", 1))
+}
+
+func TestMemcachedCas(t *testing.T) {
+	s := testServer()
+	c := dialMemcached(t, s)
+
+	c.do(t, "set key 3 0 1\r\n1\r\n", 1)
+	_, version, err := s.keystore.GetVersionedKey("key")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{fmt.Sprintf("VALUE key 3 1 %v", version), "1", "END"}, c.do(t, "gets key\r\n", 3))
+
+	assert.Equal(t, []string{"STORED"}, c.do(t, fmt.Sprintf("cas key 3 0 1 %v\r\n2\r\n", version), 1))
+	assert.Equal(t, []string{"EXISTS"}, c.do(t, fmt.Sprintf("cas key 3 0 1 %v\r\n3\r\n", version), 1))
+	assert.Equal(t, []string{"NOT_FOUND"}, c.do(t, "cas missing 0 0 1 1\r\nx\r\n", 1))
+	assert.Equal(t, []string{"VALUE key 3 1", "2", "END"}, c.do(t, "get key\r\n", 3))
+}
+
+func TestMemcachedExpiry(t *testing.T) {
+	s := testServer()
+	c := dialMemcached(t, s)
+
+	c.do(t, "set key 5 0 1\r\n1\r\n", 1)
+	assert.Equal(t, []string{"TOUCHED"}, c.do(t, "touch key 60\r\n", 1))
+	assert.Equal(t, []string{"NOT_FOUND"}, c.do(t, "touch missing 60\r\n", 1))
+
+	entry, ok := s.keystore.Lookup("key")
+	assert.True(t, ok)
+	assert.WithinDuration(t, time.Now().Add(time.Minute), entry.Expires, 5*time.Second)
+
+	// Flags survive a touch
+	assert.Equal(t, []string{"VALUE key 5 1", "1", "END"}, c.do(t, "get key\r\n", 3))
+
+	// An exptime in the past expires the item straight away
+	assert.Equal(t, []string{"STORED"}, c.do(t, "set key 0 -1 1\r\n1\r\n", 1))
+	assert.Equal(t, []string{"END"}, c.do(t, "get key\r\n", 1))
+}
+
+func TestMemcachedTTL(t *testing.T) {
+	now := time.Unix(2000000000, 0)
+
+	ttl, expired := memcachedTTL(0, now)
+	assert.Equal(t, int64(0), ttl)
+	assert.False(t, expired)
+
+	ttl, _ = memcachedTTL(60, now)
+	assert.Equal(t, int64(60), ttl)
+
+	ttl, _ = memcachedTTL(now.Unix()+90, now)
+	assert.Equal(t, int64(90), ttl)
+
+	_, expired = memcachedTTL(now.Unix()-1, now)
+	assert.True(t, expired)
+	_, expired = memcachedTTL(-1, now)
+	assert.True(t, expired)
+}
+
+func TestMemcachedProtocol(t *testing.T) {
+	c := dialMemcached(t, testServer())
+
+	// Replies to noreply commands are dropped, so the next reply is for version
+	assert.Equal(t, []string{"VERSION " + MEMCACHED_VERSION}, c.do(t, "set a 0 0 1 noreply\r\nx\r\nversion\r\n", 1))
+	assert.Equal(t, []string{"VALUE a 0 1", "x", "END"}, c.do(t, "get a noreply\r\n", 3), "a get always replies")
+
+	assert.Equal(t, []string{"ERROR"}, c.do(t, "flush_all\r\n", 1))
+	assert.Equal(t, []string{"CLIENT_ERROR bad command line format"}, c.do(t, "set a flags 0 1\r\nx\r\n", 1))
+	assert.Equal(t, []string{"SERVER_ERROR object too large for cache"}, c.do(t, fmt.Sprintf("set a 0 0 %v\r\n%v\r\n", MEMCACHED_MAX_VALUE+1, strings.Repeat("x", MEMCACHED_MAX_VALUE+1)), 1))
+
+	// The connection is still in step after the rejected value
+	assert.Equal(t, []string{"VALUE a 0 1", "x", "END"}, c.do(t, "get a\r\n", 3))
+
+	c.do(t, "quit\r\n", 0)
+	_, err := c.r.ReadString('\n')
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,329 @@
+package dht
+
+import (
+	"bytes"
+	"chord_dht/chord"
+	dht_proto "chord_dht/protos/dht"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// The depth of the Merkle tree, the ring is split into 1<<MERKLE_DEPTH buckets of keys
+const MERKLE_DEPTH = 10
+
+// The interval between anti-entropy exchanges with each replica
+const ANTI_ENTROPY_INTERVAL = 60 * time.Second
+
+// merkleTree summarises the entries within a range. The ring is split into equal buckets by
+// Chord ID, each leaf is the hash of the entries in one bucket and each node above is the hash
+// of its two children, so two trees with the same root hold the same entries and the buckets
+// which differ can be found by comparing the leaves.
+type merkleTree struct {
+	// levels[0] holds the root and levels[MERKLE_DEPTH] the leaves
+	levels [][][]byte
+}
+
+// buildMerkleTree builds the tree over a set of entries. Leaves are the XOR of the hashes of
+// their entries, so the order the entries are visited in doesn't matter.
+func buildMerkleTree(entries []Entry) *merkleTree {
+	leaves := emptyLeaves()
+	for _, v := range entries {
+		xorInto(leaves[bucketOf(v.Id)], hashEntry(v))
+	}
+
+	return treeFromLeaves(leaves)
+}
+
+func emptyLeaves() [][]byte {
+	leaves := make([][]byte, 1<<MERKLE_DEPTH)
+	for i := range leaves {
+		leaves[i] = make([]byte, sha256.Size)
+	}
+
+	return leaves
+}
+
+func xorInto(dst []byte, src []byte) {
+	for i, b := range src {
+		dst[i] ^= b
+	}
+}
+
+// treeFromLeaves hashes the levels of the tree above its leaves
+func treeFromLeaves(leaves [][]byte) *merkleTree {
+	t := &merkleTree{
+		levels: make([][][]byte, MERKLE_DEPTH+1),
+	}
+	t.levels[MERKLE_DEPTH] = leaves
+
+	for level := MERKLE_DEPTH - 1; level >= 0; level-- {
+		children := t.levels[level+1]
+		nodes := make([][]byte, len(children)/2)
+		for i := range nodes {
+			sum := sha256.Sum256(append(append([]byte{}, children[2*i]...), children[2*i+1]...))
+			nodes[i] = sum[:]
+		}
+		t.levels[level] = nodes
+	}
+
+	return t
+}
+
+// merkleSource is implemented by stores which keep the leaves of the tree up to date as they're
+// written, so that the tree can be had without a scan of the store
+type merkleSource interface {
+	merkleTree(r chord.KeyRange) *merkleTree
+}
+
+// leafEntry is the hash of an entry counted in a leaf
+type leafEntry struct {
+	id   chord.Id
+	hash []byte
+}
+
+// merkleLeaves maintains the leaves of the tree over every entry in a store. An entry is added
+// to or removed from its leaf by XORing in its hash, and the hashes in each bucket are kept
+// for the buckets which straddle the ends of a range.
+type merkleLeaves struct {
+	mu      sync.Mutex
+	leaves  [][]byte
+	buckets []map[string]leafEntry
+}
+
+func newMerkleLeaves() *merkleLeaves {
+	return &merkleLeaves{
+		leaves:  emptyLeaves(),
+		buckets: make([]map[string]leafEntry, 1<<MERKLE_DEPTH),
+	}
+}
+
+// set replaces whatever was counted for the key with the entry
+func (m *merkleLeaves) set(v Entry) {
+	bucket := bucketOf(v.Id)
+	hash := hashEntry(v)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.buckets[bucket] == nil {
+		m.buckets[bucket] = make(map[string]leafEntry)
+	}
+	if old, ok := m.buckets[bucket][v.Key]; ok {
+		xorInto(m.leaves[bucket], old.hash)
+	}
+
+	xorInto(m.leaves[bucket], hash)
+	m.buckets[bucket][v.Key] = leafEntry{id: v.Id, hash: hash}
+}
+
+// remove stops counting the key
+func (m *merkleLeaves) remove(key string, id chord.Id) {
+	bucket := bucketOf(id)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if old, ok := m.buckets[bucket][key]; ok {
+		xorInto(m.leaves[bucket], old.hash)
+		delete(m.buckets[bucket], key)
+	}
+}
+
+// tree returns the tree over the entries within r. Buckets wholly inside r keep their leaf and
+// those outside it are empty, only the buckets holding the ends of r are worked out again.
+func (m *merkleLeaves) tree(r chord.KeyRange) *merkleTree {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	leaves := make([][]byte, len(m.leaves))
+	for i, leaf := range m.leaves {
+		leaves[i] = bytes.Clone(leaf)
+	}
+
+	if r.Start == r.End {
+		return treeFromLeaves(leaves)
+	}
+
+	// The range begins just after r.Start, in its bucket or, when r.Start ends it, in the next one
+	first := bucketOf(r.Start)
+	edges := map[int]bool{first: true, (first + 1) % len(leaves): true, bucketOf(r.End): true}
+	for i := range leaves {
+		switch {
+		case edges[i]:
+			leaves[i] = make([]byte, sha256.Size)
+			for _, v := range m.buckets[i] {
+				if r.Contains(v.id) {
+					xorInto(leaves[i], v.hash)
+				}
+			}
+		case !r.Contains(bucketRange(i).End):
+			leaves[i] = make([]byte, sha256.Size)
+		}
+	}
+
+	return treeFromLeaves(leaves)
+}
+
+// merkleTree returns the tree over the node's entries within r
+func (s *Server) merkleTree(r chord.KeyRange) *merkleTree {
+	if s.merkle != nil {
+		return s.merkle.merkleTree(r)
+	}
+
+	return buildMerkleTree(entriesInRange(s.keystore, r))
+}
+
+// entriesInBuckets collects the entries within r which fall in any of the buckets, in a single
+// pass over the store
+func entriesInBuckets(store Store, r chord.KeyRange, buckets []int) []Entry {
+	wanted := make(map[int]bool, len(buckets))
+	for _, b := range buckets {
+		wanted[b] = true
+	}
+
+	var entries []Entry
+	store.Range(r, func(v Entry) bool {
+		if wanted[bucketOf(v.Id)] {
+			entries = append(entries, v)
+		}
+		return true
+	})
+
+	return entries
+}
+
+// Root returns the hash of the whole tree
+func (t *merkleTree) Root() []byte {
+	return t.levels[0][0]
+}
+
+// hashEntry covers everything replicas must agree on for a key
+func hashEntry(v Entry) []byte {
+	h := sha256.New()
+	h.Write([]byte(v.Key))
+
+	var meta [17]byte
+	binary.BigEndian.PutUint64(meta[0:8], v.Version)
+	binary.BigEndian.PutUint64(meta[8:16], uint64(serializeExpiry(v.Expires)))
+	if v.Deleted {
+		meta[16] = 1
+	}
+	h.Write(meta[:])
+	h.Write(v.Value)
+
+	return h.Sum(nil)
+}
+
+// bucketOf returns the leaf of the tree an identifier falls in
+func bucketOf(id chord.Id) int {
+	return int(id >> (chord.ID_BITS - MERKLE_DEPTH))
+}
+
+// bucketRange returns the range of identifiers covered by a leaf of the tree
+func bucketRange(bucket int) chord.KeyRange {
+	size := chord.Id(1) << (chord.ID_BITS - MERKLE_DEPTH)
+	start := chord.Id(bucket) * size
+
+	return chord.KeyRange{Start: start - 1, End: start + size - 1}
+}
+
+// diffHashes returns the indices at which two levels of a tree differ
+func diffHashes(a, b [][]byte) []int {
+	var diff []int
+	for i := range a {
+		if i >= len(b) || !bytes.Equal(a[i], b[i]) {
+			diff = append(diff, i)
+		}
+	}
+
+	return diff
+}
+
+func (s *Server) MerkleTree(ctx context.Context, in *dht_proto.MerkleTreeRequest) (*dht_proto.MerkleTreeResponse, error) {
+	if in.Level < 0 || in.Level > MERKLE_DEPTH {
+		return nil, status.Errorf(codes.InvalidArgument, "level must be between 0 and %v", MERKLE_DEPTH)
+	}
+
+	r := chord.KeyRange{Start: chord.Id(in.Start), End: chord.Id(in.End)}
+	t := s.merkleTree(r)
+
+	return &dht_proto.MerkleTreeResponse{
+		Hashes: t.levels[in.Level],
+	}, nil
+}
+
+// antiEntropy periodically compares the owned range with each replica and repairs any differences
+func (s *Server) antiEntropy() {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(ANTI_ENTROPY_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			owned := s.node.OwnedRange()
+			for _, p := range s.replicaTargets() {
+				repaired, err := s.syncReplica(dhtAddress(p), owned)
+				if err != nil {
+					fmt.Printf("anti-entropy with %v failed: %v\n", p.Id, err)
+				} else if repaired > 0 {
+					fmt.Printf("Repaired %v buckets with %v\n", repaired, p.Id)
+				}
+			}
+
+		case <-s.shutdown:
+			return
+		}
+	}
+}
+
+// syncReplica compares our copy of r with the node at address, starting at the roots of the
+// trees. If they differ, the entries in the differing buckets are exchanged in both directions
+// and the newest copy of each key wins. Returns the number of buckets repaired.
+func (s *Server) syncReplica(address string, r chord.KeyRange) (int, error) {
+	local := s.merkleTree(r)
+
+	root, err := merkleLevel(address, r, 0)
+	if err != nil {
+		return 0, err
+	}
+	if len(root) == 1 && bytes.Equal(root[0], local.Root()) {
+		return 0, nil
+	}
+
+	leaves, err := merkleLevel(address, r, MERKLE_DEPTH)
+	if err != nil {
+		return 0, err
+	}
+
+	diff := diffHashes(local.levels[MERKLE_DEPTH], leaves)
+	if len(diff) == 0 {
+		return 0, nil
+	}
+
+	err = handoffBuckets(address, r, diff, func(entry *dht_proto.Entry) {
+		s.keystore.Apply(entry.Key, entry.Value, entry.Version, parseExpiry(entry.Expires), entry.Deleted)
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	outgoing := entriesInBuckets(s.keystore, r, diff)
+	if len(outgoing) > 0 {
+		_, err = TransferRange(address, s.node.Identifier(), outgoing, true)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	promAntiEntropyRepairsTotal.Add(float64(len(diff)))
+	return len(diff), nil
+}
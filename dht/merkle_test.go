@@ -0,0 +1,165 @@
+package dht
+
+import (
+	"chord_dht/chord"
+	dht_proto "chord_dht/protos/dht"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+)
+
+func merkleEntries(keys ...string) []Entry {
+	var entries []Entry
+	for _, key := range keys {
+		entries = append(entries, Entry{
+			Key:     key,
+			Value:   []byte(key),
+			Id:      ChordIdFromString(key),
+			Version: 1,
+		})
+	}
+
+	return entries
+}
+
+func TestMerkleTreeIgnoresOrder(t *testing.T) {
+	a := buildMerkleTree(merkleEntries("a", "b", "c"))
+	b := buildMerkleTree(merkleEntries("c", "a", "b"))
+
+	assert.Equal(t, a.Root(), b.Root())
+	assert.Empty(t, diffHashes(a.levels[MERKLE_DEPTH], b.levels[MERKLE_DEPTH]))
+}
+
+func TestMerkleTreeFindsDifferingBucket(t *testing.T) {
+	entries := merkleEntries("a", "b", "c")
+	a := buildMerkleTree(entries)
+
+	entries[1].Version = 2
+	b := buildMerkleTree(entries)
+
+	assert.NotEqual(t, a.Root(), b.Root())
+	assert.Equal(t, []int{bucketOf(entries[1].Id)}, diffHashes(a.levels[MERKLE_DEPTH], b.levels[MERKLE_DEPTH]))
+}
+
+func TestMerkleTreeTombstonesDiffer(t *testing.T) {
+	entries := merkleEntries("a")
+	a := buildMerkleTree(entries)
+
+	entries[0].Deleted = true
+	b := buildMerkleTree(entries)
+
+	assert.NotEqual(t, a.Root(), b.Root())
+}
+
+func TestBucketRange(t *testing.T) {
+	size := chord.Id(1) << (chord.ID_BITS - MERKLE_DEPTH)
+
+	first := bucketRange(0)
+	assert.True(t, first.Contains(0))
+	assert.True(t, first.Contains(size-1))
+	assert.False(t, first.Contains(size))
+
+	last := bucketRange(1<<MERKLE_DEPTH - 1)
+	assert.True(t, last.Contains(1<<chord.ID_BITS-1))
+	assert.False(t, last.Contains(0))
+
+	for _, key := range []string{"a", "b", "c"} {
+		id := ChordIdFromString(key)
+		assert.True(t, bucketRange(bucketOf(id)).Contains(id))
+	}
+}
+
+func TestMerkleLeavesMatchFullBuild(t *testing.T) {
+	ks := CreateKeyStore(1)
+	for _, key := range []string{"a", "b", "c", "d"} {
+		ks.SetExpiringKey(key, []byte(key), newVersion(), time.Time{})
+	}
+	ks.SetExpiringKey("b", []byte("again"), newVersion(), time.Time{})
+	ks.DeleteVersionedKey("c", newVersion())
+	ks.DeleteKey("d")
+
+	ranges := []chord.KeyRange{
+		{Start: 0, End: 0},
+		{Start: ChordIdFromString("a"), End: ChordIdFromString("b")},
+		{Start: ChordIdFromString("b"), End: ChordIdFromString("a")},
+		{Start: ChordIdFromString("c") - 1, End: ChordIdFromString("c")},
+	}
+	for _, r := range ranges {
+		expected := buildMerkleTree(entriesInRange(ks, r))
+		assert.Equal(t, expected.levels, ks.merkleTree(r).levels, "range %v", r)
+	}
+}
+
+func TestMerkleLeavesRangeFromTopOfRing(t *testing.T) {
+	ks := CreateKeyStore(1)
+	for _, key := range []string{"a", "b", "c", "d"} {
+		ks.SetExpiringKey(key, []byte(key), newVersion(), time.Time{})
+	}
+
+	top := chord.Id(1)<<chord.ID_BITS - 1
+	ranges := []chord.KeyRange{
+		{Start: top, End: ChordIdFromString("a")},
+		{Start: top, End: 0},
+		{Start: ChordIdFromString("b"), End: top},
+	}
+	for _, r := range ranges {
+		expected := buildMerkleTree(entriesInRange(ks, r))
+		assert.Equal(t, expected.levels, ks.merkleTree(r).levels, "range %v", r)
+	}
+}
+
+// serveDHT serves s over gRPC on a local port, returning its address
+func serveDHT(t *testing.T, s *Server) string {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+
+	gs := grpc.NewServer()
+	dht_proto.RegisterDHTServer(gs, s)
+	go gs.Serve(lis)
+	t.Cleanup(func() {
+		gs.Stop()
+		CloseConnections()
+	})
+
+	return lis.Addr().String()
+}
+
+func TestSyncReplica(t *testing.T) {
+	// The local tree is built by a scan, the remote one from the leaves kept by its store
+	local := testServer()
+	local.merkle = nil
+	local.node = chord.CreateNode(2)
+	remote := testServer()
+	address := serveDHT(t, remote)
+
+	// Replicas are only accepted from nodes of the ring
+	remote.node.Rectify(&chord.RPCNode{Id: 2, Address: "127.0.0.1:1"})
+
+	local.keystore.SetExpiringKey("both", []byte("old"), newVersion(), time.Time{})
+	remote.keystore.SetExpiringKey("both", []byte("new"), newVersion(), time.Time{})
+	local.keystore.SetExpiringKey("local", []byte("1"), newVersion(), time.Time{})
+	remote.keystore.SetExpiringKey("remote", []byte("2"), newVersion(), time.Time{})
+	remote.keystore.DeleteVersionedKey("local", newVersion())
+
+	r := chord.KeyRange{Start: 0, End: 0}
+	repaired, err := local.syncReplica(address, r)
+	assert.Nil(t, err)
+	assert.Positive(t, repaired)
+
+	value, _, err := local.keystore.GetVersionedKey("both")
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("new"), value)
+	assert.True(t, local.keystore.HasKey("remote"))
+	assert.False(t, local.keystore.HasKey("local"), "the newer tombstone wins")
+	assert.Equal(t, local.merkleTree(r).Root(), remote.merkleTree(r).Root())
+
+	// Anti-entropy doesn't count as handing the range off
+	assert.False(t, remote.handingOff(ChordIdFromString("both")))
+
+	repaired, err = local.syncReplica(address, r)
+	assert.Nil(t, err)
+	assert.Zero(t, repaired)
+}
@@ -0,0 +1,339 @@
+package dht
+
+import (
+	"chord_dht/chord"
+	"context"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Keys are scoped by the namespace given in requests. Internally a key is stored as its
+// namespace and the key joined by NAMESPACE_SEPARATOR, so replication, transfers and hints
+// carry the namespace along with the key without knowing about it. Keys in the default
+// namespace, the empty one, are stored as they are.
+
+// NAMESPACE_SEPARATOR joins a namespace and a key, keys given by clients may not contain it
+const NAMESPACE_SEPARATOR = "\x00"
+
+// The interval between recounts of the keys and bytes stored for each namespace
+const QUOTA_RECOUNT_INTERVAL = 30 * time.Second
+
+var namespacePattern = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,64}$`)
+
+// scopedKey returns the key a namespaced key is stored under
+func scopedKey(namespace string, key string) string {
+	if namespace == "" {
+		return key
+	}
+
+	return namespace + NAMESPACE_SEPARATOR + key
+}
+
+// splitKey returns the namespace and key of a stored key
+func splitKey(scoped string) (string, string) {
+	namespace, key, ok := strings.Cut(scoped, NAMESPACE_SEPARATOR)
+	if !ok {
+		return "", scoped
+	}
+
+	return namespace, key
+}
+
+// requestKey validates a key given by a client and returns the key it's stored under
+func requestKey(namespace string, key string) (string, error) {
+	if namespace != "" && !namespacePattern.MatchString(namespace) {
+		return "", status.Errorf(codes.InvalidArgument, "invalid namespace %q, namespaces are up to 64 letters, digits, '_', '.' or '-'", namespace)
+	}
+	if strings.Contains(key, NAMESPACE_SEPARATOR) {
+		return "", status.Error(codes.InvalidArgument, "keys may not contain a NUL byte")
+	}
+
+	return scopedKey(namespace, key), nil
+}
+
+// internalKey returns the key an internal key of a namespace is stored under. It's stored within
+// the namespace, so it counts towards its quota, but the key starts with NAMESPACE_SEPARATOR,
+// which keys given by clients can't contain.
+func internalKey(namespace string, key string) string {
+	return namespace + NAMESPACE_SEPARATOR + NAMESPACE_SEPARATOR + key
+}
+
+// requestedKey is requestKey for a request which may address an internal key, these are only
+// accepted from this node and other nodes of the ring
+func (s *Server) requestedKey(ctx context.Context, namespace string, key string, internal bool) (string, error) {
+	if !internal {
+		return requestKey(namespace, key)
+	}
+
+	_, err := requestKey(namespace, key)
+	if err != nil {
+		return "", err
+	}
+
+	err = s.fromRingMember(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	return internalKey(namespace, key), nil
+}
+
+// Quota limits what a node stores for a namespace, zero fields are unlimited
+type Quota struct {
+	// MaxKeys is the maximum number of live keys
+	MaxKeys int64
+
+	// MaxBytes is the maximum total size of the live keys and their values
+	MaxBytes int64
+}
+
+// ParseQuota reads a quota written as <keys>:<bytes>, either may be 0 for unlimited
+func ParseQuota(s string) (Quota, error) {
+	keys, bytes, ok := strings.Cut(s, ":")
+	if !ok {
+		return Quota{}, fmt.Errorf("quota %q should be of the form <keys>:<bytes>", s)
+	}
+
+	var q Quota
+	var err error
+	q.MaxKeys, err = strconv.ParseInt(keys, 10, 64)
+	if err != nil {
+		return Quota{}, fmt.Errorf("invalid key limit in quota %q: %w", s, err)
+	}
+	q.MaxBytes, err = strconv.ParseInt(bytes, 10, 64)
+	if err != nil {
+		return Quota{}, fmt.Errorf("invalid byte limit in quota %q: %w", s, err)
+	}
+
+	return q, nil
+}
+
+// ParseQuotas reads a comma separated list of quotas written as <namespace>=<keys>:<bytes>
+func ParseQuotas(s string) (map[string]Quota, error) {
+	quotas := make(map[string]Quota)
+	if s == "" {
+		return quotas, nil
+	}
+
+	for _, item := range strings.Split(s, ",") {
+		namespace, quota, ok := strings.Cut(item, "=")
+		if !ok {
+			return nil, fmt.Errorf("quota %q should be of the form <namespace>=<keys>:<bytes>", item)
+		}
+
+		q, err := ParseQuota(quota)
+		if err != nil {
+			return nil, err
+		}
+		quotas[namespace] = q
+	}
+
+	return quotas, nil
+}
+
+// usage is what a node stores for a namespace
+type usage struct {
+	keys  int64
+	bytes int64
+}
+
+// quotaTracker enforces the quotas of each namespace on the node, counting the keys in the
+// range the node owns. Replicas are left out, since the owner has already admitted them. Usage
+// is adjusted as writes are admitted and recounted from the store periodically, which also
+// picks up keys the node has taken over or handed off. A nil tracker enforces nothing.
+type quotaTracker struct {
+	mu     sync.Mutex
+	usage  map[string]*usage
+	quotas map[string]Quota
+
+	// fallback applies to the namespaces without a quota of their own
+	fallback Quota
+
+	keysGauge  *prometheus.GaugeVec
+	bytesGauge *prometheus.GaugeVec
+}
+
+func newQuotaTracker(id chord.Id, quotas map[string]Quota, fallback Quota) *quotaTracker {
+	labels := prometheus.Labels{
+		"id": fmt.Sprint(id),
+	}
+
+	return &quotaTracker{
+		usage:    make(map[string]*usage),
+		quotas:   quotas,
+		fallback: fallback,
+
+		keysGauge: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name:        "dht_namespace_keys",
+			Help:        "The number of live keys the node owns for a namespace",
+			ConstLabels: labels,
+		}, []string{"namespace"}),
+		bytesGauge: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name:        "dht_namespace_bytes",
+			Help:        "The total size of the live keys and values the node owns for a namespace",
+			ConstLabels: labels,
+		}, []string{"namespace"}),
+	}
+}
+
+func (q *quotaTracker) quota(namespace string) Quota {
+	if quota, ok := q.quotas[namespace]; ok {
+		return quota
+	}
+
+	return q.fallback
+}
+
+// live returns if a stored entry counts towards its namespace's usage
+func live(v Entry, now time.Time) bool {
+	return !v.Deleted && (v.Expires.IsZero() || now.Before(v.Expires))
+}
+
+// entrySize is the number of bytes an entry counts for
+func entrySize(v Entry) int64 {
+	_, key := splitKey(v.Key)
+	return int64(len(key) + len(v.Value))
+}
+
+// admit checks a new write against the quota of its namespace, counting it if it fits. Returns
+// the usage counted, which is refunded if the write doesn't go ahead, or a ResourceExhausted
+// error if the write would take the namespace over its quota.
+func (q *quotaTracker) admit(store Store, key string, value []byte) (usage, error) {
+	if q == nil {
+		return usage{}, nil
+	}
+
+	namespace, _ := splitKey(key)
+	next := Entry{Key: key, Value: value}
+
+	var keys, bytes int64 = 1, entrySize(next)
+	if old, ok := store.Lookup(key); ok && live(old, time.Now()) {
+		keys, bytes = 0, bytes-entrySize(old)
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	u := q.namespaceUsage(namespace)
+	quota := q.quota(namespace)
+
+	if keys > 0 && quota.MaxKeys > 0 && u.keys+keys > quota.MaxKeys {
+		promQuotaRejectionsTotal.WithLabelValues(namespace).Inc()
+		return usage{}, status.Errorf(codes.ResourceExhausted, "namespace %q is at its quota of %v keys", namespace, quota.MaxKeys)
+	}
+	if bytes > 0 && quota.MaxBytes > 0 && u.bytes+bytes > quota.MaxBytes {
+		promQuotaRejectionsTotal.WithLabelValues(namespace).Inc()
+		return usage{}, status.Errorf(codes.ResourceExhausted, "namespace %q is at its quota of %v bytes", namespace, quota.MaxBytes)
+	}
+
+	u.keys += keys
+	u.bytes += bytes
+	q.report(namespace, u)
+
+	return usage{keys: keys, bytes: bytes}, nil
+}
+
+// refund takes back the usage admit counted for a write which didn't go ahead, e.g. because its
+// precondition failed
+func (q *quotaTracker) refund(key string, counted usage) {
+	if q == nil {
+		return
+	}
+
+	namespace, _ := splitKey(key)
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	u := q.namespaceUsage(namespace)
+	u.keys = max(u.keys-counted.keys, 0)
+	u.bytes = max(u.bytes-counted.bytes, 0)
+	q.report(namespace, u)
+}
+
+// release stops counting a key which is about to be deleted
+func (q *quotaTracker) release(store Store, key string) {
+	if q == nil {
+		return
+	}
+
+	old, ok := store.Lookup(key)
+	if !ok || !live(old, time.Now()) {
+		return
+	}
+
+	namespace, _ := splitKey(key)
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	u := q.namespaceUsage(namespace)
+	u.keys = max(u.keys-1, 0)
+	u.bytes = max(u.bytes-entrySize(old), 0)
+	q.report(namespace, u)
+}
+
+// recount replaces the usage of every namespace with the keys in the store within owned
+func (q *quotaTracker) recount(store Store, owned chord.KeyRange) {
+	if q == nil {
+		return
+	}
+
+	now := time.Now()
+	counted := make(map[string]*usage)
+	store.Range(owned, func(v Entry) bool {
+		if !live(v, now) {
+			return true
+		}
+
+		namespace, _ := splitKey(v.Key)
+		u, ok := counted[namespace]
+		if !ok {
+			u = &usage{}
+			counted[namespace] = u
+		}
+		u.keys++
+		u.bytes += entrySize(v)
+		return true
+	})
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for namespace := range q.usage {
+		if _, ok := counted[namespace]; !ok {
+			q.keysGauge.DeleteLabelValues(namespace)
+			q.bytesGauge.DeleteLabelValues(namespace)
+		}
+	}
+
+	q.usage = counted
+	for namespace, u := range q.usage {
+		q.report(namespace, u)
+	}
+}
+
+// namespaceUsage returns the usage of a namespace, creating it if needed. Requires the lock.
+func (q *quotaTracker) namespaceUsage(namespace string) *usage {
+	u, ok := q.usage[namespace]
+	if !ok {
+		u = &usage{}
+		q.usage[namespace] = u
+	}
+
+	return u
+}
+
+// report updates the metrics of a namespace. Requires the lock.
+func (q *quotaTracker) report(namespace string, u *usage) {
+	q.keysGauge.WithLabelValues(namespace).Set(float64(u.keys))
+	q.bytesGauge.WithLabelValues(namespace).Set(float64(u.bytes))
+}
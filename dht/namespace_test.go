@@ -0,0 +1,194 @@
+package dht
+
+import (
+	"bytes"
+	"chord_dht/chord"
+	dht_proto "chord_dht/protos/dht"
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// testServer returns a server for a lone node with ID 1, without replicas, wired up the way
+// StartDHT does but without listening anywhere
+func testServer() *Server {
+	ks := CreateKeyStore(1)
+	s := &Server{
+		node:              chord.CreateNode(1),
+		replicationFactor: 1,
+		merkle:            ks,
+		hints:             make(map[chord.Id]*hintQueue),
+		watches:           newWatchHub(),
+		snapshots:         &snapshotRecorder{},
+		shutdown:          make(chan struct{}),
+	}
+	s.keystore = &recordingStore{
+		Store:    &watchedStore{Store: ks, hub: s.watches},
+		recorder: s.snapshots,
+	}
+	s.hintsGauge, s.hintAgeGauge = newHintGauges(1)
+
+	return s
+}
+
+func TestRequestKey(t *testing.T) {
+	key, err := requestKey("", "test")
+	assert.Nil(t, err)
+	assert.Equal(t, "test", key)
+
+	key, err = requestKey("team-a", "test")
+	assert.Nil(t, err)
+	namespace, unscoped := splitKey(key)
+	assert.Equal(t, "team-a", namespace)
+	assert.Equal(t, "test", unscoped)
+
+	_, err = requestKey("team a", "test")
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	// A key containing the separator could collide with a key in another namespace
+	_, err = requestKey("", "team-a"+NAMESPACE_SEPARATOR+"test")
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestParseQuotas(t *testing.T) {
+	quotas, err := ParseQuotas("a=10:0,b=0:1024")
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]Quota{
+		"a": {MaxKeys: 10},
+		"b": {MaxBytes: 1024},
+	}, quotas)
+
+	_, err = ParseQuotas("a=10")
+	assert.NotNil(t, err)
+}
+
+func TestNamespacesAreIsolated(t *testing.T) {
+	s := testServer()
+
+	_, err := s.SetKey(context.Background(), &dht_proto.SetKeyRequest{Key: "test", Namespace: "a", Value: []byte("1")})
+	assert.Nil(t, err)
+	_, err = s.SetKey(context.Background(), &dht_proto.SetKeyRequest{Key: "test", Namespace: "b", Value: []byte("2")})
+	assert.Nil(t, err)
+
+	res, err := s.GetKey(context.Background(), &dht_proto.GetKeyRequest{Key: "test", Namespace: "a"})
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("1"), res.Value)
+
+	assert.False(t, s.keystore.HasKey("test"), "the default namespace shouldn't see either key")
+}
+
+func TestQuotaRejectsWrites(t *testing.T) {
+	s := testServer()
+	s.quotas = newQuotaTracker(1, map[string]Quota{"small": {MaxKeys: 2, MaxBytes: 100}}, Quota{})
+
+	set := func(key string, value string) error {
+		_, err := s.SetKey(context.Background(), &dht_proto.SetKeyRequest{Key: key, Namespace: "small", Value: []byte(value)})
+		return err
+	}
+
+	assert.Nil(t, set("a", "1"))
+	assert.Nil(t, set("b", "2"))
+	assert.Equal(t, codes.ResourceExhausted, status.Code(set("c", "3")))
+
+	// Overwriting an existing key doesn't add a key
+	assert.Nil(t, set("a", "11"))
+	assert.Equal(t, codes.ResourceExhausted, status.Code(set("a", string(make([]byte, 100)))))
+
+	// Other namespaces are unaffected
+	_, err := s.SetKey(context.Background(), &dht_proto.SetKeyRequest{Key: "c", Namespace: "other", Value: []byte("3")})
+	assert.Nil(t, err)
+
+	_, err = s.DeleteKey(context.Background(), &dht_proto.DeleteKeyRequest{Key: "b", Namespace: "small"})
+	assert.Nil(t, err)
+	assert.Nil(t, set("c", "3"))
+}
+
+func TestQuotaRefundsFailedWrites(t *testing.T) {
+	s := testServer()
+	s.quotas = newQuotaTracker(1, map[string]Quota{"small": {MaxKeys: 1}}, Quota{})
+
+	// The precondition fails with the namespace at its limit, the write mustn't stay counted
+	_, err := s.SetKey(context.Background(), &dht_proto.SetKeyRequest{
+		Key:       "a",
+		Namespace: "small",
+		Value:     []byte("1"),
+		Precondition: &dht_proto.Precondition{
+			Condition: &dht_proto.Precondition_IfVersion{IfVersion: 1},
+		},
+	})
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+	assert.Zero(t, s.quotas.usage["small"].keys)
+
+	_, err = s.SetKey(context.Background(), &dht_proto.SetKeyRequest{Key: "a", Namespace: "small", Value: []byte("1")})
+	assert.Nil(t, err)
+}
+
+func TestQuotaRecount(t *testing.T) {
+	store := CreateKeyStore(1)
+	store.SetVersionedKey(scopedKey("a", "x"), []byte("12"), 1)
+	store.SetVersionedKey(scopedKey("a", "y"), []byte("3"), 1)
+	store.SetVersionedKey("z", []byte("4"), 1)
+	store.DeleteVersionedKey(scopedKey("a", "y"), 2)
+
+	q := newQuotaTracker(1, nil, Quota{})
+	q.recount(store, chord.KeyRange{})
+
+	assert.Equal(t, &usage{keys: 1, bytes: 3}, q.usage["a"])
+	assert.Equal(t, &usage{keys: 1, bytes: 2}, q.usage[""])
+
+	// Keys outside of the range the node owns are replicas, and aren't counted
+	id := ChordIdFromString("z")
+	q.recount(store, chord.KeyRange{Start: id, End: id - 1})
+	assert.Equal(t, &usage{keys: 1, bytes: 3}, q.usage["a"])
+	assert.Nil(t, q.usage[""])
+}
+
+func TestQuotaAppliesToHints(t *testing.T) {
+	s := testServer()
+	s.quotas = newQuotaTracker(1, map[string]Quota{"small": {MaxKeys: 1}}, Quota{})
+
+	entries := []Entry{
+		{Key: scopedKey("small", "a"), Value: []byte("1"), Version: newVersion()},
+		{Key: scopedKey("small", "b"), Value: []byte("2"), Version: newVersion()},
+	}
+	assert.Nil(t, s.deliverEntries("", entries, true))
+
+	assert.True(t, s.keystore.HasKey(scopedKey("small", "a")))
+	assert.False(t, s.keystore.HasKey(scopedKey("small", "b")), "a hint over the quota should be dropped")
+}
+
+func TestQuotaAppliesToObjects(t *testing.T) {
+	s := testServer()
+	s.quotas = newQuotaTracker(1, map[string]Quota{"small": {MaxBytes: CHUNK_SIZE}}, Quota{})
+
+	_, err := s.putObject("small", "big", bytes.NewReader(make([]byte, CHUNK_SIZE+1)))
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+
+	_, err = s.putObject("small", "doc", bytes.NewReader([]byte("hello")))
+	assert.Nil(t, err)
+	assert.False(t, s.keystore.HasKey("doc"), "the object should be stored in its namespace")
+
+	var buf bytes.Buffer
+	err = s.getObject("small", "doc", func(data []byte) error {
+		_, err := buf.Write(data)
+		return err
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, "hello", buf.String())
+}
+
+func TestClientVersionsRejected(t *testing.T) {
+	s := testServer()
+	s.quotas = newQuotaTracker(1, map[string]Quota{"small": {MaxKeys: 1}}, Quota{})
+
+	_, err := s.SetKey(context.Background(), &dht_proto.SetKeyRequest{Key: "a", Namespace: "small", Value: []byte("1"), Version: 1})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	_, err = s.DeleteKey(context.Background(), &dht_proto.DeleteKeyRequest{Key: "a", Version: ^uint64(0)})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	assert.False(t, s.keystore.HasKey("a"))
+	assert.Less(t, newVersion(), ^uint64(0), "the clock mustn't be pushed to the end of time")
+}
@@ -0,0 +1,362 @@
+package dht
+
+import (
+	"bytes"
+	dht_proto "chord_dht/protos/dht"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// The size objects are split into, each chunk is stored as a key of its own
+const CHUNK_SIZE = 1 << 20
+
+// OBJECT_FORMAT marks the value of a key as an object manifest
+const OBJECT_FORMAT = "chord-object/v1"
+
+// The prefix of the keys chunks are stored under, followed by the hex upload id of the object
+// and the hex SHA-256 of the chunk. They're internal keys of the object's namespace, which
+// clients can't address.
+const CHUNK_PREFIX = "chunk/"
+
+// The size of the random id given to each write of an object
+const UPLOAD_ID_SIZE = 8
+
+// The number of times the manifest of an object is written before giving up, if it keeps
+// being replaced by other writers
+const MANIFEST_ATTEMPTS = 5
+
+// chunkKey returns the key a chunk of an upload is stored under. Keys are derived from the
+// content, so the chunks of an object are spread across the ring and identical chunks within
+// an object are only stored once. Chunks aren't shared between uploads, so they can be
+// deleted with their manifest. Chunks of manifests without an upload id were stored as plain
+// keys, see internalChunks.
+func chunkKey(upload []byte, hash []byte) string {
+	if len(upload) == 0 {
+		return CHUNK_PREFIX + hex.EncodeToString(hash)
+	}
+
+	return CHUNK_PREFIX + hex.EncodeToString(upload) + "/" + hex.EncodeToString(hash)
+}
+
+// internalChunks returns if the chunks of a manifest are stored as internal keys
+func internalChunks(manifest *dht_proto.ObjectManifest) bool {
+	return len(manifest.Upload) > 0
+}
+
+// verifyChunk checks that a chunk read back from the ring matches its hash
+func verifyChunk(hash []byte, data []byte) error {
+	sum := sha256.Sum256(data)
+	if !bytes.Equal(sum[:], hash) {
+		return fmt.Errorf("chunk %v is corrupt", hex.EncodeToString(hash))
+	}
+
+	return nil
+}
+
+// parseManifest reads the manifest stored as the value of an object's key
+func parseManifest(value []byte) (*dht_proto.ObjectManifest, error) {
+	manifest := &dht_proto.ObjectManifest{}
+	err := proto.Unmarshal(value, manifest)
+	if err != nil || manifest.Format != OBJECT_FORMAT {
+		return nil, fmt.Errorf("value is not an object manifest")
+	}
+
+	return manifest, nil
+}
+
+// routeSet writes a key from this node, proxying it to the owner
+func (s *Server) routeSet(req *dht_proto.SetKeyRequest) (*dht_proto.SetKeyResponse, error) {
+	req.Proxy = true
+	return s.SetKey(context.Background(), req)
+}
+
+// routeGet reads a key from this node, proxying it to a node holding it
+func (s *Server) routeGet(req *dht_proto.GetKeyRequest) ([]byte, error) {
+	req.Proxy = true
+	res, err := s.GetKey(context.Background(), req)
+	if err != nil {
+		return nil, err
+	}
+
+	return res.Value, nil
+}
+
+// routeDelete deletes a key from this node, proxying it to the owner
+func (s *Server) routeDelete(req *dht_proto.DeleteKeyRequest) error {
+	req.Proxy = true
+	_, err := s.DeleteKey(context.Background(), req)
+	return err
+}
+
+// currentManifest reads the manifest stored under key, returning nil if there's no object
+// there, and a precondition which only holds while it stays in place
+func (s *Server) currentManifest(namespace string, key string) (*dht_proto.ObjectManifest, *dht_proto.Precondition, error) {
+	// The owner coordinates reads above ONE, so the version isn't a stale replica's
+	res, err := s.GetKey(context.Background(), &dht_proto.GetKeyRequest{
+		Key:         key,
+		Namespace:   namespace,
+		Consistency: dht_proto.Consistency_QUORUM,
+		Proxy:       true,
+	})
+	if status.Code(err) == codes.NotFound {
+		return nil, &dht_proto.Precondition{
+			Condition: &dht_proto.Precondition_IfNotExists{IfNotExists: true},
+		}, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// A plain value is overwritten like any other, it has no chunks to clean up
+	manifest, _ := parseManifest(res.Value)
+	return manifest, &dht_proto.Precondition{
+		Condition: &dht_proto.Precondition_IfVersion{IfVersion: res.Version},
+	}, nil
+}
+
+// deleteChunks deletes the chunks of an upload, returning how many. Chunks of manifests
+// without an upload id may be shared with other objects, so they're left alone. Failures are
+// logged rather than returned, a chunk left behind only costs space.
+func (s *Server) deleteChunks(namespace string, manifest *dht_proto.ObjectManifest) int {
+	if manifest == nil || !internalChunks(manifest) {
+		return 0
+	}
+
+	deleted := 0
+	seen := make(map[string]bool)
+	for _, hash := range manifest.Chunks {
+		key := chunkKey(manifest.Upload, hash)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+
+		err := s.routeDelete(&dht_proto.DeleteKeyRequest{
+			Key:       key,
+			Namespace: namespace,
+			Internal:  true,
+		})
+		if err != nil {
+			fmt.Printf("Error deleting chunk %v: %v\n", key, err)
+			continue
+		}
+		deleted++
+	}
+
+	return deleted
+}
+
+// putObject splits everything read from r into chunks, stores each of them and then the
+// manifest. The manifest is written last, so readers never see an object with missing chunks.
+// The chunks are stored in the namespace of the object, so they count towards its quota. Once
+// the manifest is in place the chunks of the object it replaced are deleted, and if the write
+// fails the chunks stored so far are deleted instead.
+func (s *Server) putObject(namespace string, key string, r io.Reader) (*dht_proto.PutObjectResponse, error) {
+	manifest := &dht_proto.ObjectManifest{
+		Format: OBJECT_FORMAT,
+		Upload: make([]byte, UPLOAD_ID_SIZE),
+	}
+	rand.Read(manifest.Upload)
+
+	res, old, err := s.storeObject(namespace, key, manifest, r)
+	if err != nil {
+		s.deleteChunks(namespace, manifest)
+		return nil, err
+	}
+	s.deleteChunks(namespace, old)
+
+	fmt.Printf("Stored object %v of %v bytes in %v chunks\n", key, manifest.Size, len(manifest.Chunks))
+	return &dht_proto.PutObjectResponse{
+		Version: res.Version,
+		Size:    manifest.Size,
+		Chunks:  int32(len(manifest.Chunks)),
+	}, nil
+}
+
+// storeObject stores the chunks read from r and then the manifest, returning the manifest it
+// replaced. The manifest only replaces the one read beforehand, so that the chunks of a
+// manifest written concurrently aren't deleted while it's still in place.
+func (s *Server) storeObject(namespace string, key string, manifest *dht_proto.ObjectManifest, r io.Reader) (*dht_proto.SetKeyResponse, *dht_proto.ObjectManifest, error) {
+	buf := make([]byte, CHUNK_SIZE)
+	for {
+		n, err := io.ReadFull(r, buf)
+		if err == io.EOF {
+			break
+		}
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return nil, nil, err
+		}
+
+		sum := sha256.Sum256(buf[:n])
+
+		// Added before it's stored, so that it's cleaned up if the write fails part way
+		manifest.Chunks = append(manifest.Chunks, sum[:])
+		_, err = s.routeSet(&dht_proto.SetKeyRequest{
+			Key:       chunkKey(manifest.Upload, sum[:]),
+			Namespace: namespace,
+			Value:     bytes.Clone(buf[:n]),
+			Internal:  true,
+		})
+		if err != nil {
+			return nil, nil, status.Errorf(status.Code(err), "could not store chunk %v: %v", len(manifest.Chunks)-1, err)
+		}
+
+		manifest.Size += int64(n)
+	}
+
+	value, err := proto.Marshal(manifest)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for attempt := 0; attempt < MANIFEST_ATTEMPTS; attempt++ {
+		old, precondition, err := s.currentManifest(namespace, key)
+		if err != nil {
+			return nil, nil, status.Errorf(status.Code(err), "could not read the current manifest: %v", err)
+		}
+
+		res, err := s.routeSet(&dht_proto.SetKeyRequest{
+			Key:          key,
+			Namespace:    namespace,
+			Value:        value,
+			Precondition: precondition,
+		})
+		if status.Code(err) == codes.FailedPrecondition {
+			continue
+		}
+		if err != nil {
+			return nil, nil, status.Errorf(status.Code(err), "could not store manifest: %v", err)
+		}
+
+		return res, old, nil
+	}
+
+	return nil, nil, status.Errorf(codes.Aborted, "the object was replaced %v times while storing its manifest", MANIFEST_ATTEMPTS)
+}
+
+// deleteObject deletes the manifest stored under key and then the chunks it lists
+func (s *Server) deleteObject(namespace string, key string) (int, error) {
+	value, err := s.routeGet(&dht_proto.GetKeyRequest{Key: key, Namespace: namespace})
+	if err != nil {
+		return 0, err
+	}
+
+	manifest, err := parseManifest(value)
+	if err != nil {
+		return 0, status.Error(codes.FailedPrecondition, err.Error())
+	}
+
+	err = s.routeDelete(&dht_proto.DeleteKeyRequest{Key: key, Namespace: namespace})
+	if err != nil {
+		return 0, status.Errorf(status.Code(err), "could not delete manifest: %v", err)
+	}
+
+	return s.deleteChunks(namespace, manifest), nil
+}
+
+// getObject reads the chunks of an object in order, verifying each of them before it's sent
+func (s *Server) getObject(namespace string, key string, send func(data []byte) error) error {
+	value, err := s.routeGet(&dht_proto.GetKeyRequest{Key: key, Namespace: namespace})
+	if err != nil {
+		return err
+	}
+
+	manifest, err := parseManifest(value)
+	if err != nil {
+		return status.Error(codes.FailedPrecondition, err.Error())
+	}
+
+	var size int64
+	for _, hash := range manifest.Chunks {
+		data, err := s.routeGet(&dht_proto.GetKeyRequest{
+			Key:       chunkKey(manifest.Upload, hash),
+			Namespace: namespace,
+			Internal:  internalChunks(manifest),
+		})
+		if err != nil {
+			return status.Errorf(codes.DataLoss, "could not read chunk %v: %v", hex.EncodeToString(hash), err)
+		}
+
+		err = verifyChunk(hash, data)
+		if err != nil {
+			return status.Error(codes.DataLoss, err.Error())
+		}
+
+		err = send(data)
+		if err != nil {
+			return err
+		}
+		size += int64(len(data))
+	}
+
+	if size != manifest.Size {
+		return status.Errorf(codes.DataLoss, "object is %v bytes, expected %v", size, manifest.Size)
+	}
+
+	return nil
+}
+
+// objectReader reads the data of a PutObject stream
+type objectReader struct {
+	stream dht_proto.DHT_PutObjectServer
+	buf    []byte
+}
+
+func (r *objectReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		chunk, err := r.stream.Recv()
+		if err != nil {
+			return 0, err
+		}
+		r.buf = chunk.Data
+	}
+
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+func (s *Server) PutObject(stream dht_proto.DHT_PutObjectServer) error {
+	first, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+	if first.Key == "" {
+		return status.Error(codes.InvalidArgument, "the first message must set the key")
+	}
+
+	fmt.Printf("Received PutObject for %v\n", first.Key)
+	res, err := s.putObject(first.Namespace, first.Key, &objectReader{stream: stream, buf: first.Data})
+	if err != nil {
+		return err
+	}
+
+	return stream.SendAndClose(res)
+}
+
+func (s *Server) GetObject(in *dht_proto.GetObjectRequest, stream dht_proto.DHT_GetObjectServer) error {
+	fmt.Printf("Received GetObject for %v\n", in.Key)
+
+	return s.getObject(in.Namespace, in.Key, func(data []byte) error {
+		return stream.Send(&dht_proto.ObjectChunk{Data: data})
+	})
+}
+
+func (s *Server) DeleteObject(ctx context.Context, in *dht_proto.DeleteObjectRequest) (*dht_proto.DeleteObjectResponse, error) {
+	fmt.Printf("Received DeleteObject for %v\n", in.Key)
+
+	chunks, err := s.deleteObject(in.Namespace, in.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &dht_proto.DeleteObjectResponse{Chunks: int32(chunks)}, nil
+}
@@ -0,0 +1,204 @@
+package dht
+
+import (
+	"bytes"
+	"chord_dht/chord"
+	dht_proto "chord_dht/protos/dht"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+func readObject(s *Server, key string) ([]byte, error) {
+	var buf bytes.Buffer
+	err := s.getObject("", key, func(data []byte) error {
+		_, err := buf.Write(data)
+		return err
+	})
+
+	return buf.Bytes(), err
+}
+
+func TestObjectRoundTrip(t *testing.T) {
+	s := testServer()
+
+	data := make([]byte, CHUNK_SIZE*2+100)
+	rand.Read(data)
+
+	res, err := s.putObject("", "video", bytes.NewReader(data))
+	assert.Nil(t, err)
+	assert.Equal(t, int32(3), res.Chunks)
+	assert.Equal(t, int64(len(data)), res.Size)
+
+	read, err := readObject(s, "video")
+	assert.Nil(t, err)
+	assert.Equal(t, data, read)
+}
+
+func TestObjectEmpty(t *testing.T) {
+	s := testServer()
+
+	res, err := s.putObject("", "empty", bytes.NewReader(nil))
+	assert.Nil(t, err)
+	assert.Equal(t, int32(0), res.Chunks)
+
+	read, err := readObject(s, "empty")
+	assert.Nil(t, err)
+	assert.Empty(t, read)
+}
+
+func TestObjectChunksAreDeduplicated(t *testing.T) {
+	s := testServer()
+
+	data := bytes.Repeat([]byte("a"), CHUNK_SIZE*2)
+	s.putObject("", "repeated", bytes.NewReader(data))
+
+	// Two identical chunks and the manifest
+	assert.Equal(t, 2, s.keystore.Len())
+}
+
+func TestObjectDetectsCorruptChunk(t *testing.T) {
+	s := testServer()
+	s.putObject("", "doc", bytes.NewReader([]byte("hello world")))
+
+	value, _, _ := s.keystore.GetVersionedKey("doc")
+	manifest, err := parseManifest(value)
+	assert.Nil(t, err)
+
+	s.keystore.SetExpiringKey(internalKey("", chunkKey(manifest.Upload, manifest.Chunks[0])), []byte("jello world"), newVersion(), time.Time{})
+
+	_, err = readObject(s, "doc")
+	assert.Equal(t, codes.DataLoss, status.Code(err))
+}
+
+func TestObjectRejectsPlainValue(t *testing.T) {
+	s := testServer()
+	s.keystore.SetExpiringKey("plain", []byte("not an object"), newVersion(), time.Time{})
+
+	_, err := readObject(s, "plain")
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+}
+
+// liveChunks counts the chunks which haven't been deleted, legacy ones included
+func liveChunks(s *Server) int {
+	count := 0
+	s.keystore.Range(chord.KeyRange{}, func(v Entry) bool {
+		_, key := splitKey(v.Key)
+		if strings.HasPrefix(strings.TrimPrefix(key, NAMESPACE_SEPARATOR), CHUNK_PREFIX) && !v.Deleted {
+			count++
+		}
+		return true
+	})
+
+	return count
+}
+
+func TestObjectOverwriteDeletesOldChunks(t *testing.T) {
+	s := testServer()
+
+	_, err := s.putObject("", "doc", bytes.NewReader([]byte("first")))
+	assert.Nil(t, err)
+	_, err = s.putObject("", "doc", bytes.NewReader([]byte("second")))
+	assert.Nil(t, err)
+
+	assert.Equal(t, 1, liveChunks(s))
+	read, err := readObject(s, "doc")
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("second"), read)
+}
+
+func TestObjectDelete(t *testing.T) {
+	s := testServer()
+
+	data := make([]byte, CHUNK_SIZE+100)
+	rand.Read(data)
+	s.putObject("", "video", bytes.NewReader(data))
+
+	// An object with the same content has chunks of its own, so deleting one leaves the other
+	s.putObject("", "copy", bytes.NewReader(data))
+
+	chunks, err := s.deleteObject("", "video")
+	assert.Nil(t, err)
+	assert.Equal(t, 2, chunks)
+	assert.Equal(t, 2, liveChunks(s))
+
+	_, err = readObject(s, "video")
+	assert.Equal(t, codes.NotFound, status.Code(err))
+	read, err := readObject(s, "copy")
+	assert.Nil(t, err)
+	assert.Equal(t, data, read)
+
+	s.keystore.SetExpiringKey("plain", []byte("not an object"), newVersion(), time.Time{})
+	_, err = s.deleteObject("", "plain")
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+	assert.True(t, s.keystore.HasKey("plain"))
+}
+
+func TestObjectLegacyChunksAreKept(t *testing.T) {
+	s := testServer()
+
+	// Chunks written before uploads had ids may be shared between objects
+	hash := sha256.Sum256([]byte("shared"))
+	s.keystore.SetExpiringKey(chunkKey(nil, hash[:]), []byte("shared"), newVersion(), time.Time{})
+	manifest, _ := proto.Marshal(&dht_proto.ObjectManifest{
+		Format: OBJECT_FORMAT,
+		Size:   6,
+		Chunks: [][]byte{hash[:]},
+	})
+	s.keystore.SetExpiringKey("old", manifest, newVersion(), time.Time{})
+
+	read, err := readObject(s, "old")
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("shared"), read)
+
+	chunks, err := s.deleteObject("", "old")
+	assert.Nil(t, err)
+	assert.Zero(t, chunks)
+	assert.Equal(t, 1, liveChunks(s))
+}
+
+func TestObjectChunksAreInternal(t *testing.T) {
+	s := testServer()
+	address := serveDHT(t, s)
+	watch := s.watches.add("team-a", "", true, chord.KeyRange{})
+	_, err := s.putObject("team-a", "doc", bytes.NewReader([]byte("hello world")))
+	assert.Nil(t, err)
+	assert.Len(t, watch.events, 1, "only the manifest is reported to watches")
+
+	value, _, _ := s.keystore.GetVersionedKey(scopedKey("team-a", "doc"))
+	manifest, err := parseManifest(value)
+	assert.Nil(t, err)
+	key := chunkKey(manifest.Upload, manifest.Chunks[0])
+	assert.True(t, s.keystore.HasKey(internalKey("team-a", key)))
+
+	// A client addressing the chunk by its key reaches a plain key of its own
+	_, err = SetKeyIn(address, "team-a", key, []byte("jello world"))
+	assert.Nil(t, err)
+	assert.Nil(t, DeleteKeyIn(address, "team-a", key))
+
+	// and can't ask for the internal key
+	client, err := getClient(address)
+	assert.Nil(t, err)
+	_, err = client.DeleteKey(context.Background(), &dht_proto.DeleteKeyRequest{
+		Key:       key,
+		Namespace: "team-a",
+		Internal:  true,
+	})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	var buf bytes.Buffer
+	err = s.getObject("team-a", "doc", func(data []byte) error {
+		_, err := buf.Write(data)
+		return err
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("hello world"), buf.Bytes())
+}
@@ -0,0 +1,95 @@
+package dht
+
+import (
+	dht_proto "chord_dht/protos/dht"
+	"context"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// The number of times replaceKey reads a key again after it changed before the write landed
+const REPLACE_ATTEMPTS = 5
+
+// In proxy mode the node receiving a request follows redirections to the owner itself, so
+// clients only need to reach a single node, e.g. behind a load balancer. The response carries
+// the length of the lookup and the addresses the request was forwarded to. Forwarded requests
+// carry the identifier of the node, so the owner accepts internal keys from it.
+
+// proxyGetKey forwards a read to address, the node a redirect would have sent the client to
+func (s *Server) proxyGetKey(in *dht_proto.GetKeyRequest, address string, pathLength int) (*dht_proto.GetKeyResponse, error) {
+	req := proto.Clone(in).(*dht_proto.GetKeyRequest)
+	req.Proxy = false
+
+	res, path, err := getKeyVia(senderContext(context.Background(), s.node.Identifier()), address, req)
+	if err != nil {
+		return nil, err
+	}
+
+	res.PathLength = int32(pathLength)
+	res.Path = path
+	return res, nil
+}
+
+// proxySetKey forwards a write to address, the node a redirect would have sent the client to
+func (s *Server) proxySetKey(in *dht_proto.SetKeyRequest, address string, pathLength int) (*dht_proto.SetKeyResponse, error) {
+	req := proto.Clone(in).(*dht_proto.SetKeyRequest)
+	req.Proxy = false
+
+	res, path, err := setKeyVia(senderContext(context.Background(), s.node.Identifier()), address, req)
+	if err != nil {
+		return nil, err
+	}
+
+	res.PathLength = int32(pathLength)
+	res.Path = path
+	return res, nil
+}
+
+// proxyDeleteKey forwards a delete to address, the node a redirect would have sent the client to
+func (s *Server) proxyDeleteKey(in *dht_proto.DeleteKeyRequest, address string, pathLength int) (*dht_proto.DeleteKeyResponse, error) {
+	req := proto.Clone(in).(*dht_proto.DeleteKeyRequest)
+	req.Proxy = false
+
+	res, path, err := deleteKeyVia(senderContext(context.Background(), s.node.Identifier()), address, req)
+	if err != nil {
+		return nil, err
+	}
+
+	res.PathLength = int32(pathLength)
+	res.Path = path
+	return res, nil
+}
+
+// replaceKey writes req over the current version of an existing key, proxied to its owner.
+// update is called with the current value to finish the request, and the key is read again if
+// it changes before the write lands. Returns a NotFound error if the key doesn't exist.
+func (s *Server) replaceKey(req *dht_proto.SetKeyRequest, update func(current *dht_proto.GetKeyResponse)) (*dht_proto.SetKeyResponse, error) {
+	for attempt := 0; attempt < REPLACE_ATTEMPTS; attempt++ {
+		// The owner coordinates reads above ONE, so the version isn't a stale replica's
+		current, err := s.GetKey(context.Background(), &dht_proto.GetKeyRequest{
+			Key:         req.Key,
+			Namespace:   req.Namespace,
+			Consistency: dht_proto.Consistency_QUORUM,
+			Proxy:       true,
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		if update != nil {
+			update(current)
+		}
+		req.Precondition = &dht_proto.Precondition{
+			Condition: &dht_proto.Precondition_IfVersion{IfVersion: current.Version},
+		}
+
+		res, err := s.SetKey(context.Background(), req)
+		if status.Code(err) != codes.FailedPrecondition {
+			return res, err
+		}
+	}
+
+	return nil, status.Error(codes.Aborted, "the key changed too often to be replaced, try again")
+}
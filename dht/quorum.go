@@ -0,0 +1,229 @@
+package dht
+
+import (
+	"chord_dht/chord"
+	dht_proto "chord_dht/protos/dht"
+	"fmt"
+	"math/rand"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// The chance that a read of ONE answered by the owner compares the key's replicas with its own
+// copy in the background, repairing any which are stale
+const READ_REPAIR_CHANCE = 0.1
+
+// requiredReplicas returns the number of replicas, including the owner, which must take part in
+// an operation for the consistency level to be met. When the ring is smaller than the replication
+// factor, ALL and QUORUM are measured against the replicas that actually exist.
+func (s *Server) requiredReplicas(c dht_proto.Consistency) int {
+	n := min(s.replicationFactor, len(s.replicaTargets())+1)
+
+	switch c {
+	case dht_proto.Consistency_QUORUM:
+		return n/2 + 1
+	case dht_proto.Consistency_ALL:
+		return n
+	}
+
+	return 1
+}
+
+// replicateWrite sends a write or delete to every replica and waits for acks of them to
+// acknowledge it, the remaining replicas are updated in the background
+func (s *Server) replicateWrite(entry *dht_proto.Entry, acks int) error {
+	targets := s.replicaTargets()
+
+	results := make(chan error, len(targets))
+	for _, p := range targets {
+		go func(p chord.Peer) {
+			err := replicateKey(dhtAddress(p), s.node.Identifier(), entry)
+			if err != nil {
+				fmt.Printf("error replicating key %v to %v: %v\n", entry.Key, p.Id, err)
+			}
+			results <- err
+		}(p)
+	}
+
+	received := 0
+	for i := 0; i < len(targets) && received < acks; i++ {
+		if err := <-results; err == nil {
+			received++
+		}
+	}
+
+	if received < acks {
+		return fmt.Errorf("only %v of %v replicas acknowledged the write", received, acks)
+	}
+
+	return nil
+}
+
+// replicaRead is the copy of a key held by one replica, res is nil if it has no copy
+type replicaRead struct {
+	peer chord.Peer
+	res  *dht_proto.GetKeyResponse
+	err  error
+}
+
+// readReplicas reads the key from each of the targets in parallel, sending each result on the
+// returned channel as it arrives
+func readReplicas(key string, targets []chord.Peer) <-chan replicaRead {
+	results := make(chan replicaRead, len(targets))
+	for _, p := range targets {
+		go func(p chord.Peer) {
+			res, err := readReplica(dhtAddress(p), key)
+			if status.Code(err) == codes.NotFound {
+				res, err = nil, nil
+			}
+			results <- replicaRead{p, res, err}
+		}(p)
+	}
+
+	return results
+}
+
+// localCopy returns the node's own copy of a key as a read would see it, nil if it has none
+func (s *Server) localCopy(key string) *dht_proto.GetKeyResponse {
+	entry, ok := s.keystore.Lookup(key)
+	if !ok {
+		return nil
+	}
+
+	return &dht_proto.GetKeyResponse{
+		Value:   entry.Value,
+		Version: entry.Version,
+		Deleted: entry.Deleted,
+		Expires: serializeExpiry(entry.Expires),
+	}
+}
+
+// quorumRead reads the key from enough replicas to meet the consistency level and returns the
+// newest value among them. Replicas which turn out to hold an older copy are repaired in the
+// background.
+func (s *Server) quorumRead(key string, c dht_proto.Consistency) (*dht_proto.GetKeyResponse, error) {
+	targets := s.replicaTargets()
+	needed := s.requiredReplicas(c)
+
+	results := readReplicas(key, targets)
+	local := s.localCopy(key)
+
+	newest := local
+	var reads []replicaRead
+	for i := 0; i < len(targets) && len(reads)+1 < needed; i++ {
+		r := <-results
+		if r.err != nil {
+			continue
+		}
+
+		reads = append(reads, r)
+		if isNewer(r.res, newest) {
+			newest = r.res
+		}
+	}
+
+	responses := len(reads) + 1
+	if responses < needed {
+		msg := fmt.Sprintf("only %v of %v replicas responded", responses, needed)
+		return nil, status.Error(codes.Unavailable, msg)
+	}
+
+	// Replicas which haven't answered yet are still checked, they just aren't waited for
+	go s.readRepair(key, newest, local, reads, results, len(targets)-len(reads))
+
+	// A tombstone newer than every copy means the key has been deleted
+	if newest == nil || newest.Deleted {
+		return nil, status.Error(codes.NotFound, "no replica has this key")
+	}
+
+	return &dht_proto.GetKeyResponse{
+		Value:   newest.Value,
+		Version: newest.Version,
+	}, nil
+}
+
+// isNewer returns if a replica's copy of a key is newer than another, either may be missing
+func isNewer(res, than *dht_proto.GetKeyResponse) bool {
+	if res == nil {
+		return false
+	}
+
+	// A copy from too far in the future can't be trusted, and would be refused by the store anyway
+	if versionClock.Observe(res.Version) != nil {
+		return false
+	}
+
+	return than == nil || NewerThan(res.Version, res.Value, than.Version, than.Value)
+}
+
+// readRepair brings the local copy and any replica holding an older copy of the key up to date
+// with the newest copy found by a read. pending more results are still to arrive on results.
+func (s *Server) readRepair(key string, newest, local *dht_proto.GetKeyResponse, reads []replicaRead, results <-chan replicaRead, pending int) {
+	for ; pending > 0; pending-- {
+		r := <-results
+		if r.err == nil {
+			reads = append(reads, r)
+		}
+	}
+
+	// Another replica may hold something newer still, it's only found by a later read
+	for _, r := range reads {
+		if isNewer(r.res, newest) {
+			newest = r.res
+		}
+	}
+
+	if newest == nil {
+		return
+	}
+
+	entry := &dht_proto.Entry{
+		Key:     key,
+		Value:   newest.Value,
+		Version: newest.Version,
+		Deleted: newest.Deleted,
+		Expires: newest.Expires,
+	}
+
+	if isNewer(newest, local) {
+		if s.keystore.Apply(key, entry.Value, entry.Version, parseExpiry(entry.Expires), entry.Deleted) {
+			promReadRepairsTotal.Inc()
+		}
+	}
+
+	for _, r := range reads {
+		if !isNewer(newest, r.res) {
+			continue
+		}
+
+		fmt.Printf("Repairing stale copy of %v on %v\n", key, r.peer.Id)
+		err := replicateKey(dhtAddress(r.peer), s.node.Identifier(), entry)
+		if err != nil {
+			fmt.Printf("error repairing key %v on %v: %v\n", key, r.peer.Id, err)
+			continue
+		}
+		promReadRepairsTotal.Inc()
+	}
+}
+
+// checkReplicas compares the copy of a key held by each replica with the owner's, repairing
+// whichever are stale. It runs in the background after a read of ONE, which otherwise never
+// looks at the replicas.
+func (s *Server) checkReplicas(key string) {
+	targets := s.replicaTargets()
+	if len(targets) == 0 {
+		return
+	}
+
+	local := s.localCopy(key)
+	s.readRepair(key, local, local, nil, readReplicas(key, targets), len(targets))
+}
+
+// sampleReplicas checks the replicas of a key read by the owner with a consistency of ONE, for
+// READ_REPAIR_CHANCE of reads
+func (s *Server) sampleReplicas(key string) {
+	if s.replicationFactor > 1 && rand.Float64() < READ_REPAIR_CHANCE {
+		go s.checkReplicas(key)
+	}
+}
@@ -0,0 +1,91 @@
+package dht
+
+import (
+	"chord_dht/chord"
+	dht_proto "chord_dht/protos/dht"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRequiredReplicasSingleNode(t *testing.T) {
+	s := &Server{node: chord.CreateNode(1), replicationFactor: 3}
+
+	assert.Equal(t, 1, s.requiredReplicas(dht_proto.Consistency_ONE))
+	assert.Equal(t, 1, s.requiredReplicas(dht_proto.Consistency_QUORUM))
+	assert.Equal(t, 1, s.requiredReplicas(dht_proto.Consistency_ALL))
+}
+
+func TestRequiredReplicasLimitedBySuccessors(t *testing.T) {
+	a := chord.CreateNode(1)
+	a.Join(chord.CreateNode(2))
+	s := &Server{node: a, replicationFactor: 3}
+
+	assert.Equal(t, 1, s.requiredReplicas(dht_proto.Consistency_ONE))
+	assert.Equal(t, 2, s.requiredReplicas(dht_proto.Consistency_QUORUM))
+	assert.Equal(t, 2, s.requiredReplicas(dht_proto.Consistency_ALL))
+}
+
+func TestIsNewer(t *testing.T) {
+	old := &dht_proto.GetKeyResponse{Version: 1}
+	new := &dht_proto.GetKeyResponse{Version: 2}
+
+	assert.True(t, isNewer(new, old))
+	assert.False(t, isNewer(old, new))
+	assert.True(t, isNewer(old, nil), "any copy is newer than a missing one")
+	assert.False(t, isNewer(nil, old))
+}
+
+func TestReadRepairUpdatesLocalCopy(t *testing.T) {
+	s := testServer()
+	s.replicationFactor = 3
+	s.keystore.SetExpiringKey("test", []byte("old"), 1, time.Time{})
+
+	local := &dht_proto.GetKeyResponse{Value: []byte("old"), Version: 1}
+	newest := &dht_proto.GetKeyResponse{Value: []byte("new"), Version: 2}
+	s.readRepair("test", newest, local, nil, nil, 0)
+
+	value, version, _ := s.keystore.GetVersionedKey("test")
+	assert.Equal(t, []byte("new"), value)
+	assert.Equal(t, uint64(2), version)
+}
+
+func TestReadRepairFindsMissingCopy(t *testing.T) {
+	s := testServer()
+	s.replicationFactor = 3
+
+	// Neither the read nor the local store found a copy, but a replica answering later has one
+	results := make(chan replicaRead, 2)
+	results <- replicaRead{}
+	results <- replicaRead{res: &dht_proto.GetKeyResponse{Value: []byte("found"), Version: 2}}
+	s.readRepair("test", nil, nil, nil, results, 2)
+
+	value, _, _ := s.keystore.GetVersionedKey("test")
+	assert.Equal(t, []byte("found"), value)
+}
+
+func TestCheckReplicasWithoutReplicas(t *testing.T) {
+	s := testServer()
+	s.replicationFactor = 3
+	s.keystore.SetExpiringKey("test", []byte("value"), 1, time.Time{})
+
+	// A single node has nothing to compare with
+	s.checkReplicas("test")
+
+	value, _, _ := s.keystore.GetVersionedKey("test")
+	assert.Equal(t, []byte("value"), value)
+}
+
+func TestReadRepairWaitsForLateReplicas(t *testing.T) {
+	s := testServer()
+	s.replicationFactor = 3
+
+	// A replica answering after the read returned can still hold the newest copy
+	results := make(chan replicaRead, 1)
+	results <- replicaRead{res: &dht_proto.GetKeyResponse{Value: []byte("late"), Version: 3}}
+	s.readRepair("test", &dht_proto.GetKeyResponse{Value: []byte("new"), Version: 2}, nil, nil, results, 1)
+
+	value, _, _ := s.keystore.GetVersionedKey("test")
+	assert.Equal(t, []byte("late"), value)
+}
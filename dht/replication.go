@@ -0,0 +1,182 @@
+package dht
+
+import (
+	"chord_dht/chord"
+	"fmt"
+	"sort"
+)
+
+// replicaTargets returns the distinct successors which should hold copies of the keys we own,
+// at most ReplicationFactor-1 of them
+func (s *Server) replicaTargets() []chord.Peer {
+	list, _ := s.node.SuccessorList()
+	return firstReplicas(s.node.Identifier(), list.Peers(), s.replicationFactor-1)
+}
+
+// firstReplicas picks the first n distinct peers from a successor list, skipping the owner
+func firstReplicas(owner chord.Id, successors []chord.Peer, n int) []chord.Peer {
+	seen := map[chord.Id]bool{owner: true}
+
+	var replicas []chord.Peer
+	for _, p := range successors {
+		if len(replicas) >= n {
+			break
+		}
+		if seen[p.Id] {
+			continue
+		}
+		seen[p.Id] = true
+		replicas = append(replicas, p)
+	}
+
+	return replicas
+}
+
+// replicateRange copies every entry we hold within r to the given peers
+func (s *Server) replicateRange(r chord.KeyRange, peers []chord.Peer) {
+	entries := entriesInRange(s.keystore, r)
+	if len(entries) == 0 || len(peers) == 0 {
+		return
+	}
+
+	s.replicateEntries(entries, peers)
+}
+
+// watchSuccessors re-replicates the owned range whenever a new node enters the replica set,
+// for example after a replica fails or a new node joins just after us
+func (s *Server) watchSuccessors() {
+	defer s.wg.Done()
+
+	events, cancel := s.node.Subscribe()
+	defer cancel()
+
+	current := s.replicaTargets()
+	for {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+			if event.Type != chord.SuccessorListChanged {
+				continue
+			}
+
+			targets := s.replicaTargets()
+			added := peersNotIn(targets, current)
+			current = targets
+
+			go s.replicateRange(s.node.OwnedRange(), added)
+			s.updateReplicaMetrics()
+
+		case <-s.shutdown:
+			return
+		}
+	}
+}
+
+func peersNotIn(peers, existing []chord.Peer) []chord.Peer {
+	known := make(map[chord.Id]bool)
+	for _, p := range existing {
+		known[p.Id] = true
+	}
+
+	var res []chord.Peer
+	for _, p := range peers {
+		if !known[p.Id] {
+			res = append(res, p)
+		}
+	}
+
+	return res
+}
+
+// CheckKeys scans for keys the node should no longer hold. Keys outside of the owned range are
+// kept while the node is one of their owner's replicas, otherwise they are pushed to the owner
+// and dropped.
+func (s *Server) CheckKeys() {
+	defer s.updateReplicaMetrics()
+
+	owned := s.node.OwnedRange()
+	if owned.Start == owned.End {
+		// Single node ring, everything is ours
+		return
+	}
+
+	// Everything after us up to and including the predecessor belongs elsewhere
+	misplaced := entriesInRange(s.keystore, chord.KeyRange{Start: owned.End, End: owned.Start})
+	sort.Slice(misplaced, func(i, j int) bool {
+		return misplaced[i].Id < misplaced[j].Id
+	})
+
+	// Neighbouring keys usually share an owner, so only look the owner up once per range
+	pending := make(map[string][]Entry)
+	var covered *chord.KeyRange
+	var keep bool
+	var ownerAddr string
+	for _, v := range misplaced {
+		if covered == nil || !covered.Contains(v.Id) {
+			owner, _, err := s.node.FindSuccessor(v.Id, 0)
+			if err != nil {
+				fmt.Printf("key check failed, could not find owner of %v: %v\n", v.Id, err)
+				break
+			}
+
+			pred, err := owner.Predecessor()
+			if err != nil {
+				fmt.Printf("key check failed, owner %v has no predecessor: %v\n", owner, err)
+				break
+			}
+
+			covered = &chord.KeyRange{Start: pred.Identifier(), End: owner.Identifier()}
+			ownerAddr = ""
+			if chord.GetNodeAddress(owner) != "" {
+				ownerAddr = dhtAddress(chord.PeerOf(owner))
+			}
+
+			keep = false
+			if s.replicationFactor > 1 && ownerAddr != "" {
+				list, err := owner.SuccessorList()
+				keep = err == nil && s.isReplicaOf(owner.Identifier(), list.Peers())
+			}
+		}
+
+		if keep || ownerAddr == "" {
+			continue
+		}
+
+		pending[ownerAddr] = append(pending[ownerAddr], v)
+	}
+
+	// Each owner gets its keys in a single stream
+	for addr, entries := range pending {
+		fmt.Printf("Transferring %v keys to %v\n", len(entries), addr)
+		err := s.transferEntries(addr, entries, true)
+		if err != nil {
+			fmt.Printf("error transferring keys to %v: %v\n", addr, err)
+		}
+	}
+}
+
+// isReplicaOf returns if we are within the first ReplicationFactor-1 successors of the owner
+func (s *Server) isReplicaOf(owner chord.Id, successors []chord.Peer) bool {
+	for _, p := range firstReplicas(owner, successors, s.replicationFactor-1) {
+		if p.Id == s.node.Identifier() {
+			return true
+		}
+	}
+
+	return false
+}
+
+// updateReplicaMetrics counts how many of the stored keys are owned and how many are replicas
+func (s *Server) updateReplicaMetrics() {
+	primaries := 0
+	s.keystore.Range(s.node.OwnedRange(), func(Entry) bool {
+		primaries++
+		return true
+	})
+	total := s.keystore.Len()
+
+	s.primaryGauge.Set(float64(primaries))
+	s.replicaGauge.Set(float64(total - primaries))
+}
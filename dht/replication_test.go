@@ -0,0 +1,32 @@
+package dht
+
+import (
+	"chord_dht/chord"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFirstReplicasSkipsOwnerAndDuplicates(t *testing.T) {
+	successors := []chord.Peer{
+		{Id: 5}, {Id: 5}, {Id: 1}, {Id: 9}, {Id: 12},
+	}
+
+	replicas := firstReplicas(1, successors, 2)
+
+	assert.Equal(t, []chord.Peer{{Id: 5}, {Id: 9}}, replicas)
+}
+
+func TestFirstReplicasShortList(t *testing.T) {
+	successors := []chord.Peer{{Id: 5}}
+
+	assert.Len(t, firstReplicas(1, successors, 2), 1)
+	assert.Len(t, firstReplicas(1, successors, 0), 0)
+}
+
+func TestPeersNotIn(t *testing.T) {
+	current := []chord.Peer{{Id: 1}, {Id: 2}}
+	targets := []chord.Peer{{Id: 2}, {Id: 3}}
+
+	assert.Equal(t, []chord.Peer{{Id: 3}}, peersNotIn(targets, current))
+}
@@ -0,0 +1,468 @@
+package dht
+
+import (
+	"bufio"
+	dht_proto "chord_dht/protos/dht"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// The DHT can be used as a Redis cache through a subset of the Redis protocol, RESP. GET, SET
+// with EX, NX and XX, DEL, EXISTS, MGET, MSET and PING are served, every key in the default
+// namespace and forwarded to its owner like any other request. Inline commands are accepted
+// too, so the listener can be poked with telnet.
+
+// The largest bulk string accepted from a client, as for the HTTP gateway
+const RESP_MAX_BULK = GATEWAY_MAX_VALUE
+
+// The most arguments accepted in a command, enough for an MSET of a full batch
+const RESP_MAX_ARGS = 2*MAX_BATCH_KEYS + 1
+
+// errRESPProtocol is returned for input which isn't valid RESP, the connection is closed
+var errRESPProtocol = errors.New("Protocol error")
+
+// errLineTooLong is returned for a line which doesn't fit in the read buffer
+var errLineTooLong = errors.New("line too long")
+
+// ServeRESP serves Redis clients connecting to lis until the server is stopped
+func (s *Server) ServeRESP(lis net.Listener) error {
+	log.Printf("RESP server listening at %v", lis.Addr())
+
+	go func() {
+		<-s.shutdown
+		lis.Close()
+	}()
+
+	for {
+		conn, err := lis.Accept()
+		if err != nil {
+			select {
+			case <-s.shutdown:
+				return nil
+			default:
+				return err
+			}
+		}
+
+		go s.serveRESPConn(conn)
+	}
+}
+
+func (s *Server) serveRESPConn(conn net.Conn) {
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+	w := respWriter{bufio.NewWriter(conn)}
+
+	for {
+		args, err := readRESPCommand(r)
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			w.writeError(fmt.Sprintf("ERR %v", err))
+			w.Flush()
+			return
+		}
+		if len(args) == 0 {
+			continue
+		}
+
+		quit := s.respCommand(w, args)
+
+		// Replies to pipelined commands are sent together once the pipeline is drained
+		if r.Buffered() == 0 || quit {
+			if w.Flush() != nil || quit {
+				return
+			}
+		}
+	}
+}
+
+// readRESPCommand reads a command sent as an array of bulk strings, or inline as a line of
+// words separated by spaces
+func readRESPCommand(r *bufio.Reader) ([][]byte, error) {
+	line, err := readTextLine(r)
+	if err == errLineTooLong {
+		return nil, fmt.Errorf("%w: %v", errRESPProtocol, err)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if len(line) == 0 || line[0] != '*' {
+		var args [][]byte
+		for _, field := range strings.Fields(string(line)) {
+			args = append(args, []byte(field))
+		}
+		return args, nil
+	}
+
+	n, err := strconv.Atoi(string(line[1:]))
+	if err != nil || n > RESP_MAX_ARGS {
+		return nil, fmt.Errorf("%w: invalid multibulk length", errRESPProtocol)
+	}
+
+	args := make([][]byte, 0, max(n, 0))
+	for i := 0; i < n; i++ {
+		line, err := readTextLine(r)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(line) == 0 || line[0] != '$' {
+			return nil, fmt.Errorf("%w: expected '$', got '%s'", errRESPProtocol, line)
+		}
+
+		size, err := strconv.Atoi(string(line[1:]))
+		if err != nil || size < 0 || size > RESP_MAX_BULK {
+			return nil, fmt.Errorf("%w: invalid bulk length", errRESPProtocol)
+		}
+
+		arg := make([]byte, size+2)
+		_, err = io.ReadFull(r, arg)
+		if err != nil {
+			return nil, err
+		}
+		if arg[size] != '\r' || arg[size+1] != '\n' {
+			return nil, fmt.Errorf("%w: bulk string isn't terminated by CRLF", errRESPProtocol)
+		}
+
+		args = append(args, arg[:size])
+	}
+
+	return args, nil
+}
+
+// readTextLine reads a line terminated by CRLF, or a bare LF as sent by hand
+func readTextLine(r *bufio.Reader) ([]byte, error) {
+	line, err := r.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		return nil, errLineTooLong
+	}
+	if err != nil {
+		if err == io.EOF && len(line) > 0 {
+			return nil, io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+
+	line = line[:len(line)-1]
+	if len(line) > 0 && line[len(line)-1] == '\r' {
+		line = line[:len(line)-1]
+	}
+
+	return line, nil
+}
+
+// respWriter writes RESP replies
+type respWriter struct {
+	*bufio.Writer
+}
+
+func (w respWriter) writeSimple(s string) {
+	w.WriteString("+" + s + "\r\n")
+}
+
+// writeError writes an error reply, starting with an error code such as ERR
+func (w respWriter) writeError(msg string) {
+	msg = strings.NewReplacer("\r", " ", "\n", " ").Replace(msg)
+	w.WriteString("-" + msg + "\r\n")
+}
+
+func (w respWriter) writeInt(n int64) {
+	w.WriteString(":" + strconv.FormatInt(n, 10) + "\r\n")
+}
+
+// writeBulk writes a bulk string, or the null bulk string if b is nil
+func (w respWriter) writeBulk(b []byte) {
+	if b == nil {
+		w.WriteString("$-1\r\n")
+		return
+	}
+
+	w.WriteString("$" + strconv.Itoa(len(b)) + "\r\n")
+	w.Write(b)
+	w.WriteString("\r\n")
+}
+
+func (w respWriter) writeArray(n int) {
+	w.WriteString("*" + strconv.Itoa(n) + "\r\n")
+}
+
+// writeStatus writes the error reply for a failed request
+func (w respWriter) writeStatus(err error) {
+	st := status.Convert(err)
+	if st.Code() == codes.ResourceExhausted {
+		w.writeError("OOM " + st.Message())
+		return
+	}
+
+	w.writeError("ERR " + st.Message())
+}
+
+func (w respWriter) writeArity(command string) {
+	w.writeError(fmt.Sprintf("ERR wrong number of arguments for '%v' command", strings.ToLower(command)))
+}
+
+// respCommand runs a command and writes its reply, returning if the connection should close
+func (s *Server) respCommand(w respWriter, args [][]byte) bool {
+	command := strings.ToUpper(string(args[0]))
+
+	switch command {
+	case "PING":
+		switch len(args) {
+		case 1:
+			w.writeSimple("PONG")
+		case 2:
+			w.writeBulk(args[1])
+		default:
+			w.writeArity(command)
+		}
+
+	case "QUIT":
+		w.writeSimple("OK")
+		return true
+
+	case "GET":
+		if len(args) != 2 {
+			w.writeArity(command)
+			break
+		}
+		s.respGet(w, string(args[1]))
+
+	case "SET":
+		if len(args) < 3 {
+			w.writeArity(command)
+			break
+		}
+		s.respSet(w, args[1:])
+
+	case "DEL", "EXISTS":
+		if len(args) < 2 {
+			w.writeArity(command)
+			break
+		}
+		s.respCount(w, command == "DEL", respStrings(args[1:]))
+
+	case "MGET":
+		if len(args) < 2 {
+			w.writeArity(command)
+			break
+		}
+		s.respMGet(w, respStrings(args[1:]))
+
+	case "MSET":
+		if len(args) < 3 || len(args)%2 != 1 {
+			w.writeArity(command)
+			break
+		}
+		s.respMSet(w, args[1:])
+
+	default:
+		w.writeError(fmt.Sprintf("ERR unknown command '%s'", args[0]))
+	}
+
+	return false
+}
+
+func respStrings(args [][]byte) []string {
+	res := make([]string, len(args))
+	for i, arg := range args {
+		res[i] = string(arg)
+	}
+
+	return res
+}
+
+func (s *Server) respGet(w respWriter, key string) {
+	res, err := s.GetKey(context.Background(), &dht_proto.GetKeyRequest{
+		Key:   key,
+		Proxy: true,
+	})
+	if status.Code(err) == codes.NotFound {
+		w.writeBulk(nil)
+		return
+	}
+	if err != nil {
+		w.writeStatus(err)
+		return
+	}
+
+	// An empty value is still a value, not the null bulk string
+	if res.Value == nil {
+		res.Value = []byte{}
+	}
+	w.writeBulk(res.Value)
+}
+
+// respSet serves SET key value [EX seconds] [NX|XX]. A write which doesn't go ahead because of
+// NX or XX replies with the null bulk string.
+func (s *Server) respSet(w respWriter, args [][]byte) {
+	req := &dht_proto.SetKeyRequest{
+		Key:   string(args[0]),
+		Value: args[1],
+		Proxy: true,
+	}
+
+	var nx, xx bool
+	for i := 2; i < len(args); i++ {
+		switch strings.ToUpper(string(args[i])) {
+		case "NX":
+			nx = true
+		case "XX":
+			xx = true
+		case "EX":
+			i++
+			if i == len(args) {
+				w.writeError("ERR syntax error")
+				return
+			}
+
+			ttl, err := strconv.ParseInt(string(args[i]), 10, 64)
+			if err != nil || ttl <= 0 {
+				w.writeError("ERR invalid expire time in 'set' command")
+				return
+			}
+			req.TtlSeconds = ttl
+		default:
+			w.writeError("ERR syntax error")
+			return
+		}
+	}
+
+	if nx && xx {
+		w.writeError("ERR syntax error")
+		return
+	}
+
+	var err error
+	if xx {
+		_, err = s.replaceKey(req, nil)
+	} else {
+		if nx {
+			req.Precondition = &dht_proto.Precondition{
+				Condition: &dht_proto.Precondition_IfNotExists{IfNotExists: true},
+			}
+		}
+		_, err = s.SetKey(context.Background(), req)
+	}
+
+	if (xx && status.Code(err) == codes.NotFound) || (nx && status.Code(err) == codes.FailedPrecondition) {
+		w.writeBulk(nil)
+		return
+	}
+	if err != nil {
+		w.writeStatus(err)
+		return
+	}
+
+	w.writeSimple("OK")
+}
+
+// batchValues reads keys with BatchGet, returning the value of each key or nil if it's missing
+func (s *Server) batchValues(keys []string) ([][]byte, error) {
+	res, err := s.BatchGet(context.Background(), &dht_proto.BatchGetRequest{Keys: keys})
+	if err != nil {
+		return nil, err
+	}
+
+	values := make([][]byte, len(keys))
+	for i, result := range res.Results {
+		switch codes.Code(result.Code) {
+		case codes.OK:
+			values[i] = result.Value
+			if values[i] == nil {
+				values[i] = []byte{}
+			}
+		case codes.NotFound:
+		default:
+			return nil, status.Errorf(codes.Code(result.Code), "error reading %v: %v", result.Key, result.Error)
+		}
+	}
+
+	return values, nil
+}
+
+// respCount serves EXISTS, counting how many of the keys exist, and DEL, which deletes them
+// too. As in Redis, a key given more than once is counted each time by EXISTS but only once
+// by DEL.
+func (s *Server) respCount(w respWriter, del bool, keys []string) {
+	values, err := s.batchValues(keys)
+	if err != nil {
+		w.writeStatus(err)
+		return
+	}
+
+	var count int64
+	deleted := make(map[string]bool)
+	for i, key := range keys {
+		if values[i] == nil || deleted[key] {
+			continue
+		}
+		count++
+
+		if del {
+			deleted[key] = true
+			_, err := s.DeleteKey(context.Background(), &dht_proto.DeleteKeyRequest{
+				Key:   key,
+				Proxy: true,
+			})
+			if err != nil {
+				w.writeStatus(err)
+				return
+			}
+		}
+	}
+
+	w.writeInt(count)
+}
+
+func (s *Server) respMGet(w respWriter, keys []string) {
+	values, err := s.batchValues(keys)
+	if err != nil {
+		w.writeStatus(err)
+		return
+	}
+
+	w.writeArray(len(values))
+	for _, value := range values {
+		w.writeBulk(value)
+	}
+}
+
+// respMSet serves MSET. Keys are written by their owners in parallel, so unlike Redis the
+// writes aren't atomic, and some keys may have been written if it fails.
+func (s *Server) respMSet(w respWriter, args [][]byte) {
+	var entries []*dht_proto.BatchEntry
+	for i := 0; i < len(args); i += 2 {
+		entries = append(entries, &dht_proto.BatchEntry{
+			Key:   string(args[i]),
+			Value: args[i+1],
+		})
+	}
+
+	res, err := s.BatchSet(context.Background(), &dht_proto.BatchSetRequest{Entries: entries})
+	if err != nil {
+		w.writeStatus(err)
+		return
+	}
+
+	for _, result := range res.Results {
+		if codes.Code(result.Code) != codes.OK {
+			w.writeStatus(status.Errorf(codes.Code(result.Code), "error writing %v: %v", result.Key, result.Error))
+			return
+		}
+	}
+
+	w.writeSimple("OK")
+}
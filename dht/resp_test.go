@@ -0,0 +1,173 @@
+package dht
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// respClient is a minimal Redis client, speaking RESP as redis-cli does
+type respClient struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// respError is an error reply
+type respError string
+
+func dialRESP(t *testing.T) *respClient {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	t.Cleanup(func() { lis.Close() })
+
+	go testServer().ServeRESP(lis)
+
+	conn, err := net.Dial("tcp", lis.Addr().String())
+	assert.Nil(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	return &respClient{conn: conn, r: bufio.NewReader(conn)}
+}
+
+func (c *respClient) send(args ...string) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+
+	c.conn.Write([]byte(b.String()))
+}
+
+// reply reads a reply: a string for simple strings, respError for errors, int64 for integers,
+// []byte or nil for bulk strings and []any for arrays
+func (c *respClient) reply() (any, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return respError(line[1:]), nil
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		b := make([]byte, n+2)
+		_, err = io.ReadFull(c.r, b)
+		return b[:n], err
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		res := make([]any, n)
+		for i := range res {
+			res[i], err = c.reply()
+			if err != nil {
+				return nil, err
+			}
+		}
+		return res, nil
+	}
+
+	return nil, fmt.Errorf("unexpected reply %q", line)
+}
+
+func (c *respClient) do(t *testing.T, args ...string) any {
+	c.send(args...)
+	res, err := c.reply()
+	assert.Nil(t, err)
+
+	return res
+}
+
+func TestRESPCommands(t *testing.T) {
+	c := dialRESP(t)
+
+	assert.Equal(t, "PONG", c.do(t, "PING"))
+	assert.Equal(t, []byte("hello"), c.do(t, "ping", "hello"))
+
+	assert.Equal(t, "OK", c.do(t, "SET", "a", "1"))
+	assert.Equal(t, []byte("1"), c.do(t, "GET", "a"))
+	assert.Nil(t, c.do(t, "GET", "missing"))
+
+	assert.Equal(t, "OK", c.do(t, "SET", "empty", ""))
+	assert.Equal(t, []byte{}, c.do(t, "GET", "empty"))
+
+	assert.Equal(t, "OK", c.do(t, "MSET", "b", "2", "c", "3"))
+	assert.Equal(t, []any{[]byte("1"), nil, []byte("3")}, c.do(t, "MGET", "a", "missing", "c"))
+
+	assert.Equal(t, int64(3), c.do(t, "EXISTS", "a", "b", "a", "missing"))
+	assert.Equal(t, int64(2), c.do(t, "DEL", "a", "b", "a", "missing"))
+	assert.Equal(t, int64(0), c.do(t, "EXISTS", "a", "b"))
+}
+
+func TestRESPSetConditions(t *testing.T) {
+	c := dialRESP(t)
+
+	assert.Nil(t, c.do(t, "SET", "key", "1", "XX"))
+	assert.Nil(t, c.do(t, "GET", "key"))
+
+	assert.Equal(t, "OK", c.do(t, "SET", "key", "1", "NX", "EX", "60"))
+	assert.Nil(t, c.do(t, "SET", "key", "2", "NX"))
+	assert.Equal(t, []byte("1"), c.do(t, "GET", "key"))
+
+	assert.Equal(t, "OK", c.do(t, "SET", "key", "3", "xx"))
+	assert.Equal(t, []byte("3"), c.do(t, "GET", "key"))
+
+	assert.IsType(t, respError(""), c.do(t, "SET", "key", "4", "NX", "XX"))
+	assert.IsType(t, respError(""), c.do(t, "SET", "key", "4", "EX", "0"))
+	assert.IsType(t, respError(""), c.do(t, "SET", "key", "4", "EX"))
+}
+
+func TestRESPErrors(t *testing.T) {
+	c := dialRESP(t)
+
+	assert.Equal(t, respError("ERR unknown command 'FLUSHALL'"), c.do(t, "FLUSHALL"))
+	assert.Equal(t, respError("ERR wrong number of arguments for 'get' command"), c.do(t, "GET"))
+	assert.Equal(t, respError("ERR wrong number of arguments for 'mset' command"), c.do(t, "MSET", "a", "1", "b"))
+}
+
+func TestRESPPipelineAndInline(t *testing.T) {
+	c := dialRESP(t)
+
+	c.send("SET", "a", "1")
+	c.send("GET", "a")
+	c.conn.Write([]byte("PING\r\n"))
+
+	for _, expected := range []any{"OK", []byte("1"), "PONG"} {
+		res, err := c.reply()
+		assert.Nil(t, err)
+		assert.Equal(t, expected, res)
+	}
+
+	assert.Equal(t, "OK", c.do(t, "QUIT"))
+	_, err := c.reply()
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestRESPProtocolError(t *testing.T) {
+	c := dialRESP(t)
+
+	c.conn.Write([]byte("*1\r\n+PING\r\n"))
+	res, err := c.reply()
+	assert.Nil(t, err)
+	assert.IsType(t, respError(""), res)
+
+	_, err = c.reply()
+	assert.Equal(t, io.EOF, err)
+}
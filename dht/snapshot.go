@@ -0,0 +1,582 @@
+package dht
+
+import (
+	"bufio"
+	"bytes"
+	"chord_dht/chord"
+	dht_proto "chord_dht/protos/dht"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protodelim"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+// A snapshot is taken in two phases. The coordinator first prepares every node in the ring,
+// after which each node keeps the values it overwrites. It then picks a version as the cut, and
+// has every node export the newest value of each key it owns at or before the cut, from the
+// store or from what it kept. The parts are written to a directory on each node and listed in
+// a manifest written by the coordinator.
+//
+// Snapshots are only written and read within the directory set by Config.SnapshotDir, the
+// directories given in requests are relative to it on each node.
+//
+// A snapshot directory holds manifest.json and one part-<node id>.entries file for each node,
+// the parts written on other nodes have to be copied in before it can be restored. Restoring
+// sends every key to its owner in the current ring, keeping its version so that anything
+// written since the snapshot wins.
+
+// Identifies a snapshot manifest, stored in its format field
+const SNAPSHOT_FORMAT = "chord-snapshot/v1"
+
+// The name of the manifest within the directory of a snapshot
+const SNAPSHOT_MANIFEST = "manifest.json"
+
+// The time a node keeps overwritten values for after being prepared, in case the coordinator
+// never gets round to the export
+const SNAPSHOT_TIMEOUT = 10 * time.Minute
+
+// Snapshot ids are the hex of the version they were started at, nothing else is accepted since
+// the id names a directory
+var snapshotIdPattern = regexp.MustCompile(`^[0-9a-f]{1,16}$`)
+
+// checkSnapshotId returns an error for an id which wasn't made by Snapshot
+func checkSnapshotId(id string) error {
+	if !snapshotIdPattern.MatchString(id) {
+		return status.Errorf(codes.InvalidArgument, "invalid snapshot id %q", id)
+	}
+
+	return nil
+}
+
+// snapshotPath resolves a directory given in a request within the snapshot directory of the
+// node, rejecting anything which would leave it
+func (s *Server) snapshotPath(dir string) (string, error) {
+	if s.snapshotDir == "" {
+		return "", status.Error(codes.FailedPrecondition, "snapshots are disabled on this node, it has no snapshot directory")
+	}
+
+	if filepath.IsAbs(dir) {
+		rel, err := filepath.Rel(s.snapshotDir, dir)
+		if err != nil {
+			return "", status.Errorf(codes.InvalidArgument, "%v is outside of the snapshot directory", dir)
+		}
+		dir = rel
+	}
+
+	if dir != "" && dir != "." && !filepath.IsLocal(dir) {
+		return "", status.Errorf(codes.InvalidArgument, "%v is outside of the snapshot directory", dir)
+	}
+
+	return filepath.Join(s.snapshotDir, dir), nil
+}
+
+// snapshotRecorder keeps the values overwritten on a node while a snapshot is being taken
+type snapshotRecorder struct {
+	mu      sync.Mutex
+	id      string
+	history map[string][]Entry
+	timer   *time.Timer
+}
+
+// begin starts keeping overwritten values for a snapshot. Preparing the same snapshot again
+// does nothing, another snapshot can't be prepared until the first is exported or times out.
+func (r *snapshotRecorder) begin(id string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.history != nil {
+		if r.id == id {
+			return nil
+		}
+		return status.Errorf(codes.FailedPrecondition, "snapshot %v is already in progress", r.id)
+	}
+
+	r.id = id
+	r.history = make(map[string][]Entry)
+	r.timer = time.AfterFunc(SNAPSHOT_TIMEOUT, func() {
+		if _, err := r.end(id); err == nil {
+			fmt.Printf("Abandoned snapshot %v, it was never exported\n", id)
+		}
+	})
+
+	return nil
+}
+
+// end stops keeping overwritten values for a snapshot, returning what was kept
+func (r *snapshotRecorder) end(id string) (map[string][]Entry, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.history == nil || r.id != id {
+		return nil, status.Errorf(codes.FailedPrecondition, "snapshot %v hasn't been prepared on the node", id)
+	}
+
+	history := r.history
+	r.history = nil
+	r.timer.Stop()
+
+	return history, nil
+}
+
+// record keeps the stored value of a key which is about to be overwritten or removed
+func (r *snapshotRecorder) record(store Store, key string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.history == nil {
+		return
+	}
+
+	old, ok := store.Lookup(key)
+	if !ok {
+		return
+	}
+
+	kept := r.history[key]
+	if len(kept) > 0 && kept[len(kept)-1].Version == old.Version {
+		return
+	}
+	r.history[key] = append(kept, old)
+}
+
+// recordingStore keeps the values overwritten through it while a snapshot is being taken
+type recordingStore struct {
+	Store
+	recorder *snapshotRecorder
+}
+
+func (r *recordingStore) SetExpiringKey(key string, value []byte, version uint64, expires time.Time) error {
+	r.recorder.record(r.Store, key)
+	return r.Store.SetExpiringKey(key, value, version, expires)
+}
+
+func (r *recordingStore) SetVersionedKeyIf(key string, value []byte, version uint64, expires time.Time, cond Precondition) error {
+	r.recorder.record(r.Store, key)
+	return r.Store.SetVersionedKeyIf(key, value, version, expires, cond)
+}
+
+func (r *recordingStore) Apply(key string, value []byte, version uint64, expires time.Time, deleted bool) bool {
+	r.recorder.record(r.Store, key)
+	return r.Store.Apply(key, value, version, expires, deleted)
+}
+
+func (r *recordingStore) DeleteVersionedKey(key string, version uint64) error {
+	r.recorder.record(r.Store, key)
+	return r.Store.DeleteVersionedKey(key, version)
+}
+
+func (r *recordingStore) DeleteKey(key string) error {
+	r.recorder.record(r.Store, key)
+	return r.Store.DeleteKey(key)
+}
+
+// entriesAtCut returns the live keys within owned as they were at the cut, picking the newest
+// version of each key at or before the cut from the current entries and the overwritten ones.
+// The entries are sorted by key.
+func entriesAtCut(current []Entry, history map[string][]Entry, owned chord.KeyRange, cut uint64) []Entry {
+	newest := make(map[string]Entry)
+	consider := func(v Entry) {
+		if v.Version > cut || !owned.Contains(ChordIdFromString(v.Key)) {
+			return
+		}
+		if old, ok := newest[v.Key]; ok && !NewerThan(v.Version, v.Value, old.Version, old.Value) {
+			return
+		}
+		newest[v.Key] = v
+	}
+
+	for _, v := range current {
+		consider(v)
+	}
+	for _, kept := range history {
+		for _, v := range kept {
+			consider(v)
+		}
+	}
+
+	cutTime := versionTime(cut)
+	var entries []Entry
+	for _, v := range newest {
+		if live(v, cutTime) {
+			entries = append(entries, v)
+		}
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Key < entries[j].Key
+	})
+
+	return entries
+}
+
+// writeSnapshotPart writes entries to a part file, returning its SHA-256 hash
+func writeSnapshotPart(path string, entries []Entry) ([]byte, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	hash := sha256.New()
+	w := bufio.NewWriter(io.MultiWriter(f, hash))
+	for _, v := range entries {
+		_, err := protodelim.MarshalTo(w, serializeEntry(v))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = w.Flush()
+	if err != nil {
+		return nil, err
+	}
+
+	err = f.Sync()
+	if err != nil {
+		return nil, err
+	}
+
+	return hash.Sum(nil), f.Close()
+}
+
+// readSnapshotPart reads the entries of a part file, checking it against its hash
+func readSnapshotPart(path string, sum []byte) ([]Entry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	hash := sha256.New()
+	r := bufio.NewReader(io.TeeReader(f, hash))
+
+	var entries []Entry
+	for {
+		entry := &dht_proto.Entry{}
+		err := protodelim.UnmarshalFrom(r, entry)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error reading %v: %w", path, err)
+		}
+
+		entries = append(entries, parseEntry(entry))
+	}
+
+	if !bytes.Equal(hash.Sum(nil), sum) {
+		return nil, fmt.Errorf("%v doesn't match the hash in the manifest", path)
+	}
+
+	return entries, nil
+}
+
+// writeSnapshotManifest writes the manifest to the directory of its snapshot
+func writeSnapshotManifest(dir string, manifest *dht_proto.SnapshotManifest) error {
+	data, err := protojson.MarshalOptions{Multiline: true}.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(filepath.Join(dir, SNAPSHOT_MANIFEST), data, 0644)
+}
+
+// readSnapshotManifest reads the manifest of the snapshot in dir
+func readSnapshotManifest(dir string) (*dht_proto.SnapshotManifest, error) {
+	data, err := os.ReadFile(filepath.Join(dir, SNAPSHOT_MANIFEST))
+	if err != nil {
+		return nil, err
+	}
+
+	manifest := &dht_proto.SnapshotManifest{}
+	err = protojson.Unmarshal(data, manifest)
+	if err != nil {
+		return nil, fmt.Errorf("invalid snapshot manifest: %w", err)
+	}
+
+	if manifest.Format != SNAPSHOT_FORMAT {
+		return nil, fmt.Errorf("unsupported snapshot format %q", manifest.Format)
+	}
+
+	for _, part := range manifest.Parts {
+		if part.File != filepath.Base(part.File) {
+			return nil, fmt.Errorf("snapshot part %q is outside the snapshot directory", part.File)
+		}
+	}
+
+	return manifest, nil
+}
+
+// checkCoverage checks the ranges of the parts of a snapshot cover the ring exactly once. The
+// ranges of a ring which changed while the snapshot was taken may overlap or leave gaps.
+func checkCoverage(parts []*dht_proto.SnapshotPart) error {
+	sorted := make([]*dht_proto.SnapshotPart, len(parts))
+	copy(sorted, parts)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].End < sorted[j].End
+	})
+
+	for i, part := range sorted {
+		prev := sorted[(i+len(sorted)-1)%len(sorted)]
+		if part.Start != prev.End {
+			return fmt.Errorf("the range of node %v starts at %v rather than %v", part.Node, part.Start, prev.End)
+		}
+	}
+
+	return nil
+}
+
+// ringPeers walks the ring through successors, returning every node once starting with this one
+func (s *Server) ringPeers() ([]chord.Peer, error) {
+	peers := []chord.Peer{chord.PeerOf(s.node)}
+	seen := map[chord.Id]bool{s.node.Identifier(): true}
+
+	succ, err := s.node.Successor()
+	for {
+		if err != nil {
+			return nil, status.Errorf(codes.Unavailable, "could not walk the ring: %v", err)
+		}
+		if seen[succ.Identifier()] {
+			return peers, nil
+		}
+
+		seen[succ.Identifier()] = true
+		peers = append(peers, chord.PeerOf(succ))
+		succ, err = succ.Successor()
+	}
+}
+
+func (s *Server) PrepareSnapshot(ctx context.Context, in *dht_proto.PrepareSnapshotRequest) (*dht_proto.PrepareSnapshotResponse, error) {
+	fmt.Printf("Preparing snapshot %v\n", in.Id)
+
+	err := checkSnapshotId(in.Id)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.snapshots.begin(in.Id)
+	if err != nil {
+		return nil, err
+	}
+
+	return &dht_proto.PrepareSnapshotResponse{}, nil
+}
+
+func (s *Server) ExportSnapshot(ctx context.Context, in *dht_proto.ExportSnapshotRequest) (*dht_proto.SnapshotPart, error) {
+	fmt.Printf("Exporting snapshot %v at %v\n", in.Id, in.Cut)
+
+	err := checkSnapshotId(in.Id)
+	if err != nil {
+		return nil, err
+	}
+
+	root, err := s.snapshotPath(in.Directory)
+	if err != nil {
+		return nil, err
+	}
+
+	// Any version created on the node from now on comes after the cut
+	err = versionClock.Observe(in.Cut)
+	if err != nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "snapshot cut: %v", err)
+	}
+
+	owned := s.node.OwnedRange()
+	current := entriesInRange(s.keystore, owned)
+
+	// Values overwritten since the store was read are kept until now, so nothing is missed
+	history, err := s.snapshots.end(in.Id)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := entriesAtCut(current, history, owned, in.Cut)
+
+	dir := filepath.Join(root, in.Id)
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "error creating the snapshot directory: %v", err)
+	}
+
+	file := fmt.Sprintf("part-%v.entries", s.node.Identifier())
+	sum, err := writeSnapshotPart(filepath.Join(dir, file), entries)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "error writing the snapshot: %v", err)
+	}
+
+	fmt.Printf("Exported %v keys to %v\n", len(entries), filepath.Join(dir, file))
+	return &dht_proto.SnapshotPart{
+		Node:    int64(s.node.Identifier()),
+		Address: dhtAddress(chord.PeerOf(s.node)),
+		Start:   int64(owned.Start),
+		End:     int64(owned.End),
+		File:    file,
+		Entries: int64(len(entries)),
+		Sha256:  sum,
+	}, nil
+}
+
+func (s *Server) Snapshot(ctx context.Context, in *dht_proto.SnapshotRequest) (*dht_proto.SnapshotManifest, error) {
+	// Every node resolves the directory within its own snapshot directory, it's checked here
+	// first so that a bad one fails before any node is prepared
+	root, err := s.snapshotPath(in.Directory)
+	if err != nil {
+		return nil, err
+	}
+
+	peers, err := s.ringPeers()
+	if err != nil {
+		return nil, err
+	}
+
+	id := strconv.FormatUint(newVersion(), 16)
+	fmt.Printf("Taking snapshot %v of %v nodes\n", id, len(peers))
+
+	// A node which was prepared but never exports drops what it kept after SNAPSHOT_TIMEOUT
+	for _, p := range peers {
+		req := &dht_proto.PrepareSnapshotRequest{Id: id}
+		if p.Id == s.node.Identifier() {
+			_, err = s.PrepareSnapshot(ctx, req)
+		} else {
+			err = prepareSnapshot(ctx, dhtAddress(p), req)
+		}
+		if err != nil {
+			return nil, status.Errorf(status.Code(err), "error preparing %v for the snapshot: %v", p.Id, err)
+		}
+	}
+
+	cut := newVersion()
+	parts := make([]*dht_proto.SnapshotPart, len(peers))
+	errs := make([]error, len(peers))
+
+	var wg sync.WaitGroup
+	for i, p := range peers {
+		wg.Add(1)
+		go func(i int, p chord.Peer) {
+			defer wg.Done()
+
+			req := &dht_proto.ExportSnapshotRequest{
+				Id:        id,
+				Cut:       cut,
+				Directory: in.Directory,
+			}
+			if p.Id == s.node.Identifier() {
+				parts[i], errs[i] = s.ExportSnapshot(ctx, req)
+			} else {
+				parts[i], errs[i] = exportSnapshot(ctx, dhtAddress(p), req)
+			}
+			if errs[i] != nil {
+				errs[i] = fmt.Errorf("error exporting the snapshot on %v: %w", p.Id, errs[i])
+			}
+		}(i, p)
+	}
+	wg.Wait()
+
+	err = errors.Join(errs...)
+	if err != nil {
+		return nil, status.Error(codes.Unavailable, err.Error())
+	}
+
+	err = checkCoverage(parts)
+	if err != nil {
+		return nil, status.Errorf(codes.Aborted, "the ring changed during the snapshot, try again: %v", err)
+	}
+
+	manifest := &dht_proto.SnapshotManifest{
+		Format:  SNAPSHOT_FORMAT,
+		Id:      id,
+		Cut:     cut,
+		Created: time.Now().UnixMilli(),
+		Parts:   parts,
+	}
+
+	dir := filepath.Join(root, id)
+	err = os.MkdirAll(dir, 0755)
+	if err == nil {
+		err = writeSnapshotManifest(dir, manifest)
+	}
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "error writing the snapshot manifest: %v", err)
+	}
+
+	fmt.Printf("Wrote snapshot %v to %v\n", id, dir)
+	return manifest, nil
+}
+
+// restoreEntries sends each entry to the current owner of its key
+func (s *Server) restoreEntries(entries []Entry) error {
+	keys := make([]string, len(entries))
+	for i, v := range entries {
+		keys[i] = v.Key
+	}
+
+	groups, failed := s.groupByOwner(keys)
+	for i, err := range failed {
+		return fmt.Errorf("error restoring %q: %w", entries[i].Key, err)
+	}
+
+	for address, indices := range groups {
+		group := make([]Entry, len(indices))
+		for j, i := range indices {
+			group[j] = entries[i]
+		}
+
+		err := s.deliverEntries(address, group, false)
+		if err != nil {
+			return fmt.Errorf("error restoring keys to %v: %w", address, err)
+		}
+	}
+
+	return nil
+}
+
+func (s *Server) RestoreSnapshot(ctx context.Context, in *dht_proto.RestoreSnapshotRequest) (*dht_proto.RestoreSnapshotResponse, error) {
+	fmt.Printf("Restoring snapshot from %v\n", in.Directory)
+
+	dir, err := s.snapshotPath(in.Directory)
+	if err != nil {
+		return nil, err
+	}
+
+	manifest, err := readSnapshotManifest(dir)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	// Every part is checked before anything is restored
+	var entries []Entry
+	for _, part := range manifest.Parts {
+		read, err := readSnapshotPart(filepath.Join(dir, part.File), part.Sha256)
+		if err != nil {
+			return nil, status.Error(codes.DataLoss, err.Error())
+		}
+		if int64(len(read)) != part.Entries {
+			return nil, status.Errorf(codes.DataLoss, "%v holds %v entries rather than %v", part.File, len(read), part.Entries)
+		}
+
+		entries = append(entries, read...)
+	}
+
+	for start := 0; start < len(entries); start += MAX_BATCH_KEYS {
+		err := s.restoreEntries(entries[start:min(start+MAX_BATCH_KEYS, len(entries))])
+		if err != nil {
+			return nil, status.Error(codes.Unavailable, err.Error())
+		}
+	}
+
+	fmt.Printf("Restored %v keys from snapshot %v\n", len(entries), manifest.Id)
+	return &dht_proto.RestoreSnapshotResponse{Entries: int64(len(entries))}, nil
+}
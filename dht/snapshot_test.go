@@ -0,0 +1,160 @@
+package dht
+
+import (
+	"chord_dht/chord"
+	dht_proto "chord_dht/protos/dht"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestEntriesAtCut(t *testing.T) {
+	base := newVersion()
+	current := []Entry{
+		{Key: "a", Value: []byte("new"), Version: base + 20},
+		{Key: "b", Version: base + 5, Deleted: true},
+		{Key: "c", Value: []byte("c"), Version: base + 5, Expires: time.Now().Add(-time.Hour)},
+		{Key: "d", Value: []byte("d"), Version: base + 30},
+	}
+	history := map[string][]Entry{
+		"a": {{Key: "a", Value: []byte("old"), Version: base + 8}},
+	}
+
+	entries := entriesAtCut(current, history, chord.KeyRange{}, base+30)
+	assert.Len(t, entries, 2)
+	assert.Equal(t, []byte("new"), entries[0].Value)
+
+	entries = entriesAtCut(current, history, chord.KeyRange{}, base+10)
+	assert.Len(t, entries, 1)
+	assert.Equal(t, "a", entries[0].Key)
+	assert.Equal(t, []byte("old"), entries[0].Value)
+}
+
+func TestSnapshotKeepsOverwrittenValues(t *testing.T) {
+	s := testServer()
+	dir := t.TempDir()
+	s.snapshotDir = dir
+
+	s.keystore.SetExpiringKey("key", []byte("before"), newVersion(), time.Time{})
+
+	_, err := s.PrepareSnapshot(context.Background(), &dht_proto.PrepareSnapshotRequest{Id: "5eed"})
+	assert.Nil(t, err)
+	cut := newVersion()
+
+	s.keystore.SetExpiringKey("key", []byte("after"), newVersion(), time.Time{})
+
+	part, err := s.ExportSnapshot(context.Background(), &dht_proto.ExportSnapshotRequest{
+		Id:        "5eed",
+		Cut:       cut,
+		Directory: "backups",
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), part.Entries)
+
+	entries, err := readSnapshotPart(filepath.Join(dir, "backups", "5eed", part.File), part.Sha256)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("before"), entries[0].Value)
+
+	// The export ends the snapshot
+	_, err = s.ExportSnapshot(context.Background(), &dht_proto.ExportSnapshotRequest{Id: "5eed", Cut: cut, Directory: "backups"})
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+}
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	s := testServer()
+	dir := t.TempDir()
+	s.snapshotDir = dir
+
+	s.keystore.SetExpiringKey("a", []byte("1"), newVersion(), time.Time{})
+	s.keystore.SetExpiringKey(scopedKey("ns", "b"), []byte("2"), newVersion(), time.Time{})
+	s.keystore.DeleteVersionedKey("deleted", newVersion())
+
+	manifest, err := s.Snapshot(context.Background(), &dht_proto.SnapshotRequest{Directory: dir})
+	assert.Nil(t, err)
+	assert.Equal(t, SNAPSHOT_FORMAT, manifest.Format)
+	assert.Len(t, manifest.Parts, 1)
+	assert.Equal(t, int64(2), manifest.Parts[0].Entries)
+
+	restored := testServer()
+	restored.snapshotDir = dir
+	newer := newVersion()
+	restored.keystore.SetExpiringKey("a", []byte("newer"), newer, time.Time{})
+
+	res, err := restored.RestoreSnapshot(context.Background(), &dht_proto.RestoreSnapshotRequest{
+		Directory: manifest.Id,
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2), res.Entries)
+
+	value, version, err := restored.keystore.GetVersionedKey("a")
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("newer"), value)
+	assert.Equal(t, newer, version)
+
+	value, _, err = restored.keystore.GetVersionedKey(scopedKey("ns", "b"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("2"), value)
+	assert.False(t, restored.keystore.HasKey("deleted"))
+}
+
+func TestRestoreDetectsCorruption(t *testing.T) {
+	s := testServer()
+	dir := t.TempDir()
+	s.snapshotDir = dir
+
+	s.keystore.SetExpiringKey("a", []byte("1"), newVersion(), time.Time{})
+
+	manifest, err := s.Snapshot(context.Background(), &dht_proto.SnapshotRequest{Directory: dir})
+	assert.Nil(t, err)
+
+	path := filepath.Join(dir, manifest.Id, manifest.Parts[0].File)
+	data, err := os.ReadFile(path)
+	assert.Nil(t, err)
+	data[len(data)-1] ^= 0xff
+	assert.Nil(t, os.WriteFile(path, data, 0644))
+
+	// An absolute path within the snapshot directory is accepted too
+	_, err = s.RestoreSnapshot(context.Background(), &dht_proto.RestoreSnapshotRequest{
+		Directory: filepath.Join(dir, manifest.Id),
+	})
+	assert.Equal(t, codes.DataLoss, status.Code(err))
+}
+
+func TestSnapshotPathsStayInSnapshotDir(t *testing.T) {
+	s := testServer()
+
+	_, err := s.Snapshot(context.Background(), &dht_proto.SnapshotRequest{})
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err), "snapshots are disabled without a snapshot directory")
+
+	dir := t.TempDir()
+	s.snapshotDir = filepath.Join(dir, "snapshots")
+
+	for _, bad := range []string{"..", "../elsewhere", "a/../../b", dir, "/etc"} {
+		_, err = s.snapshotPath(bad)
+		assert.Equal(t, codes.InvalidArgument, status.Code(err), bad)
+
+		_, err = s.RestoreSnapshot(context.Background(), &dht_proto.RestoreSnapshotRequest{Directory: bad})
+		assert.Equal(t, codes.InvalidArgument, status.Code(err), bad)
+	}
+
+	path, err := s.snapshotPath("nightly/1")
+	assert.Nil(t, err)
+	assert.Equal(t, filepath.Join(dir, "snapshots", "nightly", "1"), path)
+
+	for _, id := range []string{"", "../../x", "ABC", "test", "00000000000000000"} {
+		_, err = s.ExportSnapshot(context.Background(), &dht_proto.ExportSnapshotRequest{Id: id, Directory: "nightly"})
+		assert.Equal(t, codes.InvalidArgument, status.Code(err), id)
+	}
+}
+
+func TestCheckCoverage(t *testing.T) {
+	assert.Nil(t, checkCoverage([]*dht_proto.SnapshotPart{{Start: 5, End: 5}}))
+	assert.Nil(t, checkCoverage([]*dht_proto.SnapshotPart{{Start: 10, End: 3}, {Start: 3, End: 10}}))
+	assert.NotNil(t, checkCoverage([]*dht_proto.SnapshotPart{{Start: 10, End: 3}, {Start: 4, End: 10}}))
+}
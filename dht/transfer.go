@@ -0,0 +1,130 @@
+package dht
+
+import (
+	"chord_dht/chord"
+	dht_proto "chord_dht/protos/dht"
+	"fmt"
+	"io"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// The maximum number of entries sent in each message of a TransferRange stream
+const TRANSFER_BATCH_SIZE = 1000
+
+// The maximum size of each message of a TransferRange stream, well below the gRPC message limit
+const TRANSFER_BATCH_BYTES = 1 << 20
+
+// The maximum time a TransferRange stream may take, including the acknowledgement
+const TRANSFER_TIMEOUT = 5 * time.Minute
+
+// batchEntries splits entries into batches of at most TRANSFER_BATCH_SIZE entries and roughly
+// TRANSFER_BATCH_BYTES bytes. An entry larger than the byte limit is sent in a batch on its own.
+func batchEntries(entries []Entry) [][]*dht_proto.Entry {
+	var batches [][]*dht_proto.Entry
+	var batch []*dht_proto.Entry
+	size := 0
+
+	for _, v := range entries {
+		entry := serializeEntry(v)
+		entrySize := proto.Size(entry)
+
+		if len(batch) > 0 && (len(batch) >= TRANSFER_BATCH_SIZE || size+entrySize > TRANSFER_BATCH_BYTES) {
+			batches = append(batches, batch)
+			batch = nil
+			size = 0
+		}
+
+		batch = append(batch, entry)
+		size += entrySize
+	}
+
+	if len(batch) > 0 {
+		batches = append(batches, batch)
+	}
+
+	return batches
+}
+
+// transferEntries pushes entries to another node over a single stream. Once the node has
+// acknowledged them, the local copies are deleted if drop is set, unless they were overwritten
+// in the meantime.
+func (s *Server) transferEntries(address string, entries []Entry, drop bool) error {
+	res, err := TransferRange(address, s.node.Identifier(), entries, false)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Transferred %v keys to %v, %v were applied\n", res.Received, address, res.Applied)
+	if !drop {
+		return nil
+	}
+
+	for _, v := range entries {
+		if stored, ok := s.keystore.Lookup(v.Key); ok && stored.Version == v.Version {
+			s.keystore.DeleteKey(v.Key)
+		}
+	}
+
+	return nil
+}
+
+// replicateEntries sends copies of entries to each of the given peers
+func (s *Server) replicateEntries(entries []Entry, peers []chord.Peer) {
+	for _, p := range peers {
+		fmt.Printf("Replicating %v keys to %v\n", len(entries), p.Id)
+		_, err := TransferRange(dhtAddress(p), s.node.Identifier(), entries, true)
+		if err != nil {
+			fmt.Printf("error replicating keys to %v: %v\n", p.Id, err)
+		}
+	}
+}
+
+func (s *Server) TransferRange(stream dht_proto.DHT_TransferRangeServer) error {
+	err := s.fromRingMember(stream.Context())
+	if err != nil {
+		return err
+	}
+
+	received, applied := 0, 0
+	var fresh []Entry
+	for {
+		batch, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		for _, entry := range batch.Entries {
+			received++
+
+			var ok bool
+			if batch.Hinted {
+				ok = s.applyHint(parseEntry(entry))
+			} else {
+				ok = s.keystore.Apply(entry.Key, entry.Value, entry.Version, parseExpiry(entry.Expires), entry.Deleted)
+			}
+			if !ok {
+				continue
+			}
+			applied++
+
+			// Copies sent to a replica stop there, anything else may be ours to replicate
+			if !batch.Replica {
+				fresh = append(fresh, parseEntry(entry))
+			}
+		}
+	}
+
+	if s.replicationFactor > 1 && len(fresh) > 0 {
+		go s.replicateEntries(fresh, s.replicaTargets())
+	}
+
+	return stream.SendAndClose(&dht_proto.TransferRangeResponse{
+		Received: int32(received),
+		Applied:  int32(applied),
+	})
+}
@@ -0,0 +1,39 @@
+package dht
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBatchEntriesByCount(t *testing.T) {
+	var entries []Entry
+	for i := 0; i < TRANSFER_BATCH_SIZE*2+1; i++ {
+		entries = append(entries, Entry{Key: fmt.Sprint(i), Value: []byte("v")})
+	}
+
+	batches := batchEntries(entries)
+	assert.Len(t, batches, 3)
+	assert.Len(t, batches[0], TRANSFER_BATCH_SIZE)
+	assert.Len(t, batches[2], 1)
+}
+
+func TestBatchEntriesBySize(t *testing.T) {
+	large := make([]byte, TRANSFER_BATCH_BYTES/2)
+	entries := []Entry{
+		{Key: "a", Value: large},
+		{Key: "b", Value: large},
+		{Key: "c", Value: make([]byte, TRANSFER_BATCH_BYTES*2)},
+		{Key: "d", Value: []byte("small")},
+	}
+
+	batches := batchEntries(entries)
+	assert.Len(t, batches, 4, "each large entry should start a new batch")
+	assert.Equal(t, "c", batches[2][0].Key, "an oversized entry is sent on its own")
+	assert.Equal(t, "d", batches[3][0].Key)
+}
+
+func TestBatchEntriesEmpty(t *testing.T) {
+	assert.Len(t, batchEntries(nil), 0)
+}
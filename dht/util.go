@@ -2,7 +2,10 @@ package dht
 
 import (
 	"chord_dht/chord"
+	dht_proto "chord_dht/protos/dht"
 	"net"
+	"strconv"
+	"time"
 )
 
 func stripPort(address string) string {
@@ -10,7 +13,83 @@ func stripPort(address string) string {
 	return host
 }
 
+// dhtAddress returns the address of the DHT server on a node, from the endpoint it advertises.
+// Nodes which haven't advertised one yet are assumed to serve on DHT_PORT.
+func dhtAddress(p chord.Peer) string {
+	if address := p.ServiceAddress(SERVICE_NAME); address != "" {
+		return address
+	}
+
+	return net.JoinHostPort(stripPort(p.Address), strconv.Itoa(DHT_PORT))
+}
+
+// forwardNode describes the DHT server at address for a redirect
+func forwardNode(address string) *dht_proto.Node {
+	host, port, _ := net.SplitHostPort(address)
+	p, _ := strconv.Atoi(port)
+
+	return &dht_proto.Node{
+		Address: host,
+		Port:    int32(p),
+	}
+}
+
 func ChordIdFromString(str string) chord.Id {
 	hash := chord.Hash([]byte(str))
 	return chord.IdentifierFromBytes(hash)
 }
+
+// serializeEntry converts an entry for sending to another node
+func serializeEntry(v Entry) *dht_proto.Entry {
+	return &dht_proto.Entry{
+		Key:     v.Key,
+		Value:   v.Value,
+		Version: v.Version,
+		Deleted: v.Deleted,
+		Expires: serializeExpiry(v.Expires),
+	}
+}
+
+// parseEntry is the inverse of serializeEntry
+func parseEntry(entry *dht_proto.Entry) Entry {
+	return Entry{
+		Key:     entry.Key,
+		Value:   entry.Value,
+		Id:      ChordIdFromString(entry.Key),
+		Version: entry.Version,
+		Deleted: entry.Deleted,
+		Expires: parseExpiry(entry.Expires),
+	}
+}
+
+// serializeExpiry converts an expiry time to milliseconds since the epoch, keeping zero as never
+func serializeExpiry(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+
+	return t.UnixMilli()
+}
+
+// parseExpiry is the inverse of serializeExpiry
+func parseExpiry(ms int64) time.Time {
+	if ms == 0 {
+		return time.Time{}
+	}
+
+	return time.UnixMilli(ms)
+}
+
+// parsePrecondition converts a precondition from a request into its keystore equivalent
+func parsePrecondition(p *dht_proto.Precondition) Precondition {
+	switch c := p.Condition.(type) {
+	case *dht_proto.Precondition_IfNotExists:
+		return Precondition{NotExists: c.IfNotExists}
+	case *dht_proto.Precondition_IfVersion:
+		return Precondition{Version: c.IfVersion}
+	case *dht_proto.Precondition_IfValue:
+		return Precondition{Value: c.IfValue}
+	}
+
+	return Precondition{}
+}
@@ -0,0 +1,30 @@
+package dht
+
+import (
+	"chord_dht/chord"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDhtAddressUsesAdvertisedEndpoint(t *testing.T) {
+	p := chord.Peer{
+		Address:  "10.0.0.1:8080",
+		Services: map[string]string{SERVICE_NAME: "10.0.0.1:9000"},
+	}
+	assert.Equal(t, "10.0.0.1:9000", dhtAddress(p))
+
+	// Nodes which haven't advertised the DHT yet are assumed to use the default port
+	p.Services = nil
+	assert.Equal(t, "10.0.0.1:8081", dhtAddress(p))
+}
+
+func TestForwardNodeRoundTrip(t *testing.T) {
+	assert.Equal(t, "10.0.0.1:9000", forwardAddress(forwardNode("10.0.0.1:9000")))
+	assert.Equal(t, "[::1]:9000", forwardAddress(forwardNode("[::1]:9000")))
+
+	// Redirects from nodes which don't send the port
+	node := forwardNode("10.0.0.1:9000")
+	node.Port = 0
+	assert.Equal(t, "10.0.0.1:8081", forwardAddress(node))
+}
@@ -0,0 +1,452 @@
+package dht
+
+import (
+	"chord_dht/chord"
+	dht_proto "chord_dht/protos/dht"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// The number of events buffered for each watch, a watch which falls further behind is ended
+// so the client can resubscribe rather than silently miss changes
+const WATCH_BUFFER_SIZE = 256
+
+// watch is a single WatchKey or WatchPrefix stream
+type watch struct {
+	// key is the watched key, or the prefix of the watched keys if prefix is set
+	namespace string
+	key       string
+	prefix    bool
+
+	// owned is the node's range as last seen by a prefix watch, guarded by the hub lock
+	owned chord.KeyRange
+
+	events chan *dht_proto.WatchEvent
+
+	// moved is closed when the watched key leaves the node's range, overflow when the
+	// watch falls behind. Both are guarded by the hub lock.
+	moved    chan struct{}
+	overflow chan struct{}
+	ended    bool
+}
+
+// matches returns if the watch covers a stored key. Requires the hub lock.
+func (w *watch) matches(scoped string) bool {
+	namespace, key := splitKey(scoped)
+	if namespace != w.namespace {
+		return false
+	}
+
+	// Internal keys, such as the chunks of objects, aren't the client's to watch
+	if strings.HasPrefix(key, NAMESPACE_SEPARATOR) {
+		return false
+	}
+
+	// Replicas and hand-offs of keys the node doesn't own are reported by their owner
+	if w.prefix {
+		return strings.HasPrefix(key, w.key) && w.owned.Contains(ChordIdFromString(scoped))
+	}
+
+	return key == w.key
+}
+
+// end stops the watch, closing done. Requires the hub lock.
+func (w *watch) end(done chan struct{}) {
+	if !w.ended {
+		w.ended = true
+		close(done)
+	}
+}
+
+// watchHub tracks the open watches on a node
+type watchHub struct {
+	mu      sync.Mutex
+	watches map[*watch]struct{}
+}
+
+func newWatchHub() *watchHub {
+	return &watchHub{
+		watches: make(map[*watch]struct{}),
+	}
+}
+
+// add registers a watch. owned is the node's range, which prefix watches follow.
+func (h *watchHub) add(namespace string, key string, prefix bool, owned chord.KeyRange) *watch {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	w := &watch{
+		namespace: namespace,
+		key:       key,
+		prefix:    prefix,
+		owned:     owned,
+		events:    make(chan *dht_proto.WatchEvent, WATCH_BUFFER_SIZE),
+		moved:     make(chan struct{}),
+		overflow:  make(chan struct{}),
+	}
+	h.watches[w] = struct{}{}
+	promWatches.Inc()
+
+	return w
+}
+
+func (h *watchHub) remove(w *watch) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if _, ok := h.watches[w]; ok {
+		delete(h.watches, w)
+		promWatches.Dec()
+	}
+}
+
+// active returns if there are any open watches
+func (h *watchHub) active() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return len(h.watches) > 0
+}
+
+// publish delivers an event to every watch of its key without blocking
+func (h *watchHub) publish(event *dht_proto.WatchEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for w := range h.watches {
+		if w.ended || !w.matches(event.Key) {
+			continue
+		}
+
+		select {
+		case w.events <- event:
+		default:
+			w.end(w.overflow)
+		}
+	}
+}
+
+// rangeChanged ends the key watches which are no longer within the node's range. Prefix
+// watches cover whatever the node owns, so they carry on, but are told of any part of the
+// range which has moved to another node so the client can watch it there.
+func (h *watchHub) rangeChanged(owned chord.KeyRange) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for w := range h.watches {
+		if w.ended {
+			continue
+		}
+
+		if !w.prefix {
+			if !owned.Contains(ChordIdFromString(scopedKey(w.namespace, w.key))) {
+				w.end(w.moved)
+			}
+			continue
+		}
+
+		if moved, ok := handedOver(w.owned, owned); ok {
+			select {
+			case w.events <- &dht_proto.WatchEvent{
+				Type:  dht_proto.WatchEventType_REDIRECT,
+				Start: int64(moved.Start),
+				End:   int64(moved.End),
+			}:
+			default:
+				w.end(w.overflow)
+			}
+		}
+		w.owned = owned
+	}
+}
+
+// handedOver returns the part of the old range which is no longer owned. The node's end of
+// its range never changes, so it can only lose keys to new predecessors.
+func handedOver(old chord.KeyRange, owned chord.KeyRange) (chord.KeyRange, bool) {
+	if owned == old || owned.Start == owned.End {
+		return chord.KeyRange{}, false
+	}
+
+	// The node owned the whole ring, everything outside its new range has moved
+	if old.Start == old.End {
+		return chord.KeyRange{Start: owned.End, End: owned.Start}, true
+	}
+
+	if owned.End != old.End || !old.Contains(owned.Start) {
+		return chord.KeyRange{}, false
+	}
+
+	return chord.KeyRange{Start: old.Start, End: owned.Start}, true
+}
+
+// watchedStore publishes a watch event for every change made through it
+type watchedStore struct {
+	Store
+	hub *watchHub
+}
+
+func (w *watchedStore) SetExpiringKey(key string, value []byte, version uint64, expires time.Time) error {
+	err := w.Store.SetExpiringKey(key, value, version, expires)
+	if err == nil {
+		w.publish(key, value, version, expires, false)
+	}
+
+	return err
+}
+
+func (w *watchedStore) SetVersionedKeyIf(key string, value []byte, version uint64, expires time.Time, cond Precondition) error {
+	err := w.Store.SetVersionedKeyIf(key, value, version, expires, cond)
+	if err == nil {
+		w.publish(key, value, version, expires, false)
+	}
+
+	return err
+}
+
+func (w *watchedStore) Apply(key string, value []byte, version uint64, expires time.Time, deleted bool) bool {
+	applied := w.Store.Apply(key, value, version, expires, deleted)
+	if applied {
+		w.publish(key, value, version, expires, deleted)
+	}
+
+	return applied
+}
+
+func (w *watchedStore) DeleteVersionedKey(key string, version uint64) error {
+	err := w.Store.DeleteVersionedKey(key, version)
+	if err == nil {
+		w.publish(key, nil, version, time.Time{}, true)
+	}
+
+	return err
+}
+
+// PurgeExpired reports the keys which were replaced by tombstones as they expired. Finding them takes a scan of
+// the store, so it's only done while there are watches open.
+func (w *watchedStore) PurgeExpired(now time.Time) int {
+	if !w.hub.active() {
+		return w.Store.PurgeExpired(now)
+	}
+
+	var expired []Entry
+	w.Store.Range(chord.KeyRange{}, func(v Entry) bool {
+		if !v.Deleted && !v.Expires.IsZero() && !now.Before(v.Expires) {
+			expired = append(expired, v)
+		}
+		return true
+	})
+
+	purged := w.Store.PurgeExpired(now)
+
+	for _, v := range expired {
+		// Skip keys which were written again before the purge
+		stored, ok := w.Store.Lookup(v.Key)
+		if !ok || !stored.Deleted || stored.Version != expiryVersion(v.Version, v.Expires) {
+			continue
+		}
+
+		w.hub.publish(&dht_proto.WatchEvent{
+			Type:    dht_proto.WatchEventType_EXPIRE,
+			Key:     v.Key,
+			Version: v.Version,
+			Expires: serializeExpiry(v.Expires),
+		})
+	}
+
+	return purged
+}
+
+func (w *watchedStore) publish(key string, value []byte, version uint64, expires time.Time, deleted bool) {
+	event := &dht_proto.WatchEvent{
+		Type:    dht_proto.WatchEventType_SET,
+		Key:     key,
+		Value:   value,
+		Version: version,
+		Expires: serializeExpiry(expires),
+	}
+
+	if deleted {
+		event.Type = dht_proto.WatchEventType_DELETE
+		event.Value = nil
+		event.Expires = 0
+	}
+
+	w.hub.publish(event)
+}
+
+// watchRedirect tells a client to watch a key on its owner instead
+func (s *Server) watchRedirect(key string, stream dht_proto.DHT_WatchKeyServer) error {
+	owner, _, err := s.node.FindSuccessor(ChordIdFromString(key), 0)
+	if err != nil {
+		return status.Errorf(codes.Unavailable, "the key has moved and its owner could not be found: %v", err)
+	}
+
+	address := dhtAddress(chord.PeerOf(owner))
+	fmt.Printf("Redirecting watch on %v to %v\n", key, address)
+
+	_, unscoped := splitKey(key)
+	return stream.Send(&dht_proto.WatchEvent{
+		Type:        dht_proto.WatchEventType_REDIRECT,
+		Key:         unscoped,
+		ForwardNode: forwardNode(address),
+	})
+}
+
+// clientEvent returns an event with the key as the client knows it, without its namespace
+func clientEvent(event *dht_proto.WatchEvent) *dht_proto.WatchEvent {
+	namespace, key := splitKey(event.Key)
+	if namespace == "" {
+		return event
+	}
+
+	res := proto.Clone(event).(*dht_proto.WatchEvent)
+	res.Key = key
+	return res
+}
+
+// prefixRedirects splits a range handed over by a prefix watch between the nodes which own it
+// now, returning a redirect to each of them
+func (s *Server) prefixRedirects(event *dht_proto.WatchEvent) ([]*dht_proto.WatchEvent, error) {
+	var redirects []*dht_proto.WatchEvent
+
+	r := chord.KeyRange{Start: chord.Id(event.Start), End: chord.Id(event.End)}
+	for len(redirects) < MAX_REDIRECTS {
+		owner, _, err := s.node.FindSuccessor(r.Start+1, 0)
+		if err != nil {
+			return nil, status.Errorf(codes.Unavailable, "part of the range has moved and its owner could not be found: %v", err)
+		}
+
+		// The owner covers the rest of the range unless its identifier falls before the end
+		part := r
+		id := owner.Identifier()
+		if id != r.End && r.Contains(id) {
+			part.End = id
+		}
+
+		address := dhtAddress(chord.PeerOf(owner))
+		fmt.Printf("Redirecting prefix watch on range %v to %v\n", part, address)
+		redirects = append(redirects, &dht_proto.WatchEvent{
+			Type:        dht_proto.WatchEventType_REDIRECT,
+			ForwardNode: forwardNode(address),
+			Start:       int64(part.Start),
+			End:         int64(part.End),
+		})
+
+		if part.End == r.End {
+			return redirects, nil
+		}
+		r.Start = part.End
+	}
+
+	return redirects, nil
+}
+
+// serveWatch sends the events of a watch until the client goes away or the watch ends
+func (s *Server) serveWatch(w *watch, send func(*dht_proto.WatchEvent) error, done <-chan struct{}) error {
+	for {
+		select {
+		case event := <-w.events:
+			if event.Type == dht_proto.WatchEventType_REDIRECT {
+				redirects, err := s.prefixRedirects(event)
+				if err != nil {
+					return err
+				}
+				for _, redirect := range redirects {
+					err := send(redirect)
+					if err != nil {
+						return err
+					}
+				}
+				continue
+			}
+
+			err := send(clientEvent(event))
+			if err != nil {
+				return err
+			}
+
+		case <-w.moved:
+			// Nothing more is published to the watch, send what's left before redirecting
+			for {
+				select {
+				case event := <-w.events:
+					err := send(clientEvent(event))
+					if err != nil {
+						return err
+					}
+				default:
+					return errWatchMoved
+				}
+			}
+
+		case <-w.overflow:
+			return status.Error(codes.ResourceExhausted, "the watch fell too far behind, resubscribe to continue")
+
+		case <-done:
+			return nil
+
+		case <-s.shutdown:
+			return status.Error(codes.Unavailable, "the node is shutting down")
+		}
+	}
+}
+
+// errWatchMoved ends a key watch whose key has left the node's range
+var errWatchMoved = fmt.Errorf("the watched key has moved")
+
+func (s *Server) WatchKey(in *dht_proto.WatchKeyRequest, stream dht_proto.DHT_WatchKeyServer) error {
+	fmt.Printf("Received WatchKey for %v\n", in.Key)
+
+	key, err := requestKey(in.Namespace, in.Key)
+	if err != nil {
+		return err
+	}
+
+	w := s.watches.add(in.Namespace, in.Key, false, chord.KeyRange{})
+	defer s.watches.remove(w)
+
+	// The range is checked once the watch is registered, so a change in between isn't missed
+	if !s.node.OwnedRange().Contains(ChordIdFromString(key)) {
+		return s.watchRedirect(key, stream)
+	}
+
+	if entry, ok := s.keystore.Lookup(key); ok && !entry.Deleted {
+		err := stream.Send(&dht_proto.WatchEvent{
+			Type:    dht_proto.WatchEventType_SET,
+			Key:     in.Key,
+			Value:   entry.Value,
+			Version: entry.Version,
+			Expires: serializeExpiry(entry.Expires),
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	err = s.serveWatch(w, stream.Send, stream.Context().Done())
+	if err == errWatchMoved {
+		return s.watchRedirect(key, stream)
+	}
+
+	return err
+}
+
+func (s *Server) WatchPrefix(in *dht_proto.WatchPrefixRequest, stream dht_proto.DHT_WatchPrefixServer) error {
+	fmt.Printf("Received WatchPrefix for %v\n", in.Prefix)
+
+	_, err := requestKey(in.Namespace, in.Prefix)
+	if err != nil {
+		return err
+	}
+
+	w := s.watches.add(in.Namespace, in.Prefix, true, s.node.OwnedRange())
+	defer s.watches.remove(w)
+
+	return s.serveWatch(w, stream.Send, stream.Context().Done())
+}
@@ -0,0 +1,168 @@
+package dht
+
+import (
+	"chord_dht/chord"
+	dht_proto "chord_dht/protos/dht"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestWatchedStorePublishesChanges(t *testing.T) {
+	hub := newWatchHub()
+	store := &watchedStore{Store: CreateKeyStore(0), hub: hub}
+
+	key := hub.add("", "test", false, chord.KeyRange{})
+	prefix := hub.add("", "te", true, chord.KeyRange{})
+	defer hub.remove(key)
+	defer hub.remove(prefix)
+
+	store.SetExpiringKey("test", []byte("a"), 2, time.Time{})
+	store.Apply("test", []byte("stale"), 1, time.Time{}, false)
+	store.DeleteVersionedKey("test", 3)
+	store.SetExpiringKey("other", []byte("b"), 4, time.Time{})
+	store.SetExpiringKey("ten", []byte("c"), 5, time.Time{})
+
+	event := <-key.events
+	assert.Equal(t, dht_proto.WatchEventType_SET, event.Type)
+	assert.Equal(t, []byte("a"), event.Value)
+	assert.Equal(t, uint64(2), event.Version)
+
+	event = <-key.events
+	assert.Equal(t, dht_proto.WatchEventType_DELETE, event.Type)
+	assert.Equal(t, uint64(3), event.Version)
+	assert.Len(t, key.events, 0, "stale copies and other keys shouldn't be reported")
+
+	assert.Len(t, prefix.events, 3)
+}
+
+func TestPrefixWatchOnlyReportsOwnedKeys(t *testing.T) {
+	hub := newWatchHub()
+	store := &watchedStore{Store: CreateKeyStore(0), hub: hub}
+
+	owned := chord.KeyRange{Start: ChordIdFromString("a") - 1, End: ChordIdFromString("a")}
+	w := hub.add("", "", true, owned)
+	defer hub.remove(w)
+
+	// A copy kept for another owner
+	store.Apply("b", []byte("replica"), 1, time.Time{}, false)
+	assert.Len(t, w.events, 0)
+
+	store.SetExpiringKey("a", []byte("owned"), 2, time.Time{})
+	event := <-w.events
+	assert.Equal(t, "a", event.Key)
+	assert.Len(t, w.events, 0)
+}
+
+func TestWatchedStorePublishesExpiry(t *testing.T) {
+	hub := newWatchHub()
+	store := &watchedStore{Store: CreateKeyStore(0), hub: hub}
+
+	expires := time.Now().Add(time.Minute)
+	store.SetExpiringKey("test", []byte("a"), 1, expires)
+
+	w := hub.add("", "test", false, chord.KeyRange{})
+	defer hub.remove(w)
+
+	assert.Equal(t, 0, store.PurgeExpired(time.Now()))
+	assert.Len(t, w.events, 0)
+
+	assert.Equal(t, 1, store.PurgeExpired(expires))
+	event := <-w.events
+	assert.Equal(t, dht_proto.WatchEventType_EXPIRE, event.Type)
+	assert.Equal(t, uint64(1), event.Version)
+}
+
+func TestWatchEndsWhenKeyMoves(t *testing.T) {
+	s := &Server{watches: newWatchHub(), shutdown: make(chan struct{})}
+	id := ChordIdFromString("test")
+
+	w := s.watches.add("", "test", false, chord.KeyRange{})
+	prefix := s.watches.add("", "", true, chord.KeyRange{})
+	defer s.watches.remove(w)
+	defer s.watches.remove(prefix)
+
+	s.watches.publish(&dht_proto.WatchEvent{Key: "test", Version: 1})
+	s.watches.rangeChanged(chord.KeyRange{Start: id, End: id + 10})
+
+	// Nothing is published once the watch has ended
+	s.watches.publish(&dht_proto.WatchEvent{Key: "test", Version: 2})
+
+	var sent []*dht_proto.WatchEvent
+	err := s.serveWatch(w, func(event *dht_proto.WatchEvent) error {
+		sent = append(sent, event)
+		return nil
+	}, nil)
+
+	assert.Equal(t, errWatchMoved, err)
+	assert.Len(t, sent, 1, "buffered events should be sent before the watch ends")
+	assert.False(t, prefix.ended, "prefix watches follow the node's range")
+}
+
+func TestWatchEndsWhenFallingBehind(t *testing.T) {
+	s := &Server{watches: newWatchHub(), shutdown: make(chan struct{})}
+
+	w := s.watches.add("", "test", false, chord.KeyRange{})
+	defer s.watches.remove(w)
+
+	for i := 0; i <= WATCH_BUFFER_SIZE; i++ {
+		s.watches.publish(&dht_proto.WatchEvent{Key: "test", Version: uint64(i)})
+	}
+
+	err := s.serveWatch(w, func(event *dht_proto.WatchEvent) error {
+		return nil
+	}, nil)
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+}
+
+func TestHandedOver(t *testing.T) {
+	_, ok := handedOver(chord.KeyRange{Start: 10, End: 100}, chord.KeyRange{Start: 10, End: 100})
+	assert.False(t, ok)
+
+	// A new predecessor takes the start of the range
+	moved, ok := handedOver(chord.KeyRange{Start: 10, End: 100}, chord.KeyRange{Start: 50, End: 100})
+	assert.True(t, ok)
+	assert.Equal(t, chord.KeyRange{Start: 10, End: 50}, moved)
+
+	// The predecessor left, the range grew
+	_, ok = handedOver(chord.KeyRange{Start: 50, End: 100}, chord.KeyRange{Start: 10, End: 100})
+	assert.False(t, ok)
+
+	moved, ok = handedOver(chord.KeyRange{Start: 100, End: 100}, chord.KeyRange{Start: 50, End: 100})
+	assert.True(t, ok)
+	assert.Equal(t, chord.KeyRange{Start: 100, End: 50}, moved)
+}
+
+func TestPrefixWatchRedirectsMovedRange(t *testing.T) {
+	// The node still owns the published key once part of its range has moved
+	end := ChordIdFromString("test") + 10
+	s := &Server{node: chord.CreateNode(end), watches: newWatchHub(), shutdown: make(chan struct{})}
+
+	w := s.watches.add("", "", true, chord.KeyRange{Start: end - 90, End: end})
+	defer s.watches.remove(w)
+
+	s.watches.rangeChanged(chord.KeyRange{Start: end - 50, End: end})
+	s.watches.rangeChanged(chord.KeyRange{Start: end - 50, End: end})
+	s.watches.publish(&dht_proto.WatchEvent{Key: "test", Version: 1})
+	assert.False(t, w.ended)
+
+	done := make(chan struct{})
+	var sent []*dht_proto.WatchEvent
+	s.serveWatch(w, func(event *dht_proto.WatchEvent) error {
+		sent = append(sent, event)
+		if len(sent) == 2 {
+			close(done)
+		}
+		return nil
+	}, done)
+
+	assert.Len(t, sent, 2, "an unchanged range shouldn't redirect again")
+	assert.Equal(t, dht_proto.WatchEventType_REDIRECT, sent[0].Type)
+	assert.Equal(t, int64(end-90), sent[0].Start)
+	assert.Equal(t, int64(end-50), sent[0].End)
+	assert.NotNil(t, sent[0].ForwardNode)
+	assert.Equal(t, "test", sent[1].Key)
+}
@@ -5,10 +5,12 @@ import (
 	"chord_dht/dht"
 	"flag"
 	"fmt"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
@@ -22,24 +24,96 @@ var BOOTSTRAP_ADDRESS = flag.String("bootstrap", "", "The address and port of a
 
 var PORT = flag.Int("port", 0, "Port to listen on")
 
+var REPLICAS = flag.Int("replicas", 3, "The number of nodes which store a copy of each key")
+
+var TOMBSTONE_GRACE = flag.Duration("tombstone-grace", time.Hour, "How long deleted keys are remembered for before being garbage collected")
+
+var DHT_PORT = flag.Int("dht-port", dht.DHT_PORT, "Port to serve the DHT on, advertised to other nodes through the ring")
+
+var QUOTAS = flag.String("quotas", "", "Comma separated quotas for each namespace, of the form <namespace>=<keys>:<bytes>, 0 is unlimited")
+
+var DEFAULT_QUOTA = flag.String("default-quota", "0:0", "The quota of namespaces without one of their own, of the form <keys>:<bytes>, 0 is unlimited")
+
+var DATA_DIR = flag.String("data-dir", "", "The directory to persist keys to, keys are only held in memory if unset")
+
+var REDIS_PORT = flag.Int("redis-port", 0, "Port to serve the Redis protocol on, disabled if 0")
+
+var MEMCACHED_PORT = flag.Int("memcached-port", 0, "Port to serve the memcached text protocol on, disabled if 0")
+
+var SNAPSHOT_DIR = flag.String("snapshot-dir", "", "The directory snapshots are written to and restored from, snapshots are disabled if unset")
+
+var GATEWAY = flag.Bool("gateway", false, "Serve the HTTP/JSON gateway to the DHT alongside the metrics on :2112")
+
 func main() {
 	flag.Parse()
 
+	// The DHT's port is advertised from the moment the node joins, so peers don't fall back
+	// to the default port before it's registered
+	dhtListener, err := net.Listen("tcp", fmt.Sprintf("0.0.0.0:%v", *DHT_PORT))
+	if err != nil {
+		panic(err)
+	}
+
 	config := chord.BootstrapConfig{
 		ExternalAddr:  *EXTERNAL_ADDRESS,
 		BootstrapAddr: *BOOTSTRAP_ADDRESS,
 		Port:          *PORT,
+		Services: map[string]int{
+			dht.SERVICE_NAME: dhtListener.Addr().(*net.TCPAddr).Port,
+		},
 	}
+	quotas, err := dht.ParseQuotas(*QUOTAS)
+	if err != nil {
+		panic(err)
+	}
+	defaultQuota, err := dht.ParseQuota(*DEFAULT_QUOTA)
+	if err != nil {
+		panic(err)
+	}
+
 	node := chord.Bootstrap(config)
 
-	var server *dht.Server
-	go func() {
-		server = dht.StartDHT(node, 8081)
-	}()
+	var store dht.Store = dht.CreateKeyStore(node.Identifier())
+	if *DATA_DIR != "" {
+		disk, err := dht.OpenDiskStore(*DATA_DIR, node.Identifier())
+		if err != nil {
+			panic(err)
+		}
+		store = disk
+	}
+
+	server := dht.StartDHT(node, dht.Config{
+		Listener:          dhtListener,
+		ReplicationFactor: *REPLICAS,
+		TombstoneGrace:    *TOMBSTONE_GRACE,
+		Quotas:            quotas,
+		DefaultQuota:      defaultQuota,
+		Store:             store,
+		SnapshotDir:       *SNAPSHOT_DIR,
+	})
+
+	if *REDIS_PORT != 0 {
+		lis, err := net.Listen("tcp", fmt.Sprintf("0.0.0.0:%v", *REDIS_PORT))
+		if err != nil {
+			panic(err)
+		}
+		go server.ServeRESP(lis)
+	}
+
+	if *MEMCACHED_PORT != 0 {
+		lis, err := net.Listen("tcp", fmt.Sprintf("0.0.0.0:%v", *MEMCACHED_PORT))
+		if err != nil {
+			panic(err)
+		}
+		go server.ServeMemcached(lis)
+	}
 
 	go func() {
 		prometheus.Register(node.PrometheusRegistry())
 		http.Handle("/metrics", promhttp.Handler())
+		if *GATEWAY {
+			server.RegisterGateway(http.DefaultServeMux)
+		}
 		http.ListenAndServe(":2112", nil)
 	}()
 
@@ -0,0 +1,22 @@
+import sys
+
+import key_lib as dht
+
+def main():
+    if len(sys.argv) < 3:
+        print("Usage: client.py <address> <key>")
+        exit(1)
+
+    ENTRY_ADDRESS = f"{sys.argv[1]}:{dht.PORT}"
+    key = sys.argv[2]
+
+    try:
+        dht.delete_key(ENTRY_ADDRESS, key)
+    except Exception as e:
+        sys.stderr.write(f"Error deleting key: {e}")
+        sys.exit(1)
+
+    print(f"Key {key} deleted successfully")
+
+if __name__ == "__main__":
+    main()
@@ -5,28 +5,44 @@ import dht.dht_pb2_grpc
 
 PORT = 8081
 
-def set_key(addr: str, key: str, value: bytes):
+# Redirects carry the port of the owner's DHT server, older nodes leave it unset
+def forward_address(node) -> str:
+    return f"{node.address}:{node.port or PORT}"
+
+# With proxy set, the node at addr forwards the request to the owner itself, so there are no redirects to follow
+def set_key(addr: str, key: str, value: bytes, proxy: bool = False, namespace: str = ""):
     with grpc.insecure_channel(addr) as channel:
         stub = dht.dht_pb2_grpc.DHTStub(channel)
-        req = dht.dht_pb2.SetKeyRequest(key=key, value=value)
+        req = dht.dht_pb2.SetKeyRequest(key=key, value=value, proxy=proxy, namespace=namespace)
         res = stub.SetKey(req)
         if res.forwardNode.address:
-            forwardAddr = f"{res.forwardNode.address}:{PORT}"
+            forwardAddr = forward_address(res.forwardNode)
             #sys.stderr.write(f"forwarding to {res.forwardNode.address}")
-            return set_key(forwardAddr, key, value)
+            return set_key(forwardAddr, key, value, namespace=namespace)
         else:
             return res, addr
             
         
-def get_key(addr: str, key: str) -> bytes:
+def get_key(addr: str, key: str, proxy: bool = False, namespace: str = "") -> bytes:
     with grpc.insecure_channel(addr) as channel:
         stub = dht.dht_pb2_grpc.DHTStub(channel)
-        req = dht.dht_pb2.GetKeyRequest(key=key)
+        req = dht.dht_pb2.GetKeyRequest(key=key, proxy=proxy, namespace=namespace)
         res = stub.GetKey(req)
         if res.forwardNode.address:
-            forwardAddr = f"{res.forwardNode.address}:{PORT}"
+            forwardAddr = forward_address(res.forwardNode)
             #sys.stderr.write(f"forwarding to {res.forwardNode.address}")
-            _, value = get_key(forwardAddr, key)
+            _, value = get_key(forwardAddr, key, namespace=namespace)
             return res.pathLength, value
 
-        return  0, res.value
\ No newline at end of file
+        return  0, res.value
+
+def delete_key(addr: str, key: str, proxy: bool = False, namespace: str = ""):
+    with grpc.insecure_channel(addr) as channel:
+        stub = dht.dht_pb2_grpc.DHTStub(channel)
+        req = dht.dht_pb2.DeleteKeyRequest(key=key, proxy=proxy, namespace=namespace)
+        res = stub.DeleteKey(req)
+        if res.forwardNode.address:
+            forwardAddr = forward_address(res.forwardNode)
+            return delete_key(forwardAddr, key, namespace=namespace)
+        else:
+            return res, addr